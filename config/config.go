@@ -1,66 +1,81 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/kkyr/fig"
 )
 
-type InputSource struct {
-	Type string `fig:"type" validate:"required"`
-
-	Address string `fig:"address" validate:"required"`
-
-	// fs, whip
-	VideoFile string `fig:"video_file"`
-	AudioFile string `fig:"audio_file"`
-
-	// janus
-	ChannelID int `fig:"channel_id"`
-}
-
-type OutputSource struct {
-	Type string `fig:"type" validate:"required"`
-
-	Address string `fig:"address" validate:"required"`
-
-	// whep
+// Source is the TOML table of an input, output, service or orchestrator. Besides
+// `type`, its keys are decoded into the config of that type by its registry.
+type Source map[string]interface{}
 
-	Server        string `fig:"server"`
-	HTTPS         bool
-	HTTPSHostname string `fig:"https_hostname"`
-	HTTPSCert     string `fig:"https_cert"`
-	HTTPSKey      string `fig:"https_key"`
+// Type is the registered name of the implementation, eg: rtmp
+func (s Source) Type() string {
+	typ, _ := s["type"].(string)
+	return typ
 }
 
 type Config struct {
 	Input struct {
-		Sources []InputSource `fig:"sources"`
+		Sources []Source `fig:"sources"`
 	}
 
 	Output struct {
-		Sources []OutputSource `fig:"sources"`
+		Sources []Source `fig:"sources"`
 	}
 
-	Service struct {
-		Type string `fig:"type" validate:"required"`
-
-		Endpoint     string `fig:"endpoint"`
-		ClientID     string `fig:"client_id"`
-		ClientSecret string `fig:"client_secret"`
+	Service      Source `fig:"service"`
+	Orchestrator Source `fig:"orchestrator"`
+	// Auth picks how publishers are authenticated, the service stream key is the default
+	Auth Source `fig:"auth"`
+
+	// Access limits where publishers and viewers can connect from, and how often
+	// publishers can fail to authenticate before being locked out
+	Access struct {
+		// CIDRs or addresses, deny wins and everyone is allowed when allow is empty
+		PublishAllow []string `fig:"publish_allow"`
+		PublishDeny  []string `fig:"publish_deny"`
+		ViewAllow    []string `fig:"view_allow"`
+		ViewDeny     []string `fig:"view_deny"`
+
+		// Failures in a row per address before a lockout, zero disables it
+		MaxFailures   int           `fig:"max_failures" default:"5"`
+		Lockout       time.Duration `fig:"lockout" default:"1m"`
+		MaxLockout    time.Duration `fig:"max_lockout" default:"1h"`
+		FailureWindow time.Duration `fig:"failure_window" default:"10m"`
+		// Failures in a row per channel from any address before a lockout, zero disables it.
+		// It locks out the streamer's own key too, so it's well above max_failures.
+		ChannelMaxFailures int `fig:"channel_max_failures" default:"50"`
+
+		// AuditLog is a file every attempt is appended to as JSON, - is stdout
+		AuditLog string `fig:"audit_log"`
 	}
 
-	Orchestrator struct {
-		Type string `fig:"type" validate:"required"`
-
-		// rt orchestrator
-
-		Endpoint     string `fig:"endpoint"`
-		Key          string `fig:"key"`
-		WHEPEndpoint string `fig:"whep_endpoint"`
+	// Limits of this node, zero is unlimited
+	Limits struct {
+		MaxPublishers       int `fig:"max_publishers"`
+		MaxViewers          int `fig:"max_viewers"`
+		MaxViewersPerStream int `fig:"max_viewers_per_stream"`
+		// MaxStreamBitrate is the ingest bitrate of each stream in bits per second
+		MaxStreamBitrate int `fig:"max_stream_bitrate"`
+		// RetryAfter is how long rejected publishers and viewers are told to wait
+		RetryAfter time.Duration `fig:"retry_after" default:"30s"`
+	}
 
-		// ftl orchestrator
+	Webhook struct {
+		// Events are only sent when the URL is set
+		URL        string `fig:"url"`
+		Secret     string `fig:"secret"`
+		SecretFile string `fig:"secret_file"`
 
-		Address    string `fig:"address"`
-		RegionCode string `fig:"region_code"`
+		QueueSize  int           `fig:"queue_size" default:"1000"`
+		MaxRetries int           `fig:"max_retries" default:"5"`
+		Backoff    time.Duration `fig:"backoff" default:"1s"`
+		Timeout    time.Duration `fig:"timeout" default:"5s"`
 	}
 
 	Control struct {
@@ -73,17 +88,53 @@ type Config struct {
 		HTTPSHostname  string `fig:"https_hostname"`
 		HTTPSCert      string `fig:"https_cert"`
 		HTTPSKey       string `fig:"https_key"`
+		AdminToken     string `fig:"admin_token"`
+		AdminTokenFile string `fig:"admin_token_file"`
+
+		ReconnectGrace time.Duration `fig:"reconnect_grace"`
+		// TakeoverPolicy is reject or takeover, for publishers starting a channel that's already live
+		TakeoverPolicy          string            `fig:"takeover_policy" default:"reject"`
+		ChannelTakeoverPolicies map[string]string `fig:"channel_takeover_policies"`
+		// BFramePolicy is reject, warn or passthrough, for publishers sending H264 with B-frames
+		BFramePolicy          string            `fig:"bframe_policy" default:"warn"`
+		ChannelBFramePolicies map[string]string `fig:"channel_bframe_policies"`
+		ThumbnailInterval     time.Duration     `fig:"thumbnail_interval" default:"15s"`
+		// Packets of the latest GOP kept per video track for new viewers, negative disables it
+		GOPCacheSize int `fig:"gop_cache_size" default:"1500"`
+
+		DrainTimeout    time.Duration `fig:"drain_timeout" default:"30s"`
+		ShutdownTimeout time.Duration `fig:"shutdown_timeout" default:"10s"`
 
 		SaveVideo bool `fig:"save_video"`
 	}
 }
 
-func Load() (Config, error) {
+// EnvPrefix is prepended to every environment variable overriding the config, eg: WAVEGUIDE_CONTROL_LOG_LEVEL
+const EnvPrefix = "WAVEGUIDE"
+
+// Load reads the config file at path, then applies any WAVEGUIDE_* environment
+// variables and reads the secrets that were given as files.
+func Load(path string) (Config, error) {
 	var cfg Config
 
-	if err := fig.Load(&cfg, fig.File("config.toml"), fig.Dirs(".")); err != nil {
+	if err := fig.Load(&cfg,
+		fig.File(filepath.Base(path)),
+		fig.Dirs(filepath.Dir(path)),
+		fig.UseEnv(EnvPrefix),
+	); err != nil {
 		return cfg, err
 	}
 
+	if err := applySourceEnv(&cfg, os.Environ()); err != nil {
+		return cfg, err
+	}
+
+	if err := readSecretInto(&cfg.Webhook.Secret, cfg.Webhook.SecretFile); err != nil {
+		return cfg, fmt.Errorf("webhook.secret_file: %w", err)
+	}
+	if err := readSecretInto(&cfg.Control.AdminToken, cfg.Control.AdminTokenFile); err != nil {
+		return cfg, fmt.Errorf("control.admin_token_file: %w", err)
+	}
+
 	return cfg, nil
 }
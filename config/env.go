@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// applySourceEnv overrides the keys of the source tables, which fig can't do as
+// they're maps, eg:
+//
+//	WAVEGUIDE_SERVICE_CLIENT_SECRET=secret
+//	WAVEGUIDE_INPUT_SOURCES_0_ADDRESS=:1935
+func applySourceEnv(cfg *Config, environ []string) error {
+	for _, env := range environ {
+		name, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix+"_") {
+			continue
+		}
+		name = strings.TrimPrefix(name, EnvPrefix+"_")
+
+		var err error
+		switch {
+		case strings.HasPrefix(name, "SERVICE_"):
+			cfg.Service = setSourceKey(cfg.Service, strings.TrimPrefix(name, "SERVICE_"), value)
+		case strings.HasPrefix(name, "ORCHESTRATOR_"):
+			cfg.Orchestrator = setSourceKey(cfg.Orchestrator, strings.TrimPrefix(name, "ORCHESTRATOR_"), value)
+		case strings.HasPrefix(name, "AUTH_"):
+			cfg.Auth = setSourceKey(cfg.Auth, strings.TrimPrefix(name, "AUTH_"), value)
+		case strings.HasPrefix(name, "INPUT_SOURCES_"):
+			cfg.Input.Sources, err = setSourcesKey(cfg.Input.Sources, strings.TrimPrefix(name, "INPUT_SOURCES_"), value)
+		case strings.HasPrefix(name, "OUTPUT_SOURCES_"):
+			cfg.Output.Sources, err = setSourcesKey(cfg.Output.Sources, strings.TrimPrefix(name, "OUTPUT_SOURCES_"), value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s_%s: %w", EnvPrefix, name, err)
+		}
+	}
+
+	return nil
+}
+
+func setSourceKey(src Source, key, value string) Source {
+	if src == nil {
+		src = make(Source)
+	}
+	src[strings.ToLower(key)] = value
+	return src
+}
+
+// setSourcesKey handles INDEX_KEY, adding sources up to the index if needed
+func setSourcesKey(sources []Source, name, value string) ([]Source, error) {
+	index, key, ok := strings.Cut(name, "_")
+	i, err := strconv.Atoi(index)
+	if !ok || err != nil || i < 0 {
+		return sources, fmt.Errorf("expected the source index and key, eg: 0_ADDRESS")
+	}
+
+	for len(sources) <= i {
+		sources = append(sources, make(Source))
+	}
+	sources[i] = setSourceKey(sources[i], key, value)
+
+	return sources, nil
+}
+
+// ReadSecretFile reads a secret mounted as a file, without the trailing newline editors and tools like to add
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func readSecretInto(secret *string, path string) error {
+	if path == "" {
+		return nil
+	}
+	if *secret != "" {
+		return fmt.Errorf("the secret is set directly as well as from a file")
+	}
+
+	value, err := ReadSecretFile(path)
+	if err != nil {
+		return err
+	}
+	*secret = value
+	return nil
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplySourceEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Config{Service: Source{"type": "glimesh"}}
+	err := applySourceEnv(&cfg, []string{
+		"WAVEGUIDE_SERVICE_CLIENT_SECRET=secret",
+		"WAVEGUIDE_INPUT_SOURCES_1_TYPE=rtmp",
+		"WAVEGUIDE_INPUT_SOURCES_1_ADDRESS=:1935",
+		"HOME=/root",
+	})
+	assert.NoError(err)
+	assert.Equal(Source{"type": "glimesh", "client_secret": "secret"}, cfg.Service)
+	assert.Len(cfg.Input.Sources, 2)
+	assert.Equal(Source{"type": "rtmp", "address": ":1935"}, cfg.Input.Sources[1])
+
+	err = applySourceEnv(&cfg, []string{"WAVEGUIDE_OUTPUT_SOURCES_ADDRESS=:8080"})
+	assert.Error(err, "the source index is required")
+}
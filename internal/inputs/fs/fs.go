@@ -2,14 +2,17 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 	"github.com/sirupsen/logrus"
 )
@@ -18,12 +21,29 @@ type Source struct {
 	log     logrus.FieldLogger
 	control *control.Control
 
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+
 	// Listen address of the FS server in the ip:port format
 	Address   string
 	VideoFile string `mapstructure:"video_file"`
 	AudioFile string `mapstructure:"audio_file"`
 }
 
+type Config struct {
+	Address   string `fig:"address"`
+	VideoFile string `fig:"video_file"`
+	AudioFile string `fig:"audio_file"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	return nil
+}
+
 func New(address, videoFile, audioFile string) *Source {
 	return &Source{
 		Address:   address,
@@ -43,6 +63,16 @@ func (s *Source) SetLogger(log logrus.FieldLogger) {
 func (s *Source) Listen(ctx context.Context) {
 	s.log.Infof("Reading from FS for video=%s and audio=%s", s.VideoFile, s.AudioFile)
 
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		cancel()
+		return
+	}
+	s.cancel = cancel
+	s.mu.Unlock()
+
 	// Assert that we have an audio or video file
 	_, err := os.Stat(s.VideoFile)
 	haveVideoFile := !os.IsNotExist(err)
@@ -54,7 +84,7 @@ func (s *Source) Listen(ctx context.Context) {
 		panic("Could not find files")
 	}
 
-	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
 	if videoTrackErr != nil {
 		panic(videoTrackErr)
 	}
@@ -64,6 +94,7 @@ func (s *Source) Listen(ctx context.Context) {
 		panic(err)
 	}
 	stream.AddTrack(videoTrack, webrtc.MimeTypeH264)
+	stream.ReportMetadata(control.InputTypeMetadata("fs"))
 
 	go func() {
 		// Open a H264 file and start reading using our IVFReader
@@ -78,6 +109,16 @@ func (s *Source) Listen(ctx context.Context) {
 		}
 
 		h264FrameDuration := time.Millisecond * 33
+		h264FrameSamples := uint32(90000 * h264FrameDuration / time.Second)
+
+		packetizer := rtp.NewPacketizer(
+			1200,
+			96,
+			uint32(stream.ChannelID),
+			&codecs.H264Payloader{},
+			rtp.NewRandomSequencer(),
+			90000,
+		)
 
 		// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
 		// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
@@ -87,7 +128,11 @@ func (s *Source) Listen(ctx context.Context) {
 		// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
 		ticker := time.NewTicker(h264FrameDuration)
 		for ; true; <-ticker.C {
-			if ctx.Err() != nil || stream.Stopped() {
+			if stream.Stopped() {
+				return
+			}
+			if ctx.Err() != nil {
+				s.control.StopStream(stream.ChannelID)
 				return
 			}
 
@@ -100,9 +145,23 @@ func (s *Source) Listen(ctx context.Context) {
 				panic(h264Err)
 			}
 
-			if h264Err = videoTrack.WriteSample(media.Sample{Data: nal.Data, Duration: h264FrameDuration}); h264Err != nil {
-				panic(h264Err)
+			for _, p := range packetizer.Packetize(nal.Data, h264FrameSamples) {
+				if h264Err = stream.WriteRTP(videoTrack, p); h264Err != nil {
+					panic(h264Err)
+				}
 			}
 		}
 	}()
 }
+
+// Close stops reading the files and ends the stream
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
@@ -3,8 +3,13 @@ package ftl
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	auth "github.com/Glimesh/waveguide/pkg/auth"
 	control "github.com/Glimesh/waveguide/pkg/control"
 	ftlproto "github.com/Glimesh/waveguide/pkg/protocols/ftl"
 	types "github.com/Glimesh/waveguide/pkg/types"
@@ -18,9 +23,25 @@ type Source struct {
 	log     logrus.FieldLogger
 	control *control.Control
 
+	mu       sync.Mutex
+	srv      *ftlproto.Server
+	listener net.Listener
+	closed   bool
+
 	Address string
 }
 
+type Config struct {
+	Address string `fig:"address"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	return nil
+}
+
 func New(address string) *Source {
 	return &Source{
 		Address: address,
@@ -35,41 +56,89 @@ func (s *Source) SetLogger(log logrus.FieldLogger) {
 	s.log = log
 }
 
-func (s *Source) Listen(ctx context.Context) {
+// Bind takes the address before Listen, so a reload finds out when it's in use
+func (s *Source) Bind() error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", s.Address)
 	if err != nil {
-		s.log.Errorf("Failed: %+v", err)
-		return
+		return err
 	}
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
-		s.log.Errorf("Failed: %+v", err)
-		return
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Source) Listen(ctx context.Context) {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener == nil {
+		if err := s.Bind(); err != nil {
+			s.log.Errorf("Failed: %+v", err)
+			return
+		}
+		listener = s.listener
 	}
 
 	s.log.Infof("Starting FTL Server on %s", s.Address)
 
 	srv := ftlproto.NewServer(&ftlproto.ServerConfig{
 		Log: s.log,
+		Allow: func(conn net.Conn) bool {
+			return s.control.AllowPublisher("ftl", conn.RemoteAddr().String())
+		},
 		OnNewConnect: func(conn net.Conn) (net.Conn, *ftlproto.ConnConfig) {
 			return conn, &ftlproto.ConnConfig{
 				Handler: &connHandler{
 					control: s.control,
 					log:     s.log,
+					conn:    conn,
 				},
 			}
 		},
 	})
 
-	if err := srv.Serve(listener); err != nil {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return
+	}
+	s.srv = srv
+	s.mu.Unlock()
+
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, ftlproto.ErrServerClosed) {
 		s.log.Panicf("Failed: %+v", err)
 	}
 }
 
+// Close stops the FTL server from accepting new streams, live streams keep going
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.srv == nil {
+		// Bound but not serving yet, the listener is still ours to close
+		if s.listener != nil {
+			return s.listener.Close()
+		}
+		return nil
+	}
+	s.log.Infof("Closing FTL Server on %s", s.Address)
+	return s.srv.Close()
+}
+
 type connHandler struct {
 	control *control.Control
 	log     logrus.FieldLogger
+	conn    net.Conn
 
 	channelID types.ChannelID
 
@@ -78,15 +147,34 @@ type connHandler struct {
 	audioTrack *webrtc.TrackLocalStaticRTP
 
 	cancel chan bool
+	// disconnected is set when the client ends the stream on purpose, rather than dropping
+	disconnected bool
+	// takenOver is set when another publisher took the stream, it's not ours to stop anymore
+	takenOver int32
 }
 
-func (c *connHandler) OnConnect(channelID ftlproto.ChannelID) error {
+func (c *connHandler) OnConnect(channelID ftlproto.ChannelID, verify func(key []byte) bool) error {
 	c.channelID = types.ChannelID(channelID)
 
+	// FTL never sends the key, the client proves it has it by signing our challenge
+	grant, err := c.control.Authenticate(auth.Request{
+		ChannelID:  c.channelID,
+		Proof:      verify,
+		InputType:  "ftl",
+		RemoteAddr: c.conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		if auth.ReasonOf(err).Retryable() {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ftlproto.ErrInvalidHmacHash, err)
+	}
+
 	stream, err := c.control.StartStream(c.channelID)
 	if err != nil {
 		return err
 	}
+	stream.ApplyGrant(grant)
 	c.stream = stream
 
 	// Create a video track
@@ -104,7 +192,16 @@ func (c *connHandler) OnConnect(channelID ftlproto.ChannelID) error {
 	c.stream.AddTrack(c.videoTrack, webrtc.MimeTypeH264)
 	c.stream.AddTrack(c.audioTrack, webrtc.MimeTypeOpus)
 
+	c.stream.SetDisconnect(func(reason control.StopReason) {
+		c.log.Infof("Disconnecting publisher reason=%s", reason)
+		if reason == control.StopReasonTakeover {
+			atomic.StoreInt32(&c.takenOver, 1)
+		}
+		ftlproto.Terminate(c.conn)
+	})
+
 	c.stream.ReportMetadata(
+		control.InputTypeMetadata("ftl"),
 		control.AudioCodecMetadata(webrtc.MimeTypeOpus),
 		control.VideoCodecMetadata(webrtc.MimeTypeH264),
 	)
@@ -112,10 +209,6 @@ func (c *connHandler) OnConnect(channelID ftlproto.ChannelID) error {
 	return nil
 }
 
-func (c *connHandler) GetHmacKey() (string, error) {
-	return c.control.GetHmacKey(c.channelID)
-}
-
 func (c *connHandler) OnPlay(metadata ftlproto.FtlConnectionMetadata) error {
 	c.stream.ReportMetadata(
 		control.ClientVendorNameMetadata(metadata.VendorName),
@@ -133,11 +226,7 @@ func (c *connHandler) OnAudio(packet *rtp.Packet) error {
 		return errors.New("stream terminated")
 	}
 
-	err := c.audioTrack.WriteRTP(packet)
-
-	c.stream.ReportMetadata(control.AudioPacketsMetadata(1))
-
-	return err
+	return c.stream.WriteRTP(c.audioTrack, packet)
 }
 
 func (c *connHandler) OnVideo(packet *rtp.Packet) error {
@@ -148,18 +237,29 @@ func (c *connHandler) OnVideo(packet *rtp.Packet) error {
 		return errors.New("stream terminated")
 	}
 
-	// Write the RTP packet immediately, log after
-	err := c.videoTrack.WriteRTP(packet)
+	return c.stream.WriteRTP(c.videoTrack, packet)
+}
+
+func (c *connHandler) OnNack(count int) {
+	c.stream.ReportMetadata(control.NackPacketsMetadata(count))
+}
 
-	c.stream.ReportMetadata(control.VideoPacketsMetadata(1))
+func (c *connHandler) OnRTT(rtt time.Duration) {
+	c.stream.ReportMetadata(control.SourcePingMetadata(int(rtt.Milliseconds())))
+}
 
-	return err
+func (c *connHandler) OnDisconnect() {
+	c.disconnected = true
 }
 
 func (c *connHandler) OnClose() {
-	if c.control.ContextErr() == nil {
+	if c.control.ContextErr() == nil && atomic.LoadInt32(&c.takenOver) == 0 {
 		// This is the FTL => Control cancellation
 		// Only since if we're not the canceller.
-		c.control.StopStream(c.channelID)
+		if c.disconnected {
+			c.control.StopStream(c.channelID)
+		} else {
+			c.control.StreamDisconnected(c.channelID)
+		}
 	}
 }
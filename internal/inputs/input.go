@@ -1,7 +1,6 @@
 package input
 
 import (
-	"context"
 	"fmt"
 
 	"github.com/Glimesh/waveguide/config"
@@ -11,44 +10,41 @@ import (
 	"github.com/Glimesh/waveguide/internal/inputs/rtmp"
 	"github.com/Glimesh/waveguide/internal/inputs/whip"
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/registry"
 	"github.com/sirupsen/logrus"
 )
 
-type Inputs []control.Input
-
-func New(cfg config.Config, ctrl *control.Control, logger *logrus.Logger) (Inputs, error) {
-	sources := cfg.Input.Sources
-
-	inputs := make(Inputs, 0, len(sources))
+func init() {
+	registry.Register(control.InputTypes, "fs", func(cfg fs.Config) (control.Input, error) {
+		return fs.New(cfg.Address, cfg.VideoFile, cfg.AudioFile), nil
+	})
+	registry.Register(control.InputTypes, "janus", func(cfg janus.Config) (control.Input, error) {
+		return janus.New(cfg.Address, cfg.ChannelID), nil
+	})
+	registry.Register(control.InputTypes, "rtmp", func(cfg rtmp.Config) (control.Input, error) {
+		return rtmp.New(cfg.Address, rtmp.WithAudio(cfg.AudioConfig)), nil
+	})
+	registry.Register(control.InputTypes, "ftl", func(cfg ftl.Config) (control.Input, error) {
+		return ftl.New(cfg.Address), nil
+	})
+	registry.Register(control.InputTypes, "whip", func(cfg whip.Config) (control.Input, error) {
+		return whip.New(cfg.Address, cfg.VideoFile, cfg.AudioFile), nil
+	})
+}
 
-	for _, src := range sources {
-		var input control.Input
+// Inputs runs the [[input.sources]] and reloads them when the config changes
+type Inputs = control.Listeners[control.Input]
 
-		switch src.Type {
-		case "fs":
-			input = fs.New(src.Address, src.VideoFile, src.AudioFile)
-		case "janus":
-			input = janus.New(src.Address, src.ChannelID)
-		case "rtmp":
-			input = rtmp.New(src.Address)
-		case "ftl":
-			input = ftl.New(src.Address)
-		case "whip":
-			input = whip.New(src.Address, src.VideoFile, src.AudioFile)
-		default:
-			return nil, fmt.Errorf("unsupported input source type %s", src.Type)
-		}
-		input.SetControl(ctrl)
-		input.SetLogger(logger.WithFields(logrus.Fields{"input": src.Type}))
-		inputs = append(inputs, input)
-	}
-
-	return inputs, nil
+func New(ctrl *control.Control, logger *logrus.Logger) *Inputs {
+	return control.NewListeners("input", control.InputTypes, ctrl, logger)
 }
 
-func (in Inputs) Start(ctx context.Context) {
-	for i := range in {
-		input := in[i]
-		go input.Listen(ctx)
+// Validate checks every input source without creating them
+func Validate(cfg config.Config) error {
+	for i, src := range cfg.Input.Sources {
+		if err := control.InputTypes.Validate(src); err != nil {
+			return fmt.Errorf("input.sources[%d]: %w", i, err)
+		}
 	}
+	return nil
 }
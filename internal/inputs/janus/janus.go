@@ -4,15 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/Glimesh/waveguide/pkg/types"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 )
@@ -23,11 +26,28 @@ type Source struct {
 
 	channelID types.ChannelID
 
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+	stream *control.Stream
+
 	// Address to connect to for Janus
 	Address   string
 	ChannelID int `mapstructure:"channel_id"`
 }
 
+type Config struct {
+	Address   string `fig:"address"`
+	ChannelID int    `fig:"channel_id"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" || cfg.ChannelID == 0 {
+		return errors.New("address and channel_id are required")
+	}
+	return nil
+}
+
 func New(address string, channelID int) control.Input {
 	return &Source{
 		Address:   address,
@@ -67,6 +87,16 @@ func (s *Source) Listen(ctx context.Context) {
 
 	s.channelID = types.ChannelID(s.ChannelID)
 
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		cancel()
+		return
+	}
+	s.cancel = cancel
+	s.mu.Unlock()
+
 	values := map[string]string{"janus": "create", "transaction": randString()}
 
 	jsonValue, _ := json.Marshal(values)
@@ -89,14 +119,21 @@ func (s *Source) Listen(ctx context.Context) {
 		keepAlive, _ := json.Marshal(map[string]string{"janus": "keepalive", "session_id": fmt.Sprint(createResponse.Data.Id), "transaction": randString()})
 
 		for {
-			r, err := http.Post(sessionUrl, "application/json", bytes.NewBuffer(keepAlive))
-			if err != nil {
+			r, err := s.post(ctx, sessionUrl, keepAlive)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
 				panic(err)
 			}
 			// body, _ := ioutil.ReadAll(r.Body)
 			// fmt.Printf("Keepalive: %s\n", body)
 			r.Body.Close()
-			time.Sleep(20 * time.Second)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(20 * time.Second):
+			}
 		}
 	}()
 
@@ -144,10 +181,16 @@ func (s *Source) Listen(ctx context.Context) {
 	// Long-poll
 	go func() {
 		for {
-			longPoll, err := http.Get(sessionUrl)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, sessionUrl, nil)
 			if err != nil {
 				panic(err)
 			}
+			longPoll, err := http.DefaultClient.Do(req)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				panic(err)
+			}
 
 			var offerResponse janusFtlOfferResponse
 			if err := json.NewDecoder(longPoll.Body).Decode(&offerResponse); err != nil {
@@ -167,11 +210,44 @@ func (s *Source) Listen(ctx context.Context) {
 	}()
 }
 
+// Close stops polling Janus and ends the stream
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.stream != nil && !s.stream.Stopped() {
+		return s.control.StopStream(s.channelID)
+	}
+	return nil
+}
+
+func (s *Source) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req)
+}
+
 func (s *Source) negotiate(sdpString string, pluginUrl string) {
 	stream, err := s.control.StartStream(types.ChannelID(s.ChannelID))
-	if err != nil {
+	if errors.Is(err, control.ErrDraining) {
+		s.log.Warn("Not starting the janus stream, the node is draining")
+		return
+	} else if errors.Is(err, control.ErrAtCapacity) {
+		s.log.Warnf("Not starting the janus stream: %v", err)
+		return
+	} else if err != nil {
 		panic(err)
 	}
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
 
 	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
 	if videoTrackErr != nil {
@@ -187,6 +263,7 @@ func (s *Source) negotiate(sdpString string, pluginUrl string) {
 	stream.AddTrack(audioTrack, webrtc.MimeTypeOpus)
 
 	stream.ReportMetadata(
+		control.InputTypeMetadata("janus"),
 		control.AudioCodecMetadata(webrtc.MimeTypeOpus),
 		control.VideoCodecMetadata(webrtc.MimeTypeH264),
 		control.ClientVendorNameMetadata("waveguide-janus-input"),
@@ -210,6 +287,17 @@ func (s *Source) negotiate(sdpString string, pluginUrl string) {
 		panic(err)
 	}
 
+	stream.SetDisconnect(func(reason control.StopReason) {
+		s.log.Infof("Disconnecting from janus reason=%s", reason)
+		if reason == control.StopReasonTakeover {
+			// The stream is someone else's now, Close mustn't stop it
+			s.mu.Lock()
+			s.stream = nil
+			s.mu.Unlock()
+		}
+		peerConnection.Close()
+	})
+
 	// We must offer to send media for Janus to send anything
 	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
@@ -237,11 +325,15 @@ func (s *Source) negotiate(sdpString string, pluginUrl string) {
 				if err != nil {
 					panic(err)
 				}
-				audioTrack.WriteRTP(p)
-				stream.ReportMetadata(control.AudioPacketsMetadata(1))
+				stream.WriteRTP(audioTrack, p)
 			}
 		} else if codec.MimeType == "video/H264" {
 			s.log.Info("Got H264 track, sending to video track")
+			stream.SetKeyframeRequester(func() error {
+				return peerConnection.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+				})
+			})
 			for {
 				if err := s.control.ContextErr(); err != nil {
 					return
@@ -251,8 +343,7 @@ func (s *Source) negotiate(sdpString string, pluginUrl string) {
 				if err != nil {
 					panic(err)
 				}
-				videoTrack.WriteRTP(p)
-				stream.ReportMetadata(control.VideoPacketsMetadata(1))
+				stream.WriteRTP(videoTrack, p)
 			}
 		}
 	})
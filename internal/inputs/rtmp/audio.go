@@ -0,0 +1,217 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+const (
+	// opusSampleRate and opusChannels are what the AAC audio is converted to for the Opus encoder
+	opusSampleRate = 48000
+	opusChannels   = 2
+	// opusFrameSize is 20ms of samples per channel
+	opusFrameSize = 960
+	// opusFECPacketLoss is the packet loss the encoder expects with FEC on, it won't add FEC without some
+	opusFECPacketLoss = 10
+)
+
+var aacSampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseAudioSpecificConfig reads the sample rate and channels from the AAC sequence header
+func parseAudioSpecificConfig(asc []byte) (sampleRate int, channels int, err error) {
+	r := bitReader{data: asc}
+
+	objectType := r.read(5)
+	if objectType == 31 {
+		r.read(6)
+	}
+	if index := r.read(4); index == 15 {
+		sampleRate = int(r.read(24))
+	} else if int(index) < len(aacSampleRates) {
+		sampleRate = aacSampleRates[index]
+	}
+	channels = int(r.read(4))
+
+	if r.overrun || sampleRate == 0 {
+		return 0, 0, fmt.Errorf("invalid AAC audio specific config %s", hex.EncodeToString(asc))
+	}
+	// Channel config 0 leaves the layout to the stream, we'll know it after decoding
+	if channels == 0 {
+		channels = opusChannels
+	}
+	return sampleRate, channels, nil
+}
+
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.overrun = true
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return v
+}
+
+// center and surround channels are mixed into left and right 3dB down
+const downmixLevel = 0.7071
+
+var (
+	downmixFront      = [][2]float64{{1, 0}, {0, 1}, {downmixLevel, downmixLevel}}
+	downmixLFE        = [2]float64{0, 0}
+	downmixLeftBack   = [2]float64{downmixLevel, 0}
+	downmixRightBack  = [2]float64{0, downmixLevel}
+	downmixCenterBack = [2]float64{0.5, 0.5}
+)
+
+// downmixWeights are the left and right weight of each channel by the channel count,
+// in the order fdk-aac decodes them: L R C LFE Ls Rs then the back pair for 7.1
+var downmixWeights = map[int][][2]float64{
+	3: downmix(downmixFront),
+	4: downmix(downmixFront, downmixCenterBack),
+	5: downmix(downmixFront, downmixLeftBack, downmixRightBack),
+	6: downmix(downmixFront, downmixLFE, downmixLeftBack, downmixRightBack),
+	8: downmix(downmixFront, downmixLFE, downmixLeftBack, downmixRightBack, downmixLeftBack, downmixRightBack),
+}
+
+// downmix scales the weights so a full scale mix doesn't clip
+func downmix(front [][2]float64, rest ...[2]float64) [][2]float64 {
+	weights := append(append([][2]float64{}, front...), rest...)
+	var total [2]float64
+	for _, weight := range weights {
+		total[0] += weight[0]
+		total[1] += weight[1]
+	}
+	for i := range weights {
+		weights[i][0] /= total[0]
+		weights[i][1] /= total[1]
+	}
+	return weights
+}
+
+// resampler converts the decoded 16 bit PCM to 48kHz stereo with linear
+// interpolation, mono is copied to both channels and surround is downmixed
+type resampler struct {
+	rate     int
+	channels int
+	// weights downmixes surround, layouts we don't know keep their first two channels
+	weights [][2]float64
+
+	started bool
+	// prev is the last input frame, the next output may fall between it and the next input
+	prev [opusChannels]int16
+	// pos is where the next output frame is in input frames after prev
+	pos float64
+}
+
+func newResampler(rate, channels int) *resampler {
+	return &resampler{
+		rate:     rate,
+		channels: channels,
+		weights:  downmixWeights[channels],
+	}
+}
+
+// stereo reads one frame of the decoded PCM as left and right
+func (r *resampler) stereo(frame []byte) (left, right int16) {
+	sample := func(c int) int16 {
+		return int16(binary.LittleEndian.Uint16(frame[2*c:]))
+	}
+	switch {
+	case r.channels == 1:
+		return sample(0), sample(0)
+	case r.weights == nil:
+		return sample(0), sample(1)
+	}
+
+	var mixed [2]float64
+	for c, weight := range r.weights {
+		mixed[0] += float64(sample(c)) * weight[0]
+		mixed[1] += float64(sample(c)) * weight[1]
+	}
+	return int16(math.Round(mixed[0])), int16(math.Round(mixed[1]))
+}
+
+func (r *resampler) resample(pcm []byte) []int16 {
+	frames := len(pcm) / (2 * r.channels)
+	if frames == 0 {
+		return nil
+	}
+
+	// The input as stereo frames, starting with prev
+	in := make([]int16, 0, (frames+1)*opusChannels)
+	in = append(in, r.prev[:]...)
+	for i := 0; i < frames; i++ {
+		left, right := r.stereo(pcm[i*2*r.channels:])
+		in = append(in, left, right)
+	}
+	if !r.started {
+		r.started = true
+		in[0], in[1] = in[2], in[3]
+	}
+	copy(r.prev[:], in[len(in)-opusChannels:])
+
+	if r.rate == opusSampleRate {
+		return in[opusChannels:]
+	}
+
+	step := float64(r.rate) / opusSampleRate
+	out := make([]int16, 0, int(float64(frames)/step+1)*opusChannels)
+	for ; r.pos < float64(frames); r.pos += step {
+		i := int(r.pos)
+		frac := r.pos - float64(i)
+		for c := 0; c < opusChannels; c++ {
+			a := float64(in[i*opusChannels+c])
+			b := float64(in[(i+1)*opusChannels+c])
+			out = append(out, int16(a+(b-a)*frac))
+		}
+	}
+	r.pos -= float64(frames)
+
+	return out
+}
+
+// aacPayloader packetizes raw AAC frames as RFC 3640 AAC-hbr, one frame per
+// packet with frames too big for one packet fragmented
+type aacPayloader struct{}
+
+// aacFmtp describes the AAC-hbr packets aacPayloader makes, config is the audio specific config
+func aacFmtp(config []byte) string {
+	return "streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=" + hex.EncodeToString(config)
+}
+
+func (p *aacPayloader) Payload(mtu uint16, payload []byte) [][]byte {
+	// AU-headers-length then a single AU-header of 13 bits of size and 3 of index
+	const headerSize = 4
+	if len(payload) == 0 || len(payload) >= 1<<13 || int(mtu) <= headerSize {
+		return nil
+	}
+
+	var payloads [][]byte
+	for remaining := payload; len(remaining) > 0; {
+		size := len(remaining)
+		if size > int(mtu)-headerSize {
+			size = int(mtu) - headerSize
+		}
+
+		out := make([]byte, headerSize+size)
+		binary.BigEndian.PutUint16(out[0:], 16)
+		// Fragments carry the size of the whole frame
+		binary.BigEndian.PutUint16(out[2:], uint16(len(payload))<<3)
+		copy(out[headerSize:], remaining[:size])
+		payloads = append(payloads, out)
+
+		remaining = remaining[size:]
+	}
+	return payloads
+}
@@ -0,0 +1,179 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name       string
+		asc        []byte
+		sampleRate int
+		channels   int
+		err        bool
+	}{
+		{name: "48k stereo", asc: []byte{0x11, 0x90}, sampleRate: 48000, channels: 2},
+		{name: "44.1k mono", asc: []byte{0x12, 0x08}, sampleRate: 44100, channels: 1},
+		{name: "22.05k mono", asc: []byte{0x13, 0x88}, sampleRate: 22050, channels: 1},
+		{name: "5.1", asc: []byte{0x11, 0xb0}, sampleRate: 48000, channels: 6},
+		{name: "escape index 15 carries the rate", asc: []byte{0x17, 0x80, 0x5d, 0xc0, 0x10}, sampleRate: 48000, channels: 2},
+		{name: "escaped object type", asc: []byte{0xf8, 0x26, 0x20}, sampleRate: 48000, channels: 1},
+		{name: "channel config 0 is left to the stream", asc: []byte{0x11, 0x80}, sampleRate: 48000, channels: opusChannels},
+		{name: "reserved sample rate index", asc: []byte{0x16, 0x90}, err: true},
+		{name: "truncated", asc: []byte{0x11}, err: true},
+		{name: "truncated escaped rate", asc: []byte{0x17, 0x80, 0x5d}, err: true},
+	}
+
+	for _, test := range tests {
+		sampleRate, channels, err := parseAudioSpecificConfig(test.asc)
+		if test.err {
+			assert.Error(err, test.name)
+			continue
+		}
+		if assert.NoError(err, test.name) {
+			assert.Equal(test.sampleRate, sampleRate, test.name)
+			assert.Equal(test.channels, channels, test.name)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	assert := assert.New(t)
+
+	pcm := func(samples ...int16) []byte {
+		out := make([]byte, 2*len(samples))
+		for i, sample := range samples {
+			binary.LittleEndian.PutUint16(out[2*i:], uint16(sample))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		rate     int
+		channels int
+		chunks   [][]byte
+		expected []int16
+	}{
+		{
+			name:     "48k stereo passes through",
+			rate:     48000,
+			channels: 2,
+			chunks:   [][]byte{pcm(1, 2, 3, 4), pcm(5, 6)},
+			expected: []int16{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:     "mono is copied to both channels",
+			rate:     48000,
+			channels: 1,
+			chunks:   [][]byte{pcm(100, -100)},
+			expected: []int16{100, 100, -100, -100},
+		},
+		{
+			name:     "24k is interpolated across chunks",
+			rate:     24000,
+			channels: 1,
+			chunks:   [][]byte{pcm(0, 100), pcm(200)},
+			// The first output starts on the first input, so it runs one input behind
+			expected: []int16{0, 0, 0, 0, 0, 0, 50, 50, 100, 100, 150, 150},
+		},
+		{
+			name:     "5.1 is downmixed without the LFE",
+			rate:     48000,
+			channels: 6,
+			// L R C LFE Ls Rs
+			chunks:   [][]byte{pcm(10000, 0, 0, 10000, 0, 0), pcm(0, 0, 10000, 0, 0, 10000), pcm(-10000, -10000, -10000, -10000, -10000, -10000)},
+			expected: []int16{4142, 0, 2929, 5858, -10000, -10000},
+		},
+		{
+			name:     "unknown layouts keep the first two channels",
+			rate:     48000,
+			channels: 7,
+			chunks:   [][]byte{pcm(1, 2, 3, 4, 5, 6, 7)},
+			expected: []int16{1, 2},
+		},
+		{
+			name:     "partial frames are dropped",
+			rate:     48000,
+			channels: 2,
+			chunks:   [][]byte{pcm(1)},
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		r := newResampler(test.rate, test.channels)
+		var out []int16
+		for _, chunk := range test.chunks {
+			out = append(out, r.resample(chunk)...)
+		}
+		assert.Equal(test.expected, out, test.name)
+	}
+
+	// Common rates come out at 48k, a second of input is a second of output
+	for _, rate := range []int{44100, 22050, 32000} {
+		r := newResampler(rate, 1)
+		frames := 0
+		for i := 0; i < 50; i++ {
+			frames += len(r.resample(make([]byte, 2*rate/50))) / opusChannels
+		}
+		assert.InDelta(opusSampleRate, frames, 1, "%d mono", rate)
+	}
+}
+
+func TestAACPayloader(t *testing.T) {
+	assert := assert.New(t)
+
+	frame := func(size int) []byte {
+		return bytes.Repeat([]byte{0xaa}, size)
+	}
+	// header is the AU-headers-length and the AU-header for a frame of size bytes
+	header := func(size int) []byte {
+		return []byte{0x00, 0x10, byte(size >> 5), byte(size << 3)}
+	}
+
+	tests := []struct {
+		name     string
+		mtu      uint16
+		payload  []byte
+		expected [][]byte
+	}{
+		{
+			name:     "one frame per packet",
+			mtu:      1200,
+			payload:  frame(100),
+			expected: [][]byte{append(header(100), frame(100)...)},
+		},
+		{
+			name:     "exactly fills the mtu",
+			mtu:      104,
+			payload:  frame(100),
+			expected: [][]byte{append(header(100), frame(100)...)},
+		},
+		{
+			name:    "bigger than the mtu is fragmented",
+			mtu:     1200,
+			payload: frame(2500),
+			// Every fragment carries the size of the whole frame
+			expected: [][]byte{
+				append(header(2500), frame(1196)...),
+				append(header(2500), frame(1196)...),
+				append(header(2500), frame(108)...),
+			},
+		},
+		{name: "empty", mtu: 1200, payload: nil},
+		{name: "too big for the size field", mtu: 1200, payload: frame(1 << 13)},
+		{name: "no room after the header", mtu: 4, payload: frame(10)},
+	}
+
+	for _, test := range tests {
+		var p aacPayloader
+		assert.Equal(test.expected, p.Payload(test.mtu, test.payload), test.name)
+	}
+}
@@ -0,0 +1,158 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/rtp/pkg/obu"
+	"github.com/pion/webrtc/v3"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// Enhanced RTMP video tags, see https://veovera.org/docs/enhanced/enhanced-rtmp-v2
+const (
+	exVideoHeader = 0x80
+
+	exPacketTypeSequenceStart        = 0
+	exPacketTypeCodedFrames          = 1
+	exPacketTypeSequenceEnd          = 2
+	exPacketTypeCodedFramesX         = 3
+	exPacketTypeMetadata             = 4
+	exPacketTypeMPEG2TSSequenceStart = 5
+)
+
+// exVideoCodecs maps the FourCC of enhanced RTMP video tags to the codec we
+// publish, codecs mapped to nothing are known but can't be played by WebRTC viewers
+var exVideoCodecs = map[string]string{
+	"avc1": webrtc.MimeTypeH264,
+	"av01": webrtc.MimeTypeAV1,
+	"vp09": webrtc.MimeTypeVP9,
+	"hvc1": "",
+}
+
+type videoPacketType int
+
+const (
+	videoSequenceStart videoPacketType = iota
+	videoCodedFrames
+	videoSequenceEnd
+	// videoSkipped is anything we have no use for, eg: command frames and metadata
+	videoSkipped
+)
+
+// videoFrame is a video tag with the legacy and enhanced headers taken off
+type videoFrame struct {
+	frameType       flvtag.FrameType
+	packetType      videoPacketType
+	compositionTime int32
+	data            []byte
+}
+
+func (f videoFrame) keyframe() bool {
+	return f.frameType == flvtag.FrameTypeKeyFrame
+}
+
+func isExVideoTag(data []byte) bool {
+	return len(data) > 0 && data[0]&exVideoHeader != 0
+}
+
+// parseExVideoTag reads an enhanced RTMP video tag, it returns the FourCC of the codec
+func parseExVideoTag(data []byte) (videoFrame, string, error) {
+	if len(data) < 5 {
+		return videoFrame{}, "", errors.New("enhanced video tag is too short")
+	}
+
+	frame := videoFrame{
+		frameType: flvtag.FrameType((data[0] >> 4) & 0b0111),
+	}
+	packetType := data[0] & 0b1111
+	fourCC := string(data[1:5])
+	data = data[5:]
+
+	switch packetType {
+	case exPacketTypeSequenceStart:
+		frame.packetType = videoSequenceStart
+	case exPacketTypeCodedFrames:
+		frame.packetType = videoCodedFrames
+		// Only the codecs with B-frames send a composition time offset
+		if fourCC == "avc1" || fourCC == "hvc1" {
+			if len(data) < 3 {
+				return videoFrame{}, "", errors.New("enhanced video tag is missing its composition time")
+			}
+			// SI24
+			frame.compositionTime = int32(uint32(data[0])<<24|uint32(data[1])<<16|uint32(data[2])<<8) >> 8
+			data = data[3:]
+		}
+	case exPacketTypeCodedFramesX:
+		frame.packetType = videoCodedFrames
+	case exPacketTypeSequenceEnd:
+		frame.packetType = videoSequenceEnd
+	case exPacketTypeMetadata, exPacketTypeMPEG2TSSequenceStart:
+		frame.packetType = videoSkipped
+	default:
+		// Multitrack and ModEx
+		return videoFrame{}, "", fmt.Errorf("unsupported enhanced video packet type %d", packetType)
+	}
+
+	if frame.frameType == flvtag.FrameTypeVideoInfoCommandFrame {
+		frame.packetType = videoSkipped
+	}
+	frame.data = data
+
+	return frame, fourCC, nil
+}
+
+const (
+	obuSequenceHeader    = 1
+	obuTemporalDelimiter = 2
+)
+
+// av1TemporalUnit drops the temporal delimiters, which don't go over RTP, and adds
+// the sequence header to keyframes that don't carry it so viewers can start on them
+func av1TemporalUnit(data, sequenceHeader []byte, keyframe bool) ([]byte, error) {
+	out := make([]byte, 0, len(data)+len(sequenceHeader))
+	hasSequenceHeader := false
+
+	for pos := 0; pos < len(data); {
+		header := data[pos]
+		obuType := (header >> 3) & 0b1111
+		hasExtension := header&0b100 != 0
+		hasSize := header&0b10 != 0
+
+		headerSize := 1
+		if hasExtension {
+			headerSize++
+		}
+		if pos+headerSize > len(data) {
+			return nil, errors.New("truncated av1 obu header")
+		}
+
+		end := len(data)
+		if hasSize {
+			size, n, err := obu.ReadLeb128(data[pos+headerSize:])
+			if err != nil {
+				return nil, err
+			}
+			end = pos + headerSize + int(n) + int(size)
+			if end > len(data) {
+				return nil, errors.New("truncated av1 obu")
+			}
+		}
+
+		switch obuType {
+		case obuTemporalDelimiter:
+		case obuSequenceHeader:
+			hasSequenceHeader = true
+			out = append(out, data[pos:end]...)
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	if keyframe && !hasSequenceHeader && len(sequenceHeader) > 0 {
+		out = append(append([]byte{}, sequenceHeader...), out...)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,173 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp/pkg/obu"
+	"github.com/stretchr/testify/assert"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+func TestParseExVideoTag(t *testing.T) {
+	assert := assert.New(t)
+
+	// exTag builds an enhanced video tag header, eg: exTag(1, 1, "avc1") for a keyframe of coded frames
+	exTag := func(frameType, packetType byte, fourCC string, data ...byte) []byte {
+		return append(append([]byte{exVideoHeader | frameType<<4 | packetType}, fourCC...), data...)
+	}
+
+	tests := []struct {
+		name   string
+		tag    []byte
+		frame  videoFrame
+		fourCC string
+		err    bool
+	}{
+		{
+			name:   "avc1 keyframe with a composition time",
+			tag:    exTag(1, exPacketTypeCodedFrames, "avc1", 0x00, 0x00, 0x21, 0xaa),
+			frame:  videoFrame{frameType: flvtag.FrameTypeKeyFrame, packetType: videoCodedFrames, compositionTime: 33, data: []byte{0xaa}},
+			fourCC: "avc1",
+		},
+		{
+			name:   "negative composition time is sign extended",
+			tag:    exTag(2, exPacketTypeCodedFrames, "avc1", 0xff, 0xff, 0xdf, 0xbb),
+			frame:  videoFrame{frameType: flvtag.FrameTypeInterFrame, packetType: videoCodedFrames, compositionTime: -33, data: []byte{0xbb}},
+			fourCC: "avc1",
+		},
+		{
+			name:   "most negative composition time",
+			tag:    exTag(2, exPacketTypeCodedFrames, "hvc1", 0x80, 0x00, 0x00),
+			frame:  videoFrame{frameType: flvtag.FrameTypeInterFrame, packetType: videoCodedFrames, compositionTime: -1 << 23, data: []byte{}},
+			fourCC: "hvc1",
+		},
+		{
+			name:   "coded frames x have no composition time",
+			tag:    exTag(2, exPacketTypeCodedFramesX, "avc1", 0xcc),
+			frame:  videoFrame{frameType: flvtag.FrameTypeInterFrame, packetType: videoCodedFrames, data: []byte{0xcc}},
+			fourCC: "avc1",
+		},
+		{
+			name:   "av1 coded frames have no composition time",
+			tag:    exTag(1, exPacketTypeCodedFrames, "av01", 0x12, 0x00),
+			frame:  videoFrame{frameType: flvtag.FrameTypeKeyFrame, packetType: videoCodedFrames, data: []byte{0x12, 0x00}},
+			fourCC: "av01",
+		},
+		{
+			name:   "sequence start",
+			tag:    exTag(1, exPacketTypeSequenceStart, "vp09", 0x01),
+			frame:  videoFrame{frameType: flvtag.FrameTypeKeyFrame, packetType: videoSequenceStart, data: []byte{0x01}},
+			fourCC: "vp09",
+		},
+		{
+			name:   "sequence end",
+			tag:    exTag(1, exPacketTypeSequenceEnd, "av01"),
+			frame:  videoFrame{frameType: flvtag.FrameTypeKeyFrame, packetType: videoSequenceEnd, data: []byte{}},
+			fourCC: "av01",
+		},
+		{
+			name:   "metadata is skipped",
+			tag:    exTag(1, exPacketTypeMetadata, "av01", 0x02),
+			frame:  videoFrame{frameType: flvtag.FrameTypeKeyFrame, packetType: videoSkipped, data: []byte{0x02}},
+			fourCC: "av01",
+		},
+		{
+			name:   "command frames are skipped",
+			tag:    exTag(5, exPacketTypeCodedFrames, "av01", 0x00),
+			frame:  videoFrame{frameType: flvtag.FrameTypeVideoInfoCommandFrame, packetType: videoSkipped, data: []byte{0x00}},
+			fourCC: "av01",
+		},
+		{name: "too short for the fourcc", tag: []byte{0x91, 'a', 'v', 'c'}, err: true},
+		{name: "truncated composition time", tag: exTag(1, exPacketTypeCodedFrames, "avc1", 0x00, 0x00), err: true},
+		{name: "multitrack", tag: exTag(1, 6, "avc1"), err: true},
+		{name: "modex", tag: exTag(1, 7, "avc1"), err: true},
+	}
+
+	for _, test := range tests {
+		assert.True(isExVideoTag(test.tag), test.name)
+
+		frame, fourCC, err := parseExVideoTag(test.tag)
+		if test.err {
+			assert.Error(err, test.name)
+			continue
+		}
+		if assert.NoError(err, test.name) {
+			assert.Equal(test.frame, frame, test.name)
+			assert.Equal(test.fourCC, fourCC, test.name)
+		}
+	}
+
+	assert.False(isExVideoTag([]byte{0x17, 0x01}), "legacy avc keyframe")
+}
+
+func TestAV1TemporalUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	// OBUs with their size field set, the header is type << 3 | has size
+	temporalDelimiter := []byte{0x12, 0x00}
+	sequenceHeader := []byte{0x0a, 0x02, 0x01, 0x02}
+	otherSequenceHeader := []byte{0x0a, 0x02, 0x03, 0x04}
+	frame := []byte{0x32, 0x03, 0x0a, 0x0b, 0x0c}
+	bigFrame := append([]byte{0x32, 0x80, 0x01}, bytes.Repeat([]byte{0xff}, 128)...)
+
+	join := func(obus ...[]byte) []byte {
+		return bytes.Join(obus, nil)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		keyframe bool
+		expected []byte
+		err      string
+	}{
+		{
+			name:     "temporal delimiters are dropped",
+			data:     join(temporalDelimiter, frame),
+			expected: frame,
+		},
+		{
+			name:     "keyframes get the sequence header",
+			data:     join(temporalDelimiter, frame),
+			keyframe: true,
+			expected: join(sequenceHeader, frame),
+		},
+		{
+			name:     "keyframes carrying a sequence header keep theirs",
+			data:     join(temporalDelimiter, otherSequenceHeader, frame),
+			keyframe: true,
+			expected: join(otherSequenceHeader, frame),
+		},
+		{
+			name:     "multi byte sizes",
+			data:     join(temporalDelimiter, bigFrame, frame),
+			expected: join(bigFrame, frame),
+		},
+		{
+			name:     "without a size the obu runs to the end",
+			data:     join(temporalDelimiter, []byte{0x30, 0x01, 0x02, 0x03}),
+			expected: []byte{0x30, 0x01, 0x02, 0x03},
+		},
+		{
+			name:     "extension header",
+			data:     []byte{0x36, 0x00, 0x01, 0xff},
+			expected: []byte{0x36, 0x00, 0x01, 0xff},
+		},
+		{name: "truncated extension header", data: join(frame, []byte{0x36}), err: "truncated av1 obu header"},
+		{name: "truncated obu", data: []byte{0x32, 0x05, 0x01, 0x02}, err: "truncated av1 obu"},
+		{name: "truncated leb128", data: []byte{0x32, 0x80}, err: obu.ErrFailedToReadLEB128.Error()},
+		{name: "missing leb128", data: []byte{0x32}, err: obu.ErrFailedToReadLEB128.Error()},
+	}
+
+	for _, test := range tests {
+		out, err := av1TemporalUnit(test.data, sequenceHeader, test.keyframe)
+		if test.err != "" {
+			assert.EqualError(err, test.err, test.name)
+			continue
+		}
+		if assert.NoError(err, test.name) {
+			assert.Equal(test.expected, out, test.name)
+		}
+	}
+}
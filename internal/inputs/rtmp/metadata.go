@@ -0,0 +1,58 @@
+package rtmp
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+// onMetaDataMetadata turns the onMetaData the publisher sends with @setDataFrame into
+// stream metadata, only the values it actually sent are reported
+func onMetaDataMetadata(values map[string]interface{}) []control.Metadata {
+	var metadata []control.Metadata
+
+	if width, ok := metadataNumber(values, "width"); ok {
+		metadata = append(metadata, control.VideoWidthMetadata(int(width)))
+	}
+	if height, ok := metadataNumber(values, "height"); ok {
+		metadata = append(metadata, control.VideoHeightMetadata(int(height)))
+	}
+	if fps, ok := metadataNumber(values, "framerate"); ok {
+		metadata = append(metadata, control.VideoFramerateMetadata(fps))
+	}
+	// The bitrates are in kbps
+	if kbps, ok := metadataNumber(values, "videodatarate"); ok {
+		metadata = append(metadata, control.DeclaredVideoBitrateMetadata(int(kbps*1000)))
+	}
+	if kbps, ok := metadataNumber(values, "audiodatarate"); ok {
+		metadata = append(metadata, control.DeclaredAudioBitrateMetadata(int(kbps*1000)))
+	}
+	if encoder, ok := values["encoder"].(string); ok && encoder != "" {
+		name, version := encoderVendor(encoder)
+		metadata = append(metadata,
+			control.EncoderMetadata(encoder),
+			control.ClientVendorNameMetadata(name),
+			control.ClientVendorVersionMetadata(version),
+		)
+	}
+
+	return metadata
+}
+
+func metadataNumber(values map[string]interface{}, key string) (float64, bool) {
+	n, ok := values[key].(float64)
+	return n, ok && n > 0
+}
+
+// encoderVendor splits the encoder into a name and version, eg:
+// "obs-output module (libobs version 29.1.3)" or "Lavf60.3.100"
+func encoderVendor(encoder string) (name string, version string) {
+	if open := strings.LastIndex(encoder, " ("); open > 0 && strings.HasSuffix(encoder, ")") {
+		return encoder[:open], encoder[open+2 : len(encoder)-1]
+	}
+	if i := strings.IndexFunc(encoder, unicode.IsDigit); i > 0 {
+		return strings.TrimSpace(encoder[:i]), encoder[i:]
+	}
+	return encoder, ""
+}
@@ -0,0 +1,133 @@
+package rtmp
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnMetaDataMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy"}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	ctrl, err := control.New(context.Background(), cfg, "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Shutdown()
+
+	// reported is the part of the stream info onMetaData can set
+	type reported struct {
+		width, height                      int
+		framerate                          float64
+		videoBitrate, audioBitrate         int
+		encoder, vendorName, vendorVersion string
+	}
+
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		expected reported
+	}{
+		{
+			name: "obs",
+			values: map[string]interface{}{
+				"duration": 0.0, "fileSize": 0.0,
+				"width": 1920.0, "height": 1080.0, "videocodecid": 7.0, "videodatarate": 6000.0, "framerate": 60.0,
+				"audiocodecid": 10.0, "audiodatarate": 160.0, "audiosamplerate": 48000.0, "audiosamplesize": 16.0, "audiochannels": 2.0,
+				"stereo": true, "2.1": false, "3.1": false, "4.0": false, "4.1": false, "5.1": false, "7.1": false,
+				"encoder": "obs-output module (libobs version 29.1.3)",
+			},
+			expected: reported{
+				width: 1920, height: 1080, framerate: 60, videoBitrate: 6000000, audioBitrate: 160000,
+				encoder: "obs-output module (libobs version 29.1.3)", vendorName: "obs-output module", vendorVersion: "libobs version 29.1.3",
+			},
+		},
+		{
+			name: "ffmpeg",
+			values: map[string]interface{}{
+				"duration": 0.0, "width": 1280.0, "height": 720.0, "videodatarate": 2929.6875, "framerate": 29.97, "videocodecid": 7.0,
+				"audiodatarate": 125.0, "audiosamplerate": 44100.0, "audiosamplesize": 16.0, "stereo": true, "audiocodecid": 10.0,
+				"encoder": "Lavf60.3.100", "filesize": 0.0,
+			},
+			expected: reported{
+				width: 1280, height: 720, framerate: 29.97, videoBitrate: 2929687, audioBitrate: 125000,
+				encoder: "Lavf60.3.100", vendorName: "Lavf", vendorVersion: "60.3.100",
+			},
+		},
+		{
+			name:   "missing keys report nothing",
+			values: map[string]interface{}{"duration": 0.0},
+		},
+		{
+			name: "odd typed and empty values are ignored",
+			values: map[string]interface{}{
+				"width": "1920", "height": int64(1080), "framerate": true, "videodatarate": -1.0, "audiodatarate": 0.0, "encoder": 5.0,
+			},
+		},
+		{
+			name:     "empty encoder is ignored",
+			values:   map[string]interface{}{"encoder": "", "width": 640.0},
+			expected: reported{width: 640},
+		},
+	}
+
+	for i, test := range tests {
+		stream, err := ctrl.StartStream(types.ChannelID(i + 1))
+		if !assert.NoError(err, test.name) {
+			continue
+		}
+		assert.NoError(stream.ReportMetadata(onMetaDataMetadata(test.values)...))
+
+		info := stream.Info()
+		assert.Equal(test.expected, reported{
+			width:         info.VideoWidth,
+			height:        info.VideoHeight,
+			framerate:     info.VideoFramerate,
+			videoBitrate:  info.DeclaredVideoBitrate,
+			audioBitrate:  info.DeclaredAudioBitrate,
+			encoder:       info.Encoder,
+			vendorName:    info.VendorName,
+			vendorVersion: info.VendorVersion,
+		}, test.name)
+	}
+}
+
+func TestEncoderVendor(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		encoder string
+		name    string
+		version string
+	}{
+		{"obs-output module (libobs version 29.1.3)", "obs-output module", "libobs version 29.1.3"},
+		{"Lavf60.3.100", "Lavf", "60.3.100"},
+		{"Lavf58.29.100", "Lavf", "58.29.100"},
+		{"Larix Broadcaster 1.3.5", "Larix Broadcaster", "1.3.5"},
+		{"vMix", "vMix", ""},
+		// A leading digit or parenthesis isn't split off an empty name
+		{"3.0", "3.0", ""},
+		{"(beta)", "(beta)", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		name, version := encoderVendor(test.encoder)
+		assert.Equal(test.name, name, test.encoder)
+		assert.Equal(test.version, version, test.encoder)
+	}
+}
@@ -1,18 +1,20 @@
 package rtmp
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Glimesh/go-fdkaac/fdkaac"
+	"github.com/Glimesh/waveguide/pkg/auth"
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/h264"
 	"github.com/Glimesh/waveguide/pkg/types"
 
 	h264joy "github.com/nareix/joy5/codec/h264"
@@ -30,22 +32,69 @@ const (
 	FTL_MTU      uint16 = 1392
 	FTL_VIDEO_PT uint8  = 96
 	FTL_AUDIO_PT uint8  = 97
-
-	BANDWIDTH_LIMIT int = 8000 * 1000
 )
 
 type Source struct {
 	log     logrus.FieldLogger
 	control *control.Control
 
+	mu       sync.Mutex
+	srv      *gortmp.Server
+	listener net.Listener
+	closed   bool
+
 	// Listen address of the RTMP server in the ip:port format
 	Address string
+	Audio   AudioConfig
+}
+
+type Config struct {
+	Address     string `fig:"address"`
+	AudioConfig `fig:",squash"`
+}
+
+// AudioConfig is how the publisher's AAC is turned into Opus for WebRTC viewers
+type AudioConfig struct {
+	// OpusBitrate is in bits per second, zero lets the encoder pick
+	OpusBitrate int `fig:"opus_bitrate"`
+	// OpusComplexity is 1 to 10, zero keeps the encoder's default
+	OpusComplexity int  `fig:"opus_complexity"`
+	OpusFEC        bool `fig:"opus_fec"`
+	// AACPassthrough keeps the original AAC as a second track for outputs like HLS and recording
+	AACPassthrough bool `fig:"aac_passthrough"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	if cfg.OpusBitrate != 0 && (cfg.OpusBitrate < 6000 || cfg.OpusBitrate > 510000) {
+		return errors.New("opus_bitrate must be between 6000 and 510000")
+	}
+	if cfg.OpusComplexity < 0 || cfg.OpusComplexity > 10 {
+		return errors.New("opus_complexity must be between 0 and 10")
+	}
+	return nil
 }
 
-func New(address string) *Source {
-	return &Source{ //nolint exhaustive struct
+type Options func(*Source)
+
+func WithAudio(audio AudioConfig) Options {
+	return func(s *Source) {
+		s.Audio = audio
+	}
+}
+
+func New(address string, opts ...Options) *Source {
+	s := &Source{ //nolint exhaustive struct
 		Address: address,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 func (s *Source) SetControl(ctrl *control.Control) {
@@ -56,15 +105,34 @@ func (s *Source) SetLogger(log logrus.FieldLogger) {
 	s.log = log
 }
 
-func (s *Source) Listen(ctx context.Context) {
+// Bind takes the address before Listen, so a reload finds out when it's in use
+func (s *Source) Bind() error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", s.Address)
 	if err != nil {
-		s.log.Errorf("Failed: %+v", err)
+		return err
 	}
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
-		s.log.Errorf("Failed: %+v", err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Source) Listen(ctx context.Context) {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener == nil {
+		if err := s.Bind(); err != nil {
+			s.log.Errorf("Failed: %+v", err)
+			return
+		}
+		listener = s.listener
 	}
 
 	s.log.Infof("Starting RTMP Server on %s", s.Address)
@@ -75,6 +143,8 @@ func (s *Source) Listen(ctx context.Context) {
 				Handler: &connHandler{ //nolint exhaustive struct
 					control:                s.control,
 					log:                    s.log,
+					remoteAddr:             conn.RemoteAddr().String(),
+					audio:                  s.Audio,
 					stopMetadataCollection: make(chan bool, 1),
 				},
 
@@ -85,17 +155,68 @@ func (s *Source) Listen(ctx context.Context) {
 			}
 		},
 	})
-	if err := srv.Serve(listener); err != nil {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return
+	}
+	s.srv = srv
+	s.mu.Unlock()
+
+	// go-rtmp has no way of refusing a connection in OnConnect, so refuse it as it's accepted
+	allowed := &allowListener{Listener: listener, allow: func(conn net.Conn) bool {
+		return s.control.AllowPublisher("rtmp", conn.RemoteAddr().String())
+	}}
+	if err := srv.Serve(allowed); err != nil && !errors.Is(err, gortmp.ErrClosed) {
 		s.log.Panicf("Failed: %+v", err)
 	}
 }
 
+// allowListener closes the connections allow refuses instead of returning them
+type allowListener struct {
+	net.Listener
+	allow func(net.Conn) bool
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.allow(conn) {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+// Close stops the RTMP server from accepting new streams, live streams keep going
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	s.log.Infof("Closing RTMP Server on %s", s.Address)
+	var err error
+	if s.srv != nil {
+		err = s.srv.Close()
+	}
+	// The server only closes the listener once Serve has registered it
+	s.listener.Close()
+	return err
+}
+
 type connHandler struct {
 	gortmp.DefaultHandler
 	control *control.Control
 	// controlCtx context.Context
 
-	log logrus.FieldLogger
+	log        logrus.FieldLogger
+	conn       *gortmp.Conn
+	remoteAddr string
 
 	channelID        types.ChannelID
 	streamID         types.StreamID
@@ -104,6 +225,10 @@ type connHandler struct {
 	authenticated    bool
 	errored          bool
 	metadataFailures int
+	// unpublished is set when the client ends the stream on purpose, rather than dropping
+	unpublished bool
+	// takenOver is set when another publisher took the stream, it's not ours to stop anymore
+	takenOver int32
 
 	stream *control.Stream
 
@@ -117,9 +242,29 @@ type connHandler struct {
 	audioSequencer  rtp.Sequencer
 	audioPacketizer rtp.Packetizer
 	audioClockRate  uint32
-	audioDecoder    *fdkaac.AacDecoder
-	audioBuffer     []byte
-	audioEncoder    *opus.Encoder
+	audioTimeline   audioTimeline
+
+	audioDecoder *fdkaac.AacDecoder
+	resampler    *resampler
+	// audioBuffer is 48kHz stereo waiting for a whole Opus frame
+	audioBuffer  []int16
+	audioEncoder *opus.Encoder
+	// audioUnsupported is set once we've warned about audio that isn't AAC
+	audioUnsupported bool
+
+	audio         AudioConfig
+	aacTrack      *webrtc.TrackLocalStaticRTP
+	aacPacketizer rtp.Packetizer
+	aacSampleRate int
+
+	// timeline keeps the audio and video timestamps on the same clock
+	timeline timeline
+
+	// bframes is set once B-frames have been reported for this publisher
+	bframes bool
+	// compositionTime is of the last video frame, it only changes when frames are reordered
+	compositionTime     int32
+	haveCompositionTime bool
 
 	keyframes       int
 	lastKeyFrames   int
@@ -127,11 +272,15 @@ type connHandler struct {
 
 	stopMetadataCollection chan bool
 
+	videoCodec    string
 	videoJoyCodec *h264joy.Codec
+	// av1SequenceHeader is from the AV1 sequence start, for keyframes that don't carry it
+	av1SequenceHeader []byte
 }
 
 func (h *connHandler) OnServe(conn *gortmp.Conn) {
 	h.log.Info("OnServe: %#v", conn)
+	h.conn = conn
 }
 
 func (h *connHandler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) (err error) {
@@ -155,24 +304,22 @@ func (h *connHandler) OnCreateStream(timestamp uint32, cmd *rtmpmsg.NetConnectio
 func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) (err error) {
 	h.log.Info("OnPublish: %#v", cmd)
 
-	if cmd.PublishingName == "" {
-		return errors.New("PublishingName is empty")
-	}
 	// Authenticate
-	auth := strings.SplitN(cmd.PublishingName, "-", 2)
-	u64, err := strconv.ParseUint(auth[0], 10, 32)
-
+	h.channelID, h.streamKey, err = auth.ParseStreamKey(cmd.PublishingName, 0)
 	if err != nil {
 		h.log.Error(err)
 		return err
 	}
-	h.channelID = types.ChannelID(u64)
-	h.streamKey = []byte(auth[1])
 
 	h.started = true
 
-	if err := h.control.Authenticate(h.channelID, h.streamKey); err != nil {
-		h.log.Error(err)
+	grant, err := h.control.Authenticate(auth.Request{
+		ChannelID:  h.channelID,
+		StreamKey:  h.streamKey,
+		InputType:  "rtmp",
+		RemoteAddr: h.remoteAddr,
+	})
+	if err != nil {
 		return err
 	}
 
@@ -181,6 +328,7 @@ func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd
 		h.log.Error(err)
 		return err
 	}
+	h.stream.ApplyGrant(grant)
 
 	h.authenticated = true
 
@@ -192,14 +340,20 @@ func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd
 		"stream_id":  h.streamID,
 	})
 
+	h.stream.SetDisconnect(func(reason control.StopReason) {
+		h.log.Infof("Disconnecting publisher reason=%s", reason)
+		if reason == control.StopReasonTakeover {
+			atomic.StoreInt32(&h.takenOver, 1)
+		}
+		h.conn.Close()
+	})
+
 	h.stream.ReportMetadata(
+		control.InputTypeMetadata("rtmp"),
 		control.ClientVendorNameMetadata("waveguide-rtmp-input"),
 		control.ClientVendorVersionMetadata("0.0.1"),
 	)
 
-	if err := h.initVideo(h.videoClockRate); err != nil {
-		return err
-	}
 	if err := h.initAudio(h.audioClockRate); err != nil {
 		return err
 	}
@@ -207,6 +361,41 @@ func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd
 	return nil
 }
 
+// OnSetDataFrame reports the onMetaData OBS and ffmpeg send after publishing,
+// so the service knows what the streamer is using from the first heartbeat
+func (h *connHandler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
+	if h.stream == nil {
+		return nil
+	}
+
+	var script flvtag.ScriptData
+	if err := flvtag.DecodeScriptData(bytes.NewReader(data.Payload), &script); err != nil {
+		h.log.WithError(err).Warn("Could not decode the publisher's metadata")
+		return nil
+	}
+	values, ok := script.Objects["onMetaData"]
+	if !ok {
+		return nil
+	}
+
+	h.log.Infof("Publisher metadata: %v", values)
+	h.stream.ReportMetadata(onMetaDataMetadata(values)...)
+
+	return nil
+}
+
+func (h *connHandler) OnFCUnpublish(timestamp uint32, cmd *rtmpmsg.NetStreamFCUnpublish) error {
+	h.log.Infof("OnFCUnpublish: %#v", cmd)
+	h.unpublished = true
+	return nil
+}
+
+func (h *connHandler) OnDeleteStream(timestamp uint32, cmd *rtmpmsg.NetStreamDeleteStream) error {
+	h.log.Infof("OnDeleteStream: %#v", cmd)
+	h.unpublished = true
+	return nil
+}
+
 func (h *connHandler) OnClose() {
 	h.log.Info("RTMP OnClose")
 
@@ -215,15 +404,20 @@ func (h *connHandler) OnClose() {
 
 	// We only want to publish the stop if it's ours
 	// We also don't want control to stop the stream if we're respond to a stop
-	if h.authenticated && h.control.ContextErr() == nil {
+	if h.authenticated && h.control.ContextErr() == nil && atomic.LoadInt32(&h.takenOver) == 0 {
 		// StopStream mainly calls external services, there's a chance this call can hang for a bit while the other services are processing
 		// However it's not safe to call RemoveStream until this is finished or the pointer wont... exist?
-		if err := h.control.StopStream(h.channelID); err != nil {
+		stop := h.control.StreamDisconnected
+		if h.unpublished {
+			stop = h.control.StopStream
+		}
+		if err := stop(h.channelID); err != nil {
 			h.log.Error(err)
 			// panic(err)
 		}
 	}
 	h.authenticated = false
+	h.unpublished = false
 
 	h.started = false
 
@@ -253,11 +447,15 @@ func (h *connHandler) initAudio(clockRate uint32) (err error) {
 		return err
 	}
 
-	h.audioEncoder, err = opus.NewEncoder(int(clockRate), 2, opus.AppAudio)
+	h.audioEncoder, err = opus.NewEncoder(int(clockRate), opusChannels, opus.AppAudio)
 	if err != nil {
 		return err
 	}
+	if err := h.configureOpus(); err != nil {
+		return err
+	}
 	h.audioDecoder = fdkaac.NewAacDecoder()
+	h.audioTimeline = audioTimeline{clockRate: clockRate}
 
 	h.stream.AddTrack(h.audioTrack, webrtc.MimeTypeOpus)
 	h.stream.ReportMetadata(control.AudioCodecMetadata(webrtc.MimeTypeOpus))
@@ -265,6 +463,66 @@ func (h *connHandler) initAudio(clockRate uint32) (err error) {
 	return nil
 }
 
+func (h *connHandler) configureOpus() error {
+	if h.audio.OpusBitrate > 0 {
+		if err := h.audioEncoder.SetBitrate(h.audio.OpusBitrate); err != nil {
+			return err
+		}
+	}
+	if h.audio.OpusComplexity > 0 {
+		if err := h.audioEncoder.SetComplexity(h.audio.OpusComplexity); err != nil {
+			return err
+		}
+	}
+	if h.audio.OpusFEC {
+		if err := h.audioEncoder.SetInBandFEC(true); err != nil {
+			return err
+		}
+		if err := h.audioEncoder.SetPacketLossPerc(opusFECPacketLoss); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initAAC adds a track with the publisher's AAC as it came in, for local consumers
+// like HLS and recordings that would rather not decode our Opus
+func (h *connHandler) initAAC(config []byte, sampleRate, channels int) error {
+	if h.aacTrack != nil {
+		if sampleRate != h.aacSampleRate {
+			h.log.Warnf("AAC sample rate changed from %d to %d, the passthrough track keeps its first config", h.aacSampleRate, sampleRate)
+		}
+		return nil
+	}
+
+	h.aacPacketizer = rtp.NewPacketizer(
+		FTL_MTU,
+		FTL_AUDIO_PT,
+		uint32(h.channelID+2),
+		&aacPayloader{},
+		rtp.NewRandomSequencer(),
+		uint32(sampleRate),
+	)
+
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{ //nolint exhaustive struct
+			MimeType:    control.MimeTypeAAC,
+			ClockRate:   uint32(sampleRate),
+			Channels:    uint16(channels),
+			SDPFmtpLine: aacFmtp(config),
+		},
+		"aac",
+		"pion",
+	)
+	if err != nil {
+		return err
+	}
+	h.aacTrack = track
+	h.aacSampleRate = sampleRate
+
+	return h.stream.AddLocalTrack(track, control.MimeTypeAAC)
+}
+
 func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 	if h.errored {
 		return errors.New("stream is not longer authenticated")
@@ -276,11 +534,17 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 		return errors.New("stream terminated")
 	}
 
-	// Convert AAC to opus
 	var audio flvtag.AudioData
 	if err := flvtag.DecodeAudioData(payload, &audio); err != nil {
 		return err
 	}
+	if audio.SoundFormat != flvtag.SoundFormatAAC {
+		if !h.audioUnsupported {
+			h.audioUnsupported = true
+			h.log.Warnf("Dropping audio, only AAC is supported and the publisher sent sound format %d", audio.SoundFormat)
+		}
+		return nil
+	}
 
 	data, err := io.ReadAll(audio.Data)
 	if err != nil {
@@ -296,8 +560,33 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 			return fmt.Errorf("can't initialize codec with %s", hex.EncodeToString(data))
 		}
 
+		sampleRate, channels, err := parseAudioSpecificConfig(data)
+		if err != nil {
+			return err
+		}
+		h.log.Infof("AAC audio sample_rate=%d channels=%d", sampleRate, channels)
+		h.resampler = newResampler(sampleRate, channels)
+
+		if h.audio.AACPassthrough {
+			return h.initAAC(data, sampleRate, channels)
+		}
 		return nil
 	}
+	if h.resampler == nil {
+		return errors.New("AAC audio before its sequence header")
+	}
+
+	// Convert AAC to opus, and keep the AAC as is if it's wanted
+	ms := h.timeline.ms(timestamp)
+	if h.aacTrack != nil {
+		rtpTime := rtpTimestamp(ms, uint32(h.aacSampleRate))
+		for _, p := range h.aacPacketizer.Packetize(data, 0) {
+			p.Timestamp = rtpTime
+			if err := h.stream.WriteRTP(h.aacTrack, p); err != nil {
+				return err
+			}
+		}
+	}
 
 	pcm, err := h.audioDecoder.Decode(data)
 	if err != nil {
@@ -305,46 +594,72 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 		return fmt.Errorf("decode error")
 	}
 
-	blockSize := 960
-	for h.audioBuffer = append(h.audioBuffer, pcm...); len(h.audioBuffer) >= blockSize*4; h.audioBuffer = h.audioBuffer[blockSize*4:] {
-		pcm16 := make([]int16, blockSize*2)
-		for i := 0; i < len(pcm16); i++ {
-			pcm16[i] = int16(binary.LittleEndian.Uint16(h.audioBuffer[i*2:]))
-		}
+	// HE-AAC doubles the sample rate and parametric stereo adds a channel over
+	// what the sequence header says, the decoder knows what it actually output
+	if rate, channels := h.audioDecoder.SampleRate(), h.audioDecoder.NumChannels(); rate > 0 && channels > 0 &&
+		(rate != h.resampler.rate || channels != h.resampler.channels) {
+		h.log.Infof("Decoded AAC audio is sample_rate=%d channels=%d", rate, channels)
+		h.resampler = newResampler(rate, channels)
+	}
+
+	h.audioTimeline.sync(ms, len(h.audioBuffer)/opusChannels)
+
+	blockSize := opusFrameSize * opusChannels
+	for h.audioBuffer = append(h.audioBuffer, h.resampler.resample(pcm)...); len(h.audioBuffer) >= blockSize; h.audioBuffer = h.audioBuffer[blockSize:] {
 		bufferSize := 1024
 		opusData := make([]byte, bufferSize)
-		n, err := h.audioEncoder.Encode(pcm16, opusData)
+		n, err := h.audioEncoder.Encode(h.audioBuffer[:blockSize], opusData)
 		if err != nil {
 			return err
 		}
 		opusOutput := opusData[:n]
 
-		packets := h.audioPacketizer.Packetize(opusOutput, uint32(blockSize))
+		packets := h.audioPacketizer.Packetize(opusOutput, opusFrameSize)
 
+		rtpTime := h.audioTimeline.take(opusFrameSize)
 		for _, p := range packets {
-			if err := h.audioTrack.WriteRTP(p); err != nil {
+			p.Timestamp = rtpTime
+			if err := h.stream.WriteRTP(h.audioTrack, p); err != nil {
 				return err
 			}
 		}
-
-		h.stream.ReportMetadata(control.AudioPacketsMetadata(1)) //nolint exhaustive struct
 	}
 
 	return nil
 }
 
-func (h *connHandler) initVideo(clockRate uint32) error {
+// initVideo sets up the video track once the publisher has told us its codec
+func (h *connHandler) initVideo(codec string) error {
+	if h.videoTrack != nil {
+		if codec != h.videoCodec {
+			return fmt.Errorf("publisher switched video codec from %s to %s", h.videoCodec, codec)
+		}
+		return nil
+	}
+
+	var payloader rtp.Payloader
+	switch codec {
+	case webrtc.MimeTypeH264:
+		payloader = &codecs.H264Payloader{}
+	case webrtc.MimeTypeAV1:
+		payloader = &codecs.AV1Payloader{}
+	case webrtc.MimeTypeVP9:
+		payloader = &codecs.VP9Payloader{}
+	default:
+		return fmt.Errorf("no rtp payloader for %s", codec)
+	}
+
 	h.videoSequencer = rtp.NewFixedSequencer(25000)
 	h.videoPacketizer = rtp.NewPacketizer(
 		FTL_MTU,
 		FTL_VIDEO_PT,
 		uint32(h.channelID+1),
-		&codecs.H264Payloader{},
-		h.videoSequencer, clockRate,
+		payloader,
+		h.videoSequencer, h.videoClockRate,
 	)
 
 	track, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, //nolint exhaustive struct
+		webrtc.RTPCodecCapability{MimeType: codec}, //nolint exhaustive struct
 		"video",
 		"pion",
 	)
@@ -352,12 +667,22 @@ func (h *connHandler) initVideo(clockRate uint32) error {
 		return err
 	}
 	h.videoTrack = track
-	h.stream.AddTrack(track, webrtc.MimeTypeH264)
-	h.stream.ReportMetadata(control.VideoCodecMetadata(webrtc.MimeTypeH264))
+	h.videoCodec = codec
+	h.stream.AddTrack(track, codec)
+	h.stream.ReportMetadata(control.VideoCodecMetadata(codec))
 
 	return nil
 }
 
+// rejectCodec stops the stream of a publisher sending video we can't get to viewers
+func (h *connHandler) rejectCodec(codec string) error {
+	h.log.Warnf("Stopping stream, %s video can't be played by WebRTC viewers, only H264, AV1 and VP9 are supported", codec)
+	if err := h.control.TerminateStream(h.channelID, control.StopReasonUnsupportedCodec); err != nil {
+		h.log.Error(err)
+	}
+	return fmt.Errorf("unsupported video codec %s", codec)
+}
+
 func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 	if h.errored {
 		return errors.New("stream is not longer authenticated")
@@ -369,67 +694,165 @@ func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 		return errors.New("stream terminated")
 	}
 
-	var video flvtag.VideoData
-	if err := flvtag.DecodeVideoData(payload, &video); err != nil {
+	tag, err := io.ReadAll(payload)
+	if err != nil {
 		return err
 	}
 
-	// video.CodecID == H264, I wonder if we should check this?
-	// video.FrameType does not seem to contain b-frames even if they exist
+	var frame videoFrame
+	var codec string
+	if isExVideoTag(tag) {
+		var fourCC string
+		frame, fourCC, err = parseExVideoTag(tag)
+		if err != nil {
+			return err
+		}
+		var known bool
+		if codec, known = exVideoCodecs[fourCC]; !known || codec == "" {
+			return h.rejectCodec(fmt.Sprintf("%q", fourCC))
+		}
+	} else {
+		var video flvtag.VideoData
+		if err := flvtag.DecodeVideoData(bytes.NewReader(tag), &video); err != nil {
+			return err
+		}
+		if video.CodecID != flvtag.CodecIDAVC {
+			return h.rejectCodec(fmt.Sprintf("flv codec id %d", video.CodecID))
+		}
+		codec = webrtc.MimeTypeH264
 
-	switch video.FrameType {
+		frame = videoFrame{
+			frameType:       video.FrameType,
+			compositionTime: video.CompositionTime,
+		}
+		switch video.AVCPacketType {
+		case flvtag.AVCPacketTypeSequenceHeader:
+			frame.packetType = videoSequenceStart
+		case flvtag.AVCPacketTypeNALU:
+			frame.packetType = videoCodedFrames
+		default:
+			frame.packetType = videoSequenceEnd
+		}
+		if frame.data, err = io.ReadAll(video.Data); err != nil {
+			return err
+		}
+	}
+
+	if frame.packetType == videoSkipped || frame.packetType == videoSequenceEnd {
+		return nil
+	}
+	if err := h.initVideo(codec); err != nil {
+		return err
+	}
+
+	// video.FrameType does not seem to contain b-frames even if they exist, see detectBFrames
+	switch frame.frameType {
 	case flvtag.FrameTypeKeyFrame:
 		h.lastKeyFrames++
 		h.keyframes++
 	case flvtag.FrameTypeInterFrame:
 		h.lastInterFrames++
 	default:
-		h.log.Debug("Unknown FLV Video Frame: %+v\n", video)
+		h.log.Debug("Unknown FLV Video Frame: %+v\n", frame.frameType)
 	}
 
-	data, err := io.ReadAll(video.Data)
-	if err != nil {
-		return err
+	switch codec {
+	case webrtc.MimeTypeAV1:
+		return h.writeAV1(timestamp, frame)
+	case webrtc.MimeTypeVP9:
+		// The VP9 codec configuration record isn't needed, frames carry everything
+		if frame.packetType == videoSequenceStart {
+			return nil
+		}
+		return h.writeVideo(timestamp, frame.compositionTime, frame.data)
 	}
+	return h.writeH264(timestamp, frame)
+}
 
+func (h *connHandler) writeH264(timestamp uint32, frame videoFrame) error {
 	// From: https://github.com/nareix/joy5/blob/2c912ca30590ee653145d93873b0952716d21093/cmd/avtool/seqhdr.go#L38-L65
 	// joy5 is an unlicensed project -- need to confirm usage.
-	// Look at video.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader to figure out sps and pps
-	// Store those in the stream object, then use them later for the keyframes
-	if video.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader {
-		h.videoJoyCodec, err = h264joy.FromDecoderConfig(data)
+	// The sequence header has the sps and pps, store them for the keyframes
+	if frame.packetType == videoSequenceStart {
+		codec, err := h264joy.FromDecoderConfig(frame.data)
 		if err != nil {
 			return err
 		}
+		h.videoJoyCodec = codec
+		return nil
+	}
+
+	if !h.bframes && h.detectBFrames(frame.compositionTime, frame.data) {
+		h.bframes = true
+		if err := h.control.ReportBFrames(h.stream); err != nil {
+			return err
+		}
 	}
 
-	var outBuf []byte
-	if video.FrameType == flvtag.FrameTypeKeyFrame {
+	pktnalus, _ := h264joy.SplitNALUs(frame.data)
+	nalus := [][]byte{}
+	if frame.keyframe() && h.videoJoyCodec != nil {
 		// This fails ffprobe
-		pktnalus, _ := h264joy.SplitNALUs(data)
-		nalus := [][]byte{}
 		nalus = append(nalus, h264joy.Map2arr(h.videoJoyCodec.SPS)...)
 		nalus = append(nalus, h264joy.Map2arr(h.videoJoyCodec.PPS)...)
-		nalus = append(nalus, pktnalus...)
-		data := h264joy.JoinNALUsAnnexb(nalus)
-		outBuf = data
-	} else {
-		pktnalus, _ := h264joy.SplitNALUs(data)
-		data := h264joy.JoinNALUsAnnexb(pktnalus)
-		outBuf = data
 	}
+	nalus = append(nalus, pktnalus...)
 
-	// Likely there's more than one set of RTP packets in this read
-	samples := uint32(len(outBuf)) + h.videoClockRate
-	packets := h.videoPacketizer.Packetize(outBuf, samples)
+	return h.writeVideo(timestamp, frame.compositionTime, h264joy.JoinNALUsAnnexb(nalus))
+}
+
+func (h *connHandler) writeAV1(timestamp uint32, frame videoFrame) error {
+	// The AV1 codec configuration record is 4 bytes followed by the sequence header OBU
+	if frame.packetType == videoSequenceStart {
+		if len(frame.data) < 4 {
+			return errors.New("av1 codec configuration record is too short")
+		}
+		h.av1SequenceHeader = append([]byte{}, frame.data[4:]...)
+		return nil
+	}
+
+	data, err := av1TemporalUnit(frame.data, h.av1SequenceHeader, frame.keyframe())
+	if err != nil {
+		return err
+	}
+	return h.writeVideo(timestamp, frame.compositionTime, data)
+}
+
+// writeVideo packetizes a whole frame onto the video track
+func (h *connHandler) writeVideo(timestamp uint32, compositionTime int32, data []byte) error {
+	// The RTMP timestamp is the DTS, viewers need the PTS which is CompositionTime ms later
+	pts := h.timeline.ms(timestamp) + int64(compositionTime)
+	rtpTime := rtpTimestamp(pts, h.videoClockRate)
+
+	// Likely there's more than one set of RTP packets in this read, they're all part of the one frame
+	packets := h.videoPacketizer.Packetize(data, 0)
 
 	for _, p := range packets {
-		if err := h.videoTrack.WriteRTP(p); err != nil {
+		p.Timestamp = rtpTime
+		if err := h.stream.WriteRTP(h.videoTrack, p); err != nil {
 			return err
 		}
 	}
 
-	h.stream.ReportMetadata(control.VideoPacketsMetadata(1))
-
 	return nil
 }
+
+// detectBFrames looks for frames that are decoded in a different order than
+// they're shown, either from the composition time offset changing between frames
+// or from the slice type of the frame
+func (h *connHandler) detectBFrames(compositionTime int32, data []byte) bool {
+	reordered := h.haveCompositionTime && compositionTime != h.compositionTime
+	h.compositionTime = compositionTime
+	h.haveCompositionTime = true
+	if reordered {
+		return true
+	}
+
+	nalus, _ := h264joy.SplitNALUs(data)
+	for _, nalu := range nalus {
+		if h264.IsBSlice(nalu) {
+			return true
+		}
+	}
+	return false
+}
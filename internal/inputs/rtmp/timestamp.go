@@ -0,0 +1,88 @@
+package rtmp
+
+import "sync"
+
+const (
+	// maxTimestampRewind is how far back a timestamp can go before we treat it as
+	// the publisher restarting its clock, audio and video are interleaved a little
+	// out of order so small steps back are expected
+	maxTimestampRewind = 1000
+	// audioResyncTolerance is how far the audio timeline can drift from the RTMP
+	// timestamps before it's snapped back, smaller drifts are rounding in the ms timestamps
+	audioResyncTolerance = 40
+)
+
+// timeline turns the 32 bit millisecond RTMP timestamps of every track of a
+// publisher into one continuous 64 bit millisecond timeline, unwrapping them
+// after ~49 days and carrying on smoothly when the publisher restarts its clock.
+type timeline struct {
+	mu      sync.Mutex
+	started bool
+	lastRaw uint32
+	last    int64
+	max     int64
+}
+
+// ms returns the position of the RTMP timestamp on the timeline
+func (t *timeline) ms(timestamp uint32) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started {
+		t.started = true
+		t.lastRaw = timestamp
+		t.last = int64(timestamp)
+		t.max = t.last
+		return t.last
+	}
+
+	// The signed difference unwraps the timestamp going past 2^32
+	delta := int64(int32(timestamp - t.lastRaw))
+	next := t.last + delta
+	if delta < -maxTimestampRewind {
+		// The publisher restarted its clock, carry on from where it left off
+		next = t.max + 1
+	}
+
+	t.lastRaw = timestamp
+	t.last = next
+	if next > t.max {
+		t.max = next
+	}
+	return next
+}
+
+// rtpTimestamp converts a position on the timeline to a RTP timestamp at the clock rate
+func rtpTimestamp(ms int64, clockRate uint32) uint32 {
+	return uint32(ms * int64(clockRate) / 1000)
+}
+
+// audioTimeline places the audio frames we encode on the timeline, our frames
+// don't line up with the publisher's so the RTMP timestamps are only used to anchor them
+type audioTimeline struct {
+	clockRate uint32
+	synced    bool
+	// next is the RTP timestamp of the first buffered sample
+	next uint32
+}
+
+// sync anchors the timeline to a decoded packet at ms, buffered is how many
+// samples per channel were left over from the packets before it
+func (a *audioTimeline) sync(ms int64, buffered int) {
+	start := rtpTimestamp(ms, a.clockRate) - uint32(buffered)
+	drift := int32(start - a.next)
+	if drift < 0 {
+		drift = -drift
+	}
+	if !a.synced || drift > int32(a.clockRate/1000*audioResyncTolerance) {
+		a.next = start
+		a.synced = true
+	}
+}
+
+// take returns the RTP timestamp of the next frame of samples per channel
+func (a *audioTimeline) take(samples int) uint32 {
+	timestamp := a.next
+	a.next += uint32(samples)
+	return timestamp
+}
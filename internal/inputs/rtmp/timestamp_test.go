@@ -0,0 +1,128 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeline(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		expected   []int64
+	}{
+		{
+			name:       "wraps at 2^32",
+			timestamps: []uint32{0xffffff00, 0xfffffff0, 0x10, 0x100},
+			expected:   []int64{0xffffff00, 0xfffffff0, 1<<32 + 0x10, 1<<32 + 0x100},
+		},
+		{
+			name:       "small reorder",
+			timestamps: []uint32{1000, 1040, 1020, 1060},
+			expected:   []int64{1000, 1040, 1020, 1060},
+		},
+		{
+			name:       "reorder across the wrap",
+			timestamps: []uint32{0xfffffff0, 0x10, 0xfffffffa, 0x20},
+			expected:   []int64{0xfffffff0, 1<<32 + 0x10, 0xfffffffa, 1<<32 + 0x20},
+		},
+		{
+			name:       "publisher restart carries on after the furthest timestamp",
+			timestamps: []uint32{50000, 50040, 50020, 0, 40},
+			expected:   []int64{50000, 50040, 50020, 50041, 50081},
+		},
+		{
+			name:       "rewinds up to a second aren't restarts",
+			timestamps: []uint32{5000, 4000, 5000, 3998},
+			expected:   []int64{5000, 4000, 5000, 5001},
+		},
+		{
+			name: "audio and video interleaved",
+			// video every 33ms, audio every 23ms, each muxed a little late
+			timestamps: []uint32{0, 0, 23, 33, 46, 66, 69, 100, 92, 133, 115},
+			expected:   []int64{0, 0, 23, 33, 46, 66, 69, 100, 92, 133, 115},
+		},
+	}
+
+	for _, test := range tests {
+		var timeline timeline
+		for i, timestamp := range test.timestamps {
+			assert.Equal(test.expected[i], timeline.ms(timestamp), "%s: timestamp %d", test.name, i)
+		}
+	}
+}
+
+func TestRTPTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		ms        int64
+		clockRate uint32
+		expected  uint32
+	}{
+		{0, 90000, 0},
+		{33, 90000, 2970},
+		{1000, 90000, 90000},
+		{1000, 48000, 48000},
+		{21, 48000, 1008},
+		// RTP timestamps wrap on their own, long before the timeline does
+		{47721859, 90000, 14},
+		{1<<32 + 0x10, 90000, 1440},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, rtpTimestamp(test.ms, test.clockRate), "%dms at %d", test.ms, test.clockRate)
+	}
+}
+
+func TestAudioTimeline(t *testing.T) {
+	assert := assert.New(t)
+
+	// Every step syncs to a decoded packet then takes a 20ms Opus frame
+	type step struct {
+		ms       int64
+		buffered int
+		expected uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "frames follow on from the first packet",
+			steps: []step{{1000, 0, 48000}, {1020, 0, 48960}, {1040, 0, 49920}},
+		},
+		{
+			name: "rounding in the ms timestamps is ignored",
+			// 1021ms is 48 samples off the frames we've taken
+			steps: []step{{1000, 0, 48000}, {1021, 0, 48960}, {1039, 0, 49920}},
+		},
+		{
+			name:  "drifting too far resyncs",
+			steps: []step{{1000, 0, 48000}, {1100, 0, 52800}, {1120, 0, 53760}},
+		},
+		{
+			name:  "publisher restart resyncs",
+			steps: []step{{5000, 0, 240000}, {0, 0, 0}, {20, 0, 960}},
+		},
+		{
+			name:  "buffered samples start before the packet",
+			steps: []step{{1000, 480, 47520}, {1010, 0, 48480}},
+		},
+		{
+			name:  "wraps with the RTP timestamp",
+			steps: []step{{89478485, 0, 4294967280}, {89478505, 0, 944}, {89478525, 0, 1904}},
+		},
+	}
+
+	for _, test := range tests {
+		timeline := audioTimeline{clockRate: 48000}
+		for i, step := range test.steps {
+			timeline.sync(step.ms, step.buffered)
+			assert.Equal(step.expected, timeline.take(960), "%s: step %d", test.name, i)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package whip
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,11 +10,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Glimesh/waveguide/pkg/auth"
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/Glimesh/waveguide/pkg/types"
 
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 )
@@ -26,6 +31,8 @@ type Source struct {
 
 	peerConnectionsMutex sync.RWMutex
 	peerConnections      map[types.ChannelID]*webrtc.PeerConnection
+	// sessions maps the resource IDs handed to publishers to their channel
+	sessions map[string]types.ChannelID
 
 	// Listen address of the FS server in the ip:port format
 	Address   string
@@ -33,6 +40,19 @@ type Source struct {
 	AudioFile string `mapstructure:"audio_file"`
 }
 
+type Config struct {
+	Address   string `fig:"address"`
+	VideoFile string `fig:"video_file"`
+	AudioFile string `fig:"audio_file"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	return nil
+}
+
 func New(address, videoFile, audioFile string) *Source {
 	return &Source{
 		Address:              address,
@@ -40,6 +60,7 @@ func New(address, videoFile, audioFile string) *Source {
 		AudioFile:            audioFile,
 		peerConnectionsMutex: sync.RWMutex{},
 		peerConnections:      make(map[types.ChannelID]*webrtc.PeerConnection),
+		sessions:             make(map[string]types.ChannelID),
 	}
 }
 
@@ -56,48 +77,56 @@ func (s *Source) Listen(ctx context.Context) {
 
 	s.control.RegisterHandleFunc("/whip/endpoint/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
-
-		// This function allows for the channel ID to be passed in via the URL /whip/endpoint/1234
-		// or alternatively via the stream key 1234-somekey
-
-		strChannelID := path.Base(r.URL.Path)
-		streamKey := r.Header.Get("Authorization")
-		if streamKey == "" {
-			errUnauthorized(w, r)
+		if !s.control.AllowPublisher("whip", r.RemoteAddr) {
+			errForbidden(w, r)
 			return
 		}
 
-		if strings.HasPrefix(streamKey, "Bearer ") {
-			// Remove Bearer info, will need to research why this is being sent.
-			streamKey = strings.Replace(streamKey, "Bearer ", "", 1)
-		}
-
-		split := strings.Split(streamKey, "-")
-		if len(split) > 1 {
-			// Filter out the Channel ID prefix from the stream key
-			strChannelID = split[0]
-			streamKey = split[1]
-		}
-		intChannelID, err := strconv.Atoi(strChannelID)
-		if err != nil {
-			errWrongParams(w, r)
+		// Streams are ended by deleting the session resource, see /whip/resource/
+		if r.Method == http.MethodDelete {
+			errForbidden(w, r)
 			return
 		}
-		channelID := types.ChannelID(intChannelID)
 
-		if r.Method == http.MethodDelete {
-			// The client wants to end the stream
-			s.cleanupPeerConnection(channelID)
-			s.control.StopStream(channelID)
+		// This function allows for the channel ID to be passed in via the URL /whip/endpoint/1234
+		// or alternatively via the stream key 1234-somekey
 
-			w.WriteHeader(http.StatusOK)
+		// The channel in the URL is only used when the key doesn't have one
+		urlChannelID, _ := strconv.ParseUint(path.Base(r.URL.Path), 10, 32)
+		// Remove Bearer info, will need to research why this is being sent.
+		rawKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-			fmt.Fprintf(w, "")
+		channelID, streamKey, err := auth.ParseStreamKey(rawKey, types.ChannelID(urlChannelID))
+		if auth.ReasonOf(err) == auth.ReasonMalformedKey {
+			errWrongParams(w, r)
+			return
+		} else if err != nil {
+			errUnauthorized(w, r)
 			return
 		}
 
-		err = s.control.Authenticate(channelID, types.StreamKey(streamKey))
-		if err != nil {
+		grant, err := s.control.Authenticate(auth.Request{
+			ChannelID:  channelID,
+			StreamKey:  streamKey,
+			InputType:  "whip",
+			RemoteAddr: r.RemoteAddr,
+		})
+		// Draining and capacity are both a 503 so clients go elsewhere or come
+		// back, only capacity says when with Retry-After. FTL drops the
+		// connection without a bad key error and Janus doesn't start the stream
+		if errors.Is(err, control.ErrDraining) {
+			errUnavailable(w, r)
+			return
+		} else if errors.Is(err, control.ErrAtCapacity) {
+			errAtCapacity(w, r, s.control.RetryAfter)
+			return
+		} else if auth.ReasonOf(err) == auth.ReasonUnavailable {
+			errCustom(w, r, "Problem authenticating the stream")
+			return
+		} else if auth.ReasonOf(err) == auth.ReasonLockedOut {
+			errTooManyAttempts(w, r)
+			return
+		} else if err != nil {
 			errUnauthorized(w, r)
 			return
 		}
@@ -110,11 +139,18 @@ func (s *Source) Listen(ctx context.Context) {
 		}
 
 		stream, err := s.control.StartStream(channelID)
-		if err != nil {
+		if errors.Is(err, control.ErrDraining) {
+			errUnavailable(w, r)
+			return
+		} else if errors.Is(err, control.ErrAtCapacity) {
+			errAtCapacity(w, r, s.control.RetryAfter)
+			return
+		} else if err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "Problem starting the stream")
 			return
 		}
+		stream.ApplyGrant(grant)
 
 		ttl := time.Now().Add(PC_TIMEOUT)
 
@@ -140,7 +176,18 @@ func (s *Source) Listen(ctx context.Context) {
 		stream.AddTrack(videoTrack, webrtc.MimeTypeH264)
 		stream.AddTrack(audioTrack, webrtc.MimeTypeOpus)
 
+		// takenOver is set when another publisher took the stream, it's not ours to stop anymore
+		var takenOver int32
+		stream.SetDisconnect(func(reason control.StopReason) {
+			s.log.Infof("Disconnecting publisher channel=%s reason=%s", channelID, reason)
+			if reason == control.StopReasonTakeover {
+				atomic.StoreInt32(&takenOver, 1)
+			}
+			s.cleanupPeerConnection(channelID)
+		})
+
 		stream.ReportMetadata(
+			control.InputTypeMetadata("whip"),
 			control.AudioCodecMetadata(webrtc.MimeTypeOpus),
 			control.VideoCodecMetadata(webrtc.MimeTypeH264),
 			control.ClientVendorNameMetadata("waveguide-whip-input"),
@@ -173,11 +220,15 @@ func (s *Source) Listen(ctx context.Context) {
 						s.log.Error(err)
 						return
 					}
-					audioTrack.WriteRTP(p)
-					stream.ReportMetadata(control.AudioPacketsMetadata(1))
+					stream.WriteRTP(audioTrack, p)
 				}
 			} else if codec.MimeType == webrtc.MimeTypeH264 {
 				s.log.Info("Got H264 track, sending to video track")
+				stream.SetKeyframeRequester(func() error {
+					return peerConnection.WriteRTCP([]rtcp.Packet{
+						&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
+					})
+				})
 				for {
 					if ctx.Err() != nil || stream.Stopped() {
 						return
@@ -188,8 +239,7 @@ func (s *Source) Listen(ctx context.Context) {
 						s.log.Error(err)
 						return
 					}
-					videoTrack.WriteRTP(p)
-					stream.ReportMetadata(control.VideoPacketsMetadata(1))
+					stream.WriteRTP(videoTrack, p)
 				}
 			}
 		})
@@ -214,13 +264,14 @@ func (s *Source) Listen(ctx context.Context) {
 				shouldClose = true
 			}
 
-			if shouldClose {
+			if shouldClose && atomic.LoadInt32(&takenOver) == 0 {
 				s.cleanupPeerConnection(channelID)
-				s.control.StopStream(channelID)
+				s.control.StreamDisconnected(channelID)
 			}
 		})
 
-		s.addPeerConnection(channelID, peerConnection)
+		sessionID := uuid.New().String()
+		s.addPeerConnection(channelID, sessionID, peerConnection)
 		s.startPeerConnectionTimeout(channelID)
 
 		if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
@@ -247,20 +298,65 @@ func (s *Source) Listen(ctx context.Context) {
 
 		<-gatherComplete
 
-		w.Header().Add("Access-Control-Expose-Headers", "expire")
+		w.Header().Add("Access-Control-Expose-Headers", "expire, location")
 		w.Header().Add("Content-Type", "application/sdp")
 		w.Header().Add("Expire", ttl.Format(http.TimeFormat))
+		w.Header().Add("Location", s.resourceUrl(sessionID))
 		w.WriteHeader(http.StatusCreated)
 
 		fmt.Fprint(w, peerConnection.LocalDescription().SDP)
 	})
+
+	// The publisher ends its stream by deleting the resource it was given in the Location
+	// header, the unguessable ID keeps anyone else from ending it
+	s.control.RegisterHandleFunc("/whip/resource/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		if !s.control.AllowPublisher("whip", r.RemoteAddr) {
+			errForbidden(w, r)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			errWrongParams(w, r)
+			return
+		}
+
+		channelID, ok := s.getSession(path.Base(r.URL.Path))
+		if !ok {
+			errForbidden(w, r)
+			return
+		}
+
+		s.cleanupPeerConnection(channelID)
+		s.control.StopStream(channelID)
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Close removes the WHIP endpoints, publishers that are already connected keep streaming
+func (s *Source) Close() error {
+	s.control.UnregisterHandle("/whip/endpoint/")
+	s.control.UnregisterHandle("/whip/resource/")
+	return nil
 }
 
-func (s *Source) addPeerConnection(channelID types.ChannelID, pc *webrtc.PeerConnection) {
+func (s *Source) resourceUrl(sessionID string) string {
+	return fmt.Sprintf("%s/whip/resource/%s", s.control.HTTPServerURL(), sessionID)
+}
+
+func (s *Source) addPeerConnection(channelID types.ChannelID, sessionID string, pc *webrtc.PeerConnection) {
 	s.peerConnectionsMutex.Lock()
 	defer s.peerConnectionsMutex.Unlock()
 
 	s.peerConnections[channelID] = pc
+	s.sessions[sessionID] = channelID
+}
+func (s *Source) getSession(sessionID string) (types.ChannelID, bool) {
+	s.peerConnectionsMutex.RLock()
+	defer s.peerConnectionsMutex.RUnlock()
+
+	channelID, ok := s.sessions[sessionID]
+	return channelID, ok
 }
 func (s *Source) getPeerConnection(channelID types.ChannelID) (*webrtc.PeerConnection, bool) {
 	s.peerConnectionsMutex.RLock()
@@ -289,6 +385,11 @@ func (s *Source) cleanupPeerConnection(channelID types.ChannelID) {
 	}
 
 	delete(s.peerConnections, channelID)
+	for sessionID, sessionChannel := range s.sessions {
+		if sessionChannel == channelID {
+			delete(s.sessions, sessionID)
+		}
+	}
 }
 
 func errCustom(w http.ResponseWriter, r *http.Request, message string) {
@@ -301,6 +402,27 @@ func errUnauthorized(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text")
 	w.Write([]byte("Unauthorized"))
 }
+func errForbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte("Forbidden"))
+}
+func errTooManyAttempts(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte("Too many failed attempts"))
+}
+func errAtCapacity(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	w.Header().Set("Content-Type", "plain/text")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Server is at capacity"))
+}
+func errUnavailable(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte("Server is draining"))
+}
 func errWrongParams(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusBadRequest)
 	w.Header().Set("Content-Type", "plain/text")
@@ -2,6 +2,7 @@ package hls
 
 import (
 	"context"
+	"errors"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 
@@ -16,6 +17,17 @@ type Server struct {
 	Address string
 }
 
+type Config struct {
+	Address string `fig:"address"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	return nil
+}
+
 func New(address string) *Server {
 	return &Server{
 		Address: address,
@@ -47,3 +59,7 @@ func (s *Server) Listen(ctx context.Context) {
 
 	// s.control.Add
 }
+
+func (s *Server) Close() error {
+	return nil
+}
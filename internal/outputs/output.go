@@ -1,53 +1,45 @@
 package output
 
 import (
-	"context"
 	"fmt"
 
 	"github.com/Glimesh/waveguide/config"
 	"github.com/Glimesh/waveguide/internal/outputs/hls"
 	"github.com/Glimesh/waveguide/internal/outputs/whep"
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/registry"
+	"github.com/Glimesh/waveguide/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
-type Outputs []control.Output
-
-func New(cfg config.Config, ctrl *control.Control, logger *logrus.Logger) (Outputs, error) {
-	sources := cfg.Output.Sources
-
-	outputs := make(Outputs, 0, len(sources))
-
-	for _, src := range sources {
-		var output control.Output
-
-		switch src.Type {
-		case "hls":
-			output = hls.New(src.Address)
-		case "whep":
-			if src.HTTPS {
-				output = whep.New(
-					src.Address,
-					src.Server,
-					whep.WithHTTPS(src.HTTPSHostname, src.HTTPSCert, src.HTTPSKey),
-				)
-			} else {
-				output = whep.New(src.Address, src.Server)
-			}
-		default:
-			return nil, fmt.Errorf("unsupported output source type %s", src.Type)
+func init() {
+	registry.Register(control.OutputTypes, "hls", func(cfg hls.Config) (control.Output, error) {
+		return hls.New(cfg.Address), nil
+	})
+	registry.Register(control.OutputTypes, "whep", func(cfg whep.Config) (control.Output, error) {
+		opts := []whep.Options{
+			whep.WithPlayback(cfg.PlaybackSecret, types.PlaybackPolicy(cfg.PlaybackPolicy), cfg.ChannelPolicyMap()),
 		}
-		output.SetControl(ctrl)
-		output.SetLogger(logger.WithFields(logrus.Fields{"output": src.Type}))
-		outputs = append(outputs, output)
-	}
+		if cfg.HTTPS {
+			opts = append(opts, whep.WithHTTPS(cfg.HTTPSHostname, cfg.HTTPSCert, cfg.HTTPSKey))
+		}
+		return whep.New(cfg.Address, cfg.Server, opts...), nil
+	})
+}
 
-	return outputs, nil
+// Outputs runs the [[output.sources]] and reloads them when the config changes
+type Outputs = control.Listeners[control.Output]
+
+func New(ctrl *control.Control, logger *logrus.Logger) *Outputs {
+	return control.NewListeners("output", control.OutputTypes, ctrl, logger)
 }
 
-func (out Outputs) Start(ctx context.Context) {
-	for i := range out {
-		output := out[i]
-		go output.Listen(ctx)
+// Validate checks every output source without creating them
+func Validate(cfg config.Config) error {
+	for i, src := range cfg.Output.Sources {
+		if err := control.OutputTypes.Validate(src); err != nil {
+			return fmt.Errorf("output.sources[%d]: %w", i, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,48 @@
+package whep
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var peerConnectionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "waveguide_whep_peer_connections",
+	Help: "WHEP peer connections by connection state.",
+}, []string{"state"})
+
+var viewerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "waveguide_whep_viewer_rejections_total",
+	Help: "WHEP viewers turned away by the playback policy, by reason.",
+}, []string{"reason"})
+
+// peerStateTracker moves a peer between the state gauges, pion calls the state
+// handler from its own goroutines so the last state is guarded.
+type peerStateTracker struct {
+	mu    sync.Mutex
+	state webrtc.PeerConnectionState
+}
+
+func newPeerStateTracker() *peerStateTracker {
+	peerConnectionsGauge.WithLabelValues(webrtc.PeerConnectionStateNew.String()).Inc()
+
+	return &peerStateTracker{state: webrtc.PeerConnectionStateNew}
+}
+
+func (t *peerStateTracker) set(state webrtc.PeerConnectionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state == t.state || t.state == webrtc.PeerConnectionStateClosed {
+		return
+	}
+
+	peerConnectionsGauge.WithLabelValues(t.state.String()).Dec()
+	t.state = state
+	// Closed peers are gone, so they're not counted anywhere
+	if state != webrtc.PeerConnectionStateClosed {
+		peerConnectionsGauge.WithLabelValues(state.String()).Inc()
+	}
+}
@@ -1,5 +1,7 @@
 package whep
 
+import "github.com/Glimesh/waveguide/pkg/types"
+
 type Options func(*Server)
 
 func WithHTTPS(hostname, cert, key string) Options {
@@ -10,3 +12,12 @@ func WithHTTPS(hostname, cert, key string) Options {
 		w.HTTPSKey = key
 	}
 }
+
+// WithPlayback requires playback tokens signed with secret for the channels the policies say
+func WithPlayback(secret string, policy types.PlaybackPolicy, channelPolicies map[types.ChannelID]types.PlaybackPolicy) Options {
+	return func(w *Server) {
+		w.playbackSecret = []byte(secret)
+		w.playbackPolicy = policy
+		w.channelPolicies = channelPolicies
+	}
+}
@@ -4,15 +4,19 @@ import (
 	_ "embed"
 
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/Glimesh/waveguide/pkg/auth"
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/Glimesh/waveguide/pkg/types"
 
@@ -27,20 +31,14 @@ const PC_TIMEOUT = time.Minute * 5
 //go:embed public/stream.html
 var streamTemplateContent string
 
-// type WHEPConfig struct {
-// 	// Listen address of the webserver
-// 	Https         bool
-// 	HttpsHostname string `mapstructure:"https_hostname"`
-// 	HttpsCert     string `mapstructure:"https_cert"`
-// 	HttpsKey      string `mapstructure:"https_key"`
-// }
-
 type Server struct {
 	log     logrus.FieldLogger
 	control *control.Control
 
 	peerConnectionsMutex sync.RWMutex
 	peerConnections      map[string]*webrtc.PeerConnection
+	peerChannels         map[string]types.ChannelID
+	peerSubscriptions    map[string]*control.Subscription
 	debugChannels        map[string]*webrtc.DataChannel
 
 	Address string
@@ -50,6 +48,67 @@ type Server struct {
 	HTTPSHostname string `mapstructure:"https_hostname"`
 	HTTPSCert     string `mapstructure:"https_cert"`
 	HTTPSKey      string `mapstructure:"https_key"`
+
+	// Who can watch, the service's policy for a channel wins over these
+	playbackSecret  []byte
+	playbackPolicy  types.PlaybackPolicy
+	channelPolicies map[types.ChannelID]types.PlaybackPolicy
+}
+
+type Config struct {
+	Address string `fig:"address"`
+	Server  string `fig:"server"`
+
+	HTTPS         bool   `fig:"https"`
+	HTTPSHostname string `fig:"https_hostname"`
+	HTTPSCert     string `fig:"https_cert"`
+	HTTPSKey      string `fig:"https_key"`
+
+	// PlaybackSecret checks viewer tokens made by auth.SignPlaybackToken
+	PlaybackSecret string `fig:"playback_secret" secret:"true"`
+	// PlaybackPolicy is public or token, it's public when empty
+	PlaybackPolicy string `fig:"playback_policy"`
+	// ChannelPolicies overrides the policy per channel ID, eg: {"1234" = "token"}
+	ChannelPolicies map[string]string `fig:"channel_policies"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	if cfg.HTTPS && (cfg.HTTPSCert == "" || cfg.HTTPSKey == "") {
+		return errors.New("https_cert and https_key are required with https")
+	}
+
+	policies := []string{cfg.PlaybackPolicy}
+	for channelID, policy := range cfg.ChannelPolicies {
+		if _, err := strconv.ParseUint(channelID, 10, 32); err != nil {
+			return fmt.Errorf("channel_policies: %s is not a channel ID", channelID)
+		}
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		switch types.PlaybackPolicy(policy) {
+		case "", types.PlaybackPublic:
+		case types.PlaybackToken:
+			if cfg.PlaybackSecret == "" {
+				return errors.New("playback_secret is required for the token playback policy")
+			}
+		default:
+			return fmt.Errorf("unknown playback policy %s, expected public or token", policy)
+		}
+	}
+	return nil
+}
+
+// ChannelPolicyMap converts ChannelPolicies for WithPlayback, call Validate first
+func (cfg *Config) ChannelPolicyMap() map[types.ChannelID]types.PlaybackPolicy {
+	policies := make(map[types.ChannelID]types.PlaybackPolicy, len(cfg.ChannelPolicies))
+	for channelID, policy := range cfg.ChannelPolicies {
+		id, _ := strconv.ParseUint(channelID, 10, 32)
+		policies[types.ChannelID(id)] = types.PlaybackPolicy(policy)
+	}
+	return policies
 }
 
 func New(address, server string, opts ...Options) *Server {
@@ -59,6 +118,8 @@ func New(address, server string, opts ...Options) *Server {
 
 		peerConnectionsMutex: sync.RWMutex{},
 		peerConnections:      make(map[string]*webrtc.PeerConnection),
+		peerChannels:         make(map[string]types.ChannelID),
+		peerSubscriptions:    make(map[string]*control.Subscription),
 		debugChannels:        make(map[string]*webrtc.DataChannel),
 	}
 
@@ -79,6 +140,13 @@ func (s *Server) SetLogger(log logrus.FieldLogger) {
 
 func (s *Server) Listen(ctx context.Context) {
 	s.log.Infof("Registering WHEP http endpoints")
+	s.control.SetViewerAuthorizer(s.authorizeViewer)
+
+	api, err := newAPI()
+	if err != nil {
+		s.log.Error(err)
+		return
+	}
 
 	// Todo: Find better way of fetching this path
 	streamTemplate := template.Must(template.New("stream.html").Parse(streamTemplateContent))
@@ -88,6 +156,17 @@ func (s *Server) Listen(ctx context.Context) {
 		strChannelID := path.Base(r.URL.Path)
 
 		w.Header().Add("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			// Browsers check they can send the playback token first
+			w.Header().Add("Access-Control-Allow-Methods", "POST")
+			w.Header().Add("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !s.control.AllowViewer("whep", r.RemoteAddr) {
+			errStatus(w, r, http.StatusForbidden)
+			return
+		}
 
 		channelID, err := strconv.Atoi(strChannelID)
 		if err != nil {
@@ -95,22 +174,69 @@ func (s *Server) Listen(ctx context.Context) {
 			return
 		}
 
+		// Check the viewer before anything is allocated for it
+		if status, err := s.authorizeViewer(r, types.ChannelID(channelID)); err != nil {
+			s.log.Infof("WHEP viewer rejected channel=%d status=%d: %v", channelID, status, err)
+			viewerRejections.WithLabelValues(string(auth.ReasonOf(err))).Inc()
+			errStatus(w, r, status)
+			return
+		}
+
 		peerID := uuid.New().String()
+
+		// Take the viewer's place before allocating anything, it's given back
+		// by cleanupPeerConnection once the peer is added
+		if err := s.control.AddViewer(types.ChannelID(channelID), peerID); errors.Is(err, control.ErrAtCapacity) {
+			s.log.Infof("WHEP viewer rejected channel=%d: %v", channelID, err)
+			errAtCapacity(w, r, s.control.RetryAfter)
+			return
+		} else if err != nil {
+			errNotFound(w, r)
+			return
+		}
+		added := false
+		defer func() {
+			if !added {
+				s.control.RemoveViewer(types.ChannelID(channelID), peerID)
+			}
+		}()
+
 		s.log.Infof("WHEP Negotiation: peer=%s status=started offer=none answer=none", peerID)
 
 		ttl := time.Now().Add(PC_TIMEOUT)
 
-		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
 		if err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "error establishing webrtc connection")
 			return
 		}
+		// The peer connection is closed if we fail before the offer is sent
+		offered := false
+		defer func() {
+			if offered {
+				return
+			}
+			if added {
+				s.cleanupPeerConnection(peerID)
+			} else {
+				peerConnection.Close()
+			}
+		}()
+		// Every viewer gets its own tracks, so it can start with the GOP burst
+		// instead of joining the shared tracks halfway through a GOP
+		viewerTracks := make(map[string]*webrtc.TrackLocalStaticRTP)
+
+		peerState := newPeerStateTracker()
 		peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+			peerState.set(pcs)
+
 			// Clean up our peer connection state
 			// Maybe we don't really worry about the cleanup happening since its a no-op
 
 			switch pcs {
+			case webrtc.PeerConnectionStateConnected:
+				s.forwardMedia(peerID, types.ChannelID(channelID), viewerTracks)
 			case webrtc.PeerConnectionStateClosed:
 				s.cleanupPeerConnection(peerID)
 			case webrtc.PeerConnectionStateDisconnected:
@@ -169,7 +295,22 @@ func (s *Server) Listen(ctx context.Context) {
 			return
 		}
 		for _, track := range tracks {
-			rtpSender, _ := peerConnection.AddTrack(track.Track)
+			if track.Local {
+				continue
+			}
+			viewerTrack, err := webrtc.NewTrackLocalStaticRTP(
+				webrtc.RTPCodecCapability{MimeType: track.Codec},
+				track.Track.ID(),
+				track.Track.StreamID(),
+			)
+			if err != nil {
+				s.log.Error(err)
+				errCustom(w, r, "error creating track")
+				return
+			}
+			viewerTracks[track.Codec] = viewerTrack
+
+			rtpSender, _ := peerConnection.AddTrack(viewerTrack)
 			go func() {
 				// _ := s.log.WithField("peer", peerID)
 				for {
@@ -179,6 +320,13 @@ func (s *Server) Listen(ctx context.Context) {
 						return
 					}
 
+					for _, r := range rtcpPackets {
+						switch r.(type) {
+						case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+							s.requestKeyframe(types.ChannelID(channelID))
+						}
+					}
+
 					debugChannel, ok := s.debugChannels[peerID]
 					if !ok {
 						continue
@@ -212,7 +360,8 @@ func (s *Server) Listen(ctx context.Context) {
 			}()
 		}
 
-		s.addPeerConnection(peerID, peerConnection)
+		s.addPeerConnection(peerID, types.ChannelID(channelID), peerConnection)
+		added = true
 		s.startPeerConnectionTimeout(peerID)
 
 		// Used for SDP offer generated by the WHEP endpoint
@@ -240,6 +389,7 @@ func (s *Server) Listen(ctx context.Context) {
 		w.Header().Add("Location", s.resourceUrl(peerID))
 		w.Header().Add("Expire", ttl.Format(http.TimeFormat))
 		w.WriteHeader(http.StatusCreated)
+		offered = true
 
 		fmt.Fprint(w, string(localDescription.SDP))
 	})
@@ -293,21 +443,78 @@ func (s *Server) Listen(ctx context.Context) {
 
 	s.control.RegisterHandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
 		channelID := path.Base(r.URL.Path)
+		endpointUrl := s.endpointUrl(channelID)
+		// Pass the playback token along, eg: /stream/1234?token=...
+		if token := r.URL.Query().Get("token"); token != "" {
+			endpointUrl += "?token=" + url.QueryEscape(token)
+		}
 		data := struct {
 			ChannelID   string
-			EndpointUrl template.HTML
-		}{ChannelID: channelID, EndpointUrl: template.HTML(s.endpointUrl(channelID))}
+			EndpointUrl template.URL
+		}{ChannelID: channelID, EndpointUrl: template.URL(endpointUrl)}
 
 		streamTemplate.Execute(w, data)
 	})
 }
 
-func (s *Server) addPeerConnection(uuid string, pc *webrtc.PeerConnection) {
+// Close removes the WHEP endpoints, viewers that are already watching keep going
+func (s *Server) Close() error {
+	s.control.SetViewerAuthorizer(nil)
+	s.control.UnregisterHandle("/whep/endpoint/")
+	s.control.UnregisterHandle("/whep/resource/")
+	s.control.UnregisterHandle("/stream/")
+	return nil
+}
+
+func (s *Server) addPeerConnection(uuid string, channelID types.ChannelID, pc *webrtc.PeerConnection) {
 	s.peerConnectionsMutex.Lock()
 	defer s.peerConnectionsMutex.Unlock()
 
 	s.peerConnections[uuid] = pc
+	s.peerChannels[uuid] = channelID
+}
+
+// forwardMedia feeds the viewer tracks from the stream once the peer is connected,
+// packets written before then would be dropped and take the GOP burst with them
+func (s *Server) forwardMedia(uuid string, channelID types.ChannelID, tracks map[string]*webrtc.TrackLocalStaticRTP) {
+	sub, err := s.control.SubscribeViewer(channelID, uuid)
+	if err != nil {
+		s.log.Debugf("could not subscribe viewer %s: %v", uuid, err)
+		return
+	}
+
+	s.peerConnectionsMutex.Lock()
+	if _, ok := s.peerConnections[uuid]; !ok {
+		s.peerConnectionsMutex.Unlock()
+		sub.Close()
+		return
+	}
+	s.peerSubscriptions[uuid] = sub
+	s.peerConnectionsMutex.Unlock()
+
+	go func() {
+		for pkt := range sub.Packets() {
+			track, ok := tracks[pkt.Codec]
+			if !ok {
+				continue
+			}
+			if err := track.WriteRTP(pkt.Packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				s.log.Error(err)
+				return
+			}
+		}
+	}()
+}
+
+// requestKeyframe forwards a viewer PLI/FIR to the publisher, inputs that can't
+// be asked for one leave the viewer waiting for the next keyframe
+func (s *Server) requestKeyframe(channelID types.ChannelID) {
+	err := s.control.RequestKeyframe(channelID)
+	if err != nil && !errors.Is(err, control.ErrKeyframeUnsupported) {
+		s.log.Debugf("could not request keyframe for %d: %v", channelID, err)
+	}
 }
+
 func (s *Server) getPeerConnection(uuid string) (*webrtc.PeerConnection, bool) {
 	s.peerConnectionsMutex.RLock()
 	defer s.peerConnectionsMutex.RUnlock()
@@ -333,8 +540,52 @@ func (s *Server) cleanupPeerConnection(uuid string) {
 	if pc, ok := s.peerConnections[uuid]; ok {
 		pc.Close()
 	}
+	if sub, ok := s.peerSubscriptions[uuid]; ok {
+		sub.Close()
+	}
+	if channelID, ok := s.peerChannels[uuid]; ok {
+		s.control.RemoveViewer(channelID, uuid)
+	}
 
 	delete(s.peerConnections, uuid)
+	delete(s.peerChannels, uuid)
+	delete(s.peerSubscriptions, uuid)
+}
+
+// authorizeViewer checks the viewer's playback token when the channel needs one,
+// returning the HTTP status to reject the viewer with
+func (s *Server) authorizeViewer(r *http.Request, channelID types.ChannelID) (int, error) {
+	policy, err := s.control.PlaybackPolicy(channelID)
+	if err != nil {
+		// Fail closed, the channel could be private
+		return http.StatusServiceUnavailable, auth.Reject(auth.ReasonUnavailable, err)
+	}
+	if policy == "" {
+		policy = s.channelPolicies[channelID]
+	}
+	if policy == "" {
+		policy = s.playbackPolicy
+	}
+	if policy != types.PlaybackToken {
+		return 0, nil
+	}
+
+	if len(s.playbackSecret) == 0 {
+		return http.StatusForbidden, auth.Reject(auth.ReasonUnsupported, errors.New("playback_secret is not set"))
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	err = auth.VerifyPlaybackToken(s.playbackSecret, token, channelID, time.Now())
+	if auth.ReasonOf(err) == auth.ReasonMissingKey {
+		return http.StatusUnauthorized, err
+	} else if err != nil {
+		return http.StatusForbidden, err
+	}
+	return 0, nil
 }
 
 func (s *Server) endpointUrl(channelID string) string {
@@ -356,11 +607,25 @@ func errCustom(w http.ResponseWriter, r *http.Request, message string) {
 	w.Header().Set("Content-Type", "plain/text")
 	w.Write([]byte(message))
 }
+func errStatus(w http.ResponseWriter, r *http.Request, status int) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(status)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte(http.StatusText(status)))
+}
 func errWrongParams(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusBadRequest)
 	w.Header().Set("Content-Type", "plain/text")
 	w.Write([]byte("Invalid Parameters"))
 }
+func errAtCapacity(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	w.Header().Set("Content-Type", "plain/text")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Server is at capacity"))
+}
 func errNotFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Header().Set("Content-Type", "plain/text")
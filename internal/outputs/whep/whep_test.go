@@ -0,0 +1,64 @@
+package whep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBFramePassthroughOffersNoVideo(t *testing.T) {
+	assert := assert.New(t)
+
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy"}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+	cfg.Control.ChannelBFramePolicies = map[string]string{"1234": "passthrough"}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	ctrl, err := control.New(context.Background(), cfg, "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Shutdown()
+
+	srv := New(":0", "")
+	srv.SetControl(ctrl)
+	srv.SetLogger(logger)
+	srv.Listen(context.Background())
+
+	offer := func(channelID types.ChannelID) string {
+		rec := httptest.NewRecorder()
+		ctrl.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/whep/endpoint/%d", channelID), nil))
+		assert.Equal(http.StatusCreated, rec.Code)
+		return rec.Body.String()
+	}
+
+	for _, channelID := range []types.ChannelID{1, 1234} {
+		stream, err := ctrl.StartStream(channelID)
+		assert.NoError(err)
+		video, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+		audio, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+		assert.NoError(stream.AddTrack(video, webrtc.MimeTypeH264))
+		assert.NoError(stream.AddTrack(audio, webrtc.MimeTypeOpus))
+		assert.NoError(ctrl.ReportBFrames(stream))
+	}
+
+	assert.Contains(offer(1), "m=video", "the default policy still sends the video")
+
+	sdp := offer(1234)
+	assert.Contains(sdp, "m=audio")
+	assert.NotContains(sdp, "m=video", "b-frame video isn't offered to viewers under passthrough")
+}
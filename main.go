@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"net/http"
-	_ "net/http/pprof"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,12 +11,20 @@ import (
 	config "github.com/Glimesh/waveguide/config"
 	inputs "github.com/Glimesh/waveguide/internal/inputs"
 	outputs "github.com/Glimesh/waveguide/internal/outputs"
+	auth "github.com/Glimesh/waveguide/pkg/auth"
 	control "github.com/Glimesh/waveguide/pkg/control"
+	orchestrator "github.com/Glimesh/waveguide/pkg/orchestrator"
+	service "github.com/Glimesh/waveguide/pkg/service"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	configPath := flag.String("config", "config.toml", "path to the config file")
+	logLevel := flag.String("log-level", "", "overrides control.log_level, eg: debug")
+	validate := flag.Bool("validate", false, "check the config and exit")
+	flag.Parse()
+
 	log := logrus.New()
 
 	hostname, err := os.Hostname()
@@ -26,15 +34,13 @@ func main() {
 	}
 	log.Debugf("Server Hostname: %s", hostname)
 
-	cfg, err := config.Load()
+	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("failed to read config: %v", err)
 	}
-
-	// Temporary for debugging
-	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
-	}()
+	if *logLevel != "" {
+		cfg.Control.LogLevel = *logLevel
+	}
 
 	level, err := logrus.ParseLevel(cfg.Control.LogLevel)
 	if err != nil {
@@ -42,32 +48,101 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	ctx, stop := signal.NotifyContext(
+	if *validate {
+		if err := validateConfig(cfg, hostname); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+		log.Infof("%s is valid", *configPath)
+		return
+	}
+
+	// The first signal drains the node, streams keep running on ctx until it's done
+	signalCtx, stop := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt, syscall.SIGTERM, syscall.SIGINT,
 	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	ctrl, err := control.New(ctx, cfg, hostname, log)
 	if err != nil {
 		log.Fatalf("failed to create control: %v", err)
 	}
 
-	in, err := inputs.New(cfg, ctrl, log)
-	if err != nil {
+	in := inputs.New(ctrl, log)
+	if err := in.Start(ctx, cfg.Input.Sources); err != nil {
 		log.Fatalf("failed to create inputs: %v", err)
 	}
-	in.Start(ctx)
 
-	out, err := outputs.New(cfg, ctrl, log)
-	if err != nil {
+	out := outputs.New(ctrl, log)
+	if err := out.Start(ctx, cfg.Output.Sources); err != nil {
 		log.Fatalf("failed to create outputs: %v", err)
 	}
-	out.Start(ctx)
+
+	// Only the inputs and outputs are reloaded, everything else needs a restart
+	ctrl.SetReloader(func() error {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := validateConfig(cfg, hostname); err != nil {
+			return err
+		}
+		if err := in.Reload(cfg.Input.Sources); err != nil {
+			return err
+		}
+		return out.Reload(cfg.Output.Sources)
+	})
+	go reloadOnSignal(ctrl, log)
 
 	go ctrl.StartHTTPServer()
 
-	<-ctx.Done()
+	<-signalCtx.Done()
+	// Restore the default behaviour, so a second signal exits immediately
 	stop()
+	log.Info("Draining Waveguide, send the signal again to exit immediately")
+	ctrl.Drain()
+
 	log.Info("Exiting Waveguide and cleaning up")
 	ctrl.Shutdown()
 }
+
+// validateConfig decodes every source through its registry, without starting anything
+func validateConfig(cfg config.Config, hostname string) error {
+	if err := control.Validate(cfg); err != nil {
+		return err
+	}
+	if err := service.Validate(cfg); err != nil {
+		return err
+	}
+	if err := orchestrator.Validate(cfg, hostname); err != nil {
+		return err
+	}
+	if err := auth.Validate(cfg.Auth); err != nil {
+		return err
+	}
+	if _, err := auth.ParseACL(cfg.Access.PublishAllow, cfg.Access.PublishDeny); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	if _, err := auth.ParseACL(cfg.Access.ViewAllow, cfg.Access.ViewDeny); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	if err := inputs.Validate(cfg); err != nil {
+		return err
+	}
+	return outputs.Validate(cfg)
+}
+
+func reloadOnSignal(ctrl *control.Control, log *logrus.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.Info("Reloading config")
+		if err := ctrl.Reload(); err != nil {
+			log.Errorf("failed to reload config: %v", err)
+			continue
+		}
+		log.Info("Reloaded config")
+	}
+}
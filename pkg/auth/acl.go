@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ACL is a static list of networks allowed or denied, deny wins over allow and
+// everyone is allowed when the allow list is empty. A nil ACL allows everyone.
+type ACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ParseACL reads CIDRs or single addresses, eg: 10.0.0.0/8 or 2001:db8::1
+func ParseACL(allow, deny []string) (*ACL, error) {
+	var acl ACL
+	var err error
+
+	if acl.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+
+	return &acl, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a CIDR or address", cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a CIDR or address", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether the remote address may connect, it takes an address
+// with or without the port. Addresses that can't be parsed are only allowed
+// when there's nothing to check.
+func (acl *ACL) Allowed(remoteAddr string) bool {
+	if acl == nil || (len(acl.allow) == 0 && len(acl.deny) == 0) {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(RemoteIP(remoteAddr))
+	if err != nil {
+		return false
+	}
+	// IPv4 clients of a dual stack listener show up as ::ffff:a.b.c.d
+	addr = addr.Unmap()
+
+	for _, prefix := range acl.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, prefix := range acl.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP strips the port from a remote address
+func RemoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
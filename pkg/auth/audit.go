@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// AuditAction is what happened to an attempt
+type AuditAction string
+
+const (
+	AuditAccepted AuditAction = "accepted"
+	AuditRejected AuditAction = "rejected"
+	// AuditDenied is a connection refused by the ACL before it could try
+	AuditDenied AuditAction = "denied"
+)
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time   time.Time   `json:"time"`
+	Action AuditAction `json:"action"`
+	// Role is publish or view
+	Role string `json:"role"`
+	// Type is the input or output, eg: rtmp
+	Type       string          `json:"type,omitempty"`
+	ChannelID  types.ChannelID `json:"channel_id,omitempty"`
+	RemoteAddr string          `json:"remote_addr"`
+	Reason     Reason          `json:"reason,omitempty"`
+}
+
+// AuditLog writes every authentication attempt as a line of JSON, so it can be
+// shipped by a log collector. A nil AuditLog drops the events.
+type AuditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog appends to the file at path, - writes to stdout
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return NewAuditLog(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{w: f, closer: f}, nil
+}
+
+// Record writes the event, the time is filled in when it's zero
+func (a *AuditLog) Record(event AuditEvent) error {
+	if a == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(line)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
@@ -0,0 +1,171 @@
+// Package auth decides whether a publisher may stream. Inputs parse what the
+// publisher sent with ParseStreamKey, and Control checks it with the Authenticator
+// picked by the [auth] config.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/registry"
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// Request is what a publisher presented to an input
+type Request struct {
+	ChannelID types.ChannelID
+	StreamKey types.StreamKey
+	// Proof is set instead of StreamKey by protocols that never send the key,
+	// it reports whether the publisher knew it, eg: FTL signs a challenge with it
+	Proof func(key []byte) bool
+
+	// InputType is the registered name of the input, eg: rtmp
+	InputType  string
+	RemoteAddr string
+}
+
+// Grant is what an authenticated publisher is allowed to do
+type Grant struct {
+	ChannelID types.ChannelID
+	// MaxBitrate of the stream in bits per second, zero is unlimited
+	MaxBitrate int
+}
+
+type Authenticator interface {
+	Authenticate(req Request) (Grant, error)
+}
+
+// Reason is why a publisher was rejected, it's safe to show to the publisher
+type Reason string
+
+const (
+	ReasonMissingKey      Reason = "missing_key"
+	ReasonMalformedKey    Reason = "malformed_key"
+	ReasonInvalidKey      Reason = "invalid_key"
+	ReasonExpired         Reason = "expired"
+	ReasonWrongChannel    Reason = "wrong_channel"
+	ReasonInputNotAllowed Reason = "input_not_allowed"
+	// ReasonUnsupported is used when the authenticator can't check what the input
+	// has, eg: FTL never sends the key so it can't be a token
+	ReasonUnsupported Reason = "unsupported"
+	// ReasonUnavailable is used when the service or callback couldn't answer
+	ReasonUnavailable Reason = "unavailable"
+	ReasonDraining    Reason = "draining"
+	// ReasonAtCapacity is used when the node can't take another publisher
+	ReasonAtCapacity Reason = "at_capacity"
+	// ReasonLockedOut is used when the address or channel failed too many times recently
+	ReasonLockedOut Reason = "locked_out"
+	// ReasonAddressDenied is used when the address isn't allowed by the ACL
+	ReasonAddressDenied Reason = "address_denied"
+)
+
+// Retryable is true when the publisher could succeed on another attempt or another node
+func (r Reason) Retryable() bool {
+	return r == ReasonUnavailable || r == ReasonDraining || r == ReasonAtCapacity
+}
+
+// Error is a rejected publisher
+type Error struct {
+	Reason Reason
+	Err    error
+}
+
+func Reject(reason Reason, err error) *Error {
+	return &Error{Reason: reason, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("publisher rejected: %s", e.Reason)
+	}
+	return fmt.Sprintf("publisher rejected: %s: %v", e.Reason, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ReasonOf returns why err rejected the publisher, errors that aren't an Error
+// are treated as the authenticator being unavailable
+func ReasonOf(err error) Reason {
+	var authErr *Error
+	if errors.As(err, &authErr) {
+		return authErr.Reason
+	}
+	return ReasonUnavailable
+}
+
+// ParseStreamKey splits a `channelID-key` stream key. Keys without the channel
+// prefix use channelID instead, eg: from a WHIP URL, zero means it's required.
+// Only the first dash splits, so the key itself can contain dashes.
+func ParseStreamKey(raw string, channelID types.ChannelID) (types.ChannelID, types.StreamKey, error) {
+	if raw == "" {
+		return 0, nil, Reject(ReasonMissingKey, nil)
+	}
+
+	if prefix, key, ok := strings.Cut(raw, "-"); ok {
+		if id, err := strconv.ParseUint(prefix, 10, 32); err == nil {
+			if key == "" {
+				return 0, nil, Reject(ReasonMissingKey, nil)
+			}
+			return types.ChannelID(id), types.StreamKey(key), nil
+		}
+	}
+
+	if channelID == 0 {
+		return 0, nil, Reject(ReasonMalformedKey, errors.New("expected channelID-key"))
+	}
+	return channelID, types.StreamKey(raw), nil
+}
+
+// KeySource has the stream key of every channel, it's the service
+type KeySource interface {
+	GetHmacKey(channelID types.ChannelID) ([]byte, error)
+}
+
+// Types holds every authenticator that can be picked with `type` in the [auth] config
+var Types = registry.New[Authenticator]("auth")
+
+func init() {
+	registry.Register(Types, "service", func(cfg ServiceKeyConfig) (Authenticator, error) {
+		return &ServiceKey{}, nil
+	})
+	registry.Register(Types, "token", func(cfg TokenConfig) (Authenticator, error) {
+		return NewToken([]byte(cfg.Secret), cfg.Leeway), nil
+	})
+	registry.Register(Types, "http", func(cfg CallbackConfig) (Authenticator, error) {
+		return NewCallback(cfg.URL, cfg.Secret, cfg.Timeout), nil
+	})
+}
+
+// New creates the authenticator from the [auth] config, the service key check is the default
+func New(src config.Source, keys KeySource) (Authenticator, error) {
+	a, err := Types.New(withDefaultType(src))
+	if err != nil {
+		return nil, err
+	}
+	if serviceKey, ok := a.(*ServiceKey); ok {
+		serviceKey.keys = keys
+	}
+	return a, nil
+}
+
+// Validate checks the [auth] config without creating anything
+func Validate(src config.Source) error {
+	return Types.Validate(withDefaultType(src))
+}
+
+func withDefaultType(src config.Source) config.Source {
+	if src.Type() != "" {
+		return src
+	}
+	table := make(config.Source, len(src)+1)
+	for k, v := range src {
+		table[k] = v
+	}
+	table[registry.TypeKey] = "service"
+	return table
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStreamKey(t *testing.T) {
+	assert := assert.New(t)
+
+	channelID, key, err := ParseStreamKey("1234-abc-def", 0)
+	assert.NoError(err)
+	assert.Equal(types.ChannelID(1234), channelID)
+	assert.Equal(types.StreamKey("abc-def"), key, "only the first dash splits")
+
+	channelID, key, err = ParseStreamKey("abc-def", 5678)
+	assert.NoError(err)
+	assert.Equal(types.ChannelID(5678), channelID)
+	assert.Equal(types.StreamKey("abc-def"), key)
+
+	_, _, err = ParseStreamKey("abc", 0)
+	assert.Equal(ReasonMalformedKey, ReasonOf(err))
+	_, _, err = ParseStreamKey("", 0)
+	assert.Equal(ReasonMissingKey, ReasonOf(err))
+}
+
+func TestToken(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	a := NewToken([]byte("secret"), 0)
+	a.now = func() time.Time { return now }
+
+	token, err := SignToken([]byte("secret"), Claims{
+		ChannelID:  1234,
+		ExpiresAt:  now.Add(time.Minute).Unix(),
+		Inputs:     []string{"rtmp"},
+		MaxBitrate: 6000000,
+	})
+	assert.NoError(err)
+
+	grant, err := a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey(token), InputType: "rtmp"})
+	assert.NoError(err)
+	assert.Equal(Grant{ChannelID: 1234, MaxBitrate: 6000000}, grant)
+
+	_, err = a.Authenticate(Request{ChannelID: 5678, StreamKey: types.StreamKey(token), InputType: "rtmp"})
+	assert.Equal(ReasonWrongChannel, ReasonOf(err))
+	_, err = a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey(token), InputType: "whip"})
+	assert.Equal(ReasonInputNotAllowed, ReasonOf(err))
+	_, err = a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey(token + "x"), InputType: "rtmp"})
+	assert.Equal(ReasonInvalidKey, ReasonOf(err))
+
+	now = now.Add(2 * time.Minute)
+	_, err = a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey(token), InputType: "rtmp"})
+	assert.Equal(ReasonExpired, ReasonOf(err))
+}
+
+func TestPlaybackToken(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	token, err := SignPlaybackToken([]byte("secret"), PlaybackClaims{
+		ChannelID: 1234,
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	})
+	assert.NoError(err)
+
+	assert.NoError(VerifyPlaybackToken([]byte("secret"), token, 1234, now))
+	assert.Equal(ReasonWrongChannel, ReasonOf(VerifyPlaybackToken([]byte("secret"), token, 5678, now)))
+	assert.Equal(ReasonExpired, ReasonOf(VerifyPlaybackToken([]byte("secret"), token, 1234, now.Add(2*time.Minute))))
+	assert.Equal(ReasonInvalidKey, ReasonOf(VerifyPlaybackToken([]byte("other"), token, 1234, now)))
+	assert.Equal(ReasonMissingKey, ReasonOf(VerifyPlaybackToken([]byte("secret"), "", 1234, now)))
+
+	// Publisher and playback tokens aren't interchangeable
+	publish, err := SignToken([]byte("secret"), Claims{ChannelID: 1234})
+	assert.NoError(err)
+	assert.Equal(ReasonInvalidKey, ReasonOf(VerifyPlaybackToken([]byte("secret"), publish, 1234, now)))
+	_, err = NewToken([]byte("secret"), 0).Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey(token), InputType: "rtmp"})
+	assert.Equal(ReasonInvalidKey, ReasonOf(err))
+}
+
+func TestACL(t *testing.T) {
+	assert := assert.New(t)
+
+	acl, err := ParseACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.2.3"})
+	assert.NoError(err)
+	assert.True(acl.Allowed("10.0.0.1:1935"))
+	assert.True(acl.Allowed("[::ffff:10.0.0.1]:1935"), "IPv4 mapped addresses match IPv4 CIDRs")
+	assert.True(acl.Allowed("[2001:db8::1]:8080"))
+	assert.False(acl.Allowed("10.1.2.3:1935"), "deny wins over allow")
+	assert.False(acl.Allowed("192.168.0.1:1935"))
+	assert.False(acl.Allowed("nonsense"))
+
+	acl, err = ParseACL(nil, []string{"192.168.0.0/16"})
+	assert.NoError(err)
+	assert.True(acl.Allowed("10.0.0.1:1935"))
+	assert.False(acl.Allowed("192.168.4.4:1935"))
+
+	var none *ACL
+	assert.True(none.Allowed("192.168.4.4:1935"))
+
+	_, err = ParseACL([]string{"10.0.0.0/33"}, nil)
+	assert.Error(err)
+}
+
+func TestLockout(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	l := NewLockout(LockoutConfig{MaxFailures: 2, ChannelMaxFailures: 2, Duration: time.Minute, MaxDuration: 3 * time.Minute, Window: time.Hour})
+	l.now = func() time.Time { return now }
+
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Zero(l.Check("10.0.0.1:2000", 1234))
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Equal(time.Minute, l.Check("10.0.0.1:2000", 5678), "the address is locked on any port and channel")
+	assert.Equal(time.Minute, l.Check("10.0.0.2:1000", 1234), "the channel is locked from any address")
+	assert.Zero(l.Check("10.0.0.2:1000", 5678))
+
+	// Each failure after doubles the lockout, up to the max
+	now = now.Add(time.Minute)
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Equal(2*time.Minute, l.Check("10.0.0.1:1000", 1234))
+	now = now.Add(2 * time.Minute)
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Equal(3*time.Minute, l.Check("10.0.0.1:1000", 1234))
+
+	l.Success("10.0.0.1:1000", 1234)
+	assert.Zero(l.Check("10.0.0.1:1000", 1234))
+
+	// Failures are forgotten after the window
+	l.Failure("10.0.0.1:1000", 1234)
+	now = now.Add(2 * time.Hour)
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Zero(l.Check("10.0.0.1:1000", 1234))
+
+	// The channel takes more failures, one address is locked out well before it
+	l = NewLockout(LockoutConfig{MaxFailures: 2, ChannelMaxFailures: 4, Window: time.Hour})
+	l.now = func() time.Time { return now }
+	l.Failure("10.0.0.1:1000", 1234)
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Equal(time.Minute, l.Check("10.0.0.1:1000", 1234))
+	assert.Zero(l.Check("10.0.0.2:1000", 1234), "the streamer can still use its key")
+	l.Failure("10.0.0.3:1000", 1234)
+	l.Failure("10.0.0.4:1000", 1234)
+	assert.Equal(time.Minute, l.Check("10.0.0.2:1000", 1234), "a guess spread over addresses locks the channel")
+
+	// Either lockout can be turned off on its own
+	l = NewLockout(LockoutConfig{MaxFailures: 1})
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.NotZero(l.Check("10.0.0.1:1000", 5678))
+	assert.Zero(l.Check("10.0.0.2:1000", 1234))
+	l = NewLockout(LockoutConfig{ChannelMaxFailures: 1})
+	l.Failure("10.0.0.1:1000", 1234)
+	assert.Zero(l.Check("10.0.0.1:1000", 5678))
+	assert.NotZero(l.Check("10.0.0.2:1000", 1234))
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	a := NewAuditLog(&buf)
+	assert.NoError(a.Record(AuditEvent{
+		Time:       time.Unix(1700000000, 0).UTC(),
+		Action:     AuditRejected,
+		Role:       "publish",
+		Type:       "rtmp",
+		ChannelID:  1234,
+		RemoteAddr: "10.0.0.1:1000",
+		Reason:     ReasonInvalidKey,
+	}))
+	assert.Equal(`{"time":"2023-11-14T22:13:20Z","action":"rejected","role":"publish","type":"rtmp","channel_id":1234,"remote_addr":"10.0.0.1:1000","reason":"invalid_key"}`+"\n", buf.String())
+
+	var none *AuditLog
+	assert.NoError(none.Record(AuditEvent{}))
+}
+
+type testKeys map[types.ChannelID][]byte
+
+func (k testKeys) GetHmacKey(channelID types.ChannelID) ([]byte, error) {
+	return k[channelID], nil
+}
+
+func TestServiceKeyProof(t *testing.T) {
+	assert := assert.New(t)
+	a := NewServiceKey(testKeys{1234: []byte("key")})
+
+	_, err := a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey("key")})
+	assert.NoError(err)
+	_, err = a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey("nope")})
+	assert.Equal(ReasonInvalidKey, ReasonOf(err))
+
+	_, err = a.Authenticate(Request{ChannelID: 1234, Proof: func(key []byte) bool { return string(key) == "key" }})
+	assert.NoError(err)
+}
+
+func TestCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CallbackRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.StreamKey != "good" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(CallbackResponse{Reason: ReasonExpired})
+			return
+		}
+		json.NewEncoder(w).Encode(CallbackResponse{MaxBitrate: 1000})
+	}))
+	defer srv.Close()
+
+	a := NewCallback(srv.URL, "secret", time.Second)
+	grant, err := a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey("good")})
+	assert.NoError(err)
+	assert.Equal(1000, grant.MaxBitrate)
+
+	_, err = a.Authenticate(Request{ChannelID: 1234, StreamKey: types.StreamKey("bad")})
+	assert.Equal(ReasonExpired, ReasonOf(err))
+}
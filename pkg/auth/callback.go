@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+	"github.com/Glimesh/waveguide/pkg/webhook"
+)
+
+const defaultCallbackTimeout = 5 * time.Second
+
+type CallbackConfig struct {
+	URL string `fig:"url"`
+	// Secret signs the requests the same way as webhooks, see webhook.Sign
+	Secret  string        `fig:"secret" secret:"true"`
+	Timeout time.Duration `fig:"timeout"`
+}
+
+func (cfg *CallbackConfig) Validate() error {
+	if cfg.URL == "" {
+		return errors.New("url is required")
+	}
+	return nil
+}
+
+// Callback asks an HTTP endpoint whether the publisher is allowed. It's POSTed a
+// CallbackRequest and allows the publisher with a 2xx, optionally answering with a
+// CallbackResponse. 401 and 403 reject the publisher, anything else is an error.
+type Callback struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+type CallbackRequest struct {
+	ChannelID  types.ChannelID `json:"channel_id"`
+	StreamKey  string          `json:"stream_key"`
+	InputType  string          `json:"input_type"`
+	RemoteAddr string          `json:"remote_addr"`
+}
+
+type CallbackResponse struct {
+	MaxBitrate int `json:"max_bitrate,omitempty"`
+	// Reason is used for rejections, it defaults to invalid_key
+	Reason Reason `json:"reason,omitempty"`
+}
+
+func NewCallback(url, secret string, timeout time.Duration) *Callback {
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+	return &Callback{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (a *Callback) Authenticate(req Request) (Grant, error) {
+	if req.Proof != nil {
+		return Grant{}, Reject(ReasonUnsupported, errors.New("the callback can't check inputs that never send the key"))
+	}
+	if len(req.StreamKey) == 0 {
+		return Grant{}, Reject(ReasonMissingKey, nil)
+	}
+
+	body, err := json.Marshal(CallbackRequest{
+		ChannelID:  req.ChannelID,
+		StreamKey:  string(req.StreamKey),
+		InputType:  req.InputType,
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		return Grant{}, Reject(ReasonUnavailable, err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return Grant{}, Reject(ReasonUnavailable, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(webhook.HeaderTimestamp, timestamp)
+	if a.secret != "" {
+		httpReq.Header.Set(webhook.HeaderSignature, "sha256="+webhook.Sign(a.secret, timestamp, body))
+	}
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return Grant{}, Reject(ReasonUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var answer CallbackResponse
+	// The body is optional, an empty one leaves the defaults
+	json.NewDecoder(resp.Body).Decode(&answer) //nolint errcheck
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return Grant{ChannelID: req.ChannelID, MaxBitrate: answer.MaxBitrate}, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		if answer.Reason == "" {
+			answer.Reason = ReasonInvalidKey
+		}
+		return Grant{}, Reject(answer.Reason, nil)
+	default:
+		return Grant{}, Reject(ReasonUnavailable, fmt.Errorf("callback responded with %s", resp.Status))
+	}
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// maxLockoutEntries bounds the memory a flood of addresses can take, the
+// stale entries are swept when it's reached
+const maxLockoutEntries = 100000
+
+type LockoutConfig struct {
+	// MaxFailures in a row from an address before locking it out, disabled when zero
+	MaxFailures int
+	// ChannelMaxFailures in a row for a channel, from any address, before locking it
+	// out, disabled when zero. A locked channel refuses the right key as well, so it's
+	// meant to be high enough that only a guess spread over many addresses reaches it.
+	ChannelMaxFailures int
+	// Duration of the first lockout, it doubles with every failure after
+	Duration time.Duration
+	// MaxDuration caps the lockout
+	MaxDuration time.Duration
+	// Window is how long failures are remembered without another attempt
+	Window time.Duration
+}
+
+// Lockout tracks failed authentications per address and per channel, locking
+// them out for exponentially longer once they fail too often
+type Lockout struct {
+	cfg LockoutConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLockout(cfg LockoutConfig) *Lockout {
+	if cfg.Duration <= 0 {
+		cfg.Duration = time.Minute
+	}
+	if cfg.MaxDuration < cfg.Duration {
+		cfg.MaxDuration = cfg.Duration
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+
+	return &Lockout{
+		cfg:     cfg,
+		now:     time.Now,
+		entries: make(map[string]*lockoutEntry),
+	}
+}
+
+func addressKey(remoteAddr string) string {
+	return "addr:" + RemoteIP(remoteAddr)
+}
+
+func channelKey(channelID types.ChannelID) string {
+	return fmt.Sprintf("channel:%d", channelID)
+}
+
+// lockoutKey is an entry that's tracked and the failures that lock it out
+type lockoutKey struct {
+	key         string
+	maxFailures int
+}
+
+// keys are the entries of the attempt that have lockouts enabled
+func (l *Lockout) keys(remoteAddr string, channelID types.ChannelID) []lockoutKey {
+	var keys []lockoutKey
+	if l.cfg.MaxFailures > 0 {
+		keys = append(keys, lockoutKey{addressKey(remoteAddr), l.cfg.MaxFailures})
+	}
+	if l.cfg.ChannelMaxFailures > 0 {
+		keys = append(keys, lockoutKey{channelKey(channelID), l.cfg.ChannelMaxFailures})
+	}
+	return keys
+}
+
+// Check returns how much longer the address or channel is locked out for, it's
+// zero when the attempt can go ahead
+func (l *Lockout) Check(remoteAddr string, channelID types.ChannelID) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var remaining time.Duration
+	for _, key := range l.keys(remoteAddr, channelID) {
+		if entry, ok := l.entries[key.key]; ok && entry.lockedUntil.After(now) {
+			if left := entry.lockedUntil.Sub(now); left > remaining {
+				remaining = left
+			}
+		}
+	}
+	return remaining
+}
+
+// Failure records a failed attempt
+func (l *Lockout) Failure(remoteAddr string, channelID types.ChannelID) {
+	if l == nil {
+		return
+	}
+	keys := l.keys(remoteAddr, channelID)
+	if len(keys) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.entries) >= maxLockoutEntries {
+		l.sweep(now)
+	}
+
+	for _, key := range keys {
+		entry, ok := l.entries[key.key]
+		if !ok || l.stale(entry, now) {
+			entry = &lockoutEntry{}
+			l.entries[key.key] = entry
+		}
+
+		entry.failures++
+		entry.lastFailure = now
+		if over := entry.failures - key.maxFailures; over >= 0 {
+			entry.lockedUntil = now.Add(l.lockoutFor(over))
+		}
+	}
+}
+
+// Success forgets the failures of the address and channel
+func (l *Lockout) Success(remoteAddr string, channelID types.ChannelID) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range l.keys(remoteAddr, channelID) {
+		delete(l.entries, key.key)
+	}
+}
+
+func (l *Lockout) lockoutFor(over int) time.Duration {
+	d := l.cfg.Duration
+	for i := 0; i < over && d < l.cfg.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > l.cfg.MaxDuration {
+		d = l.cfg.MaxDuration
+	}
+	return d
+}
+
+func (l *Lockout) stale(entry *lockoutEntry, now time.Time) bool {
+	return !entry.lockedUntil.After(now) && now.Sub(entry.lastFailure) > l.cfg.Window
+}
+
+func (l *Lockout) sweep(now time.Time) {
+	for key, entry := range l.entries {
+		if l.stale(entry, now) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// PlaybackAudience marks playback tokens, so they can't be used to publish and
+// publisher tokens can't be used to watch
+const PlaybackAudience = "playback"
+
+// PlaybackClaims are what a viewer token allows, they're signed into it by SignPlaybackToken
+type PlaybackClaims struct {
+	ChannelID types.ChannelID `json:"channel_id"`
+	// ExpiresAt is a unix timestamp, zero never expires
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Audience  string `json:"aud"`
+}
+
+// SignPlaybackToken creates a viewer token in the same format as SignToken
+func SignPlaybackToken(secret []byte, claims PlaybackClaims) (string, error) {
+	claims.Audience = PlaybackAudience
+	return signClaims(secret, claims)
+}
+
+// VerifyPlaybackToken checks the viewer token allows watching the channel at now
+func VerifyPlaybackToken(secret []byte, token string, channelID types.ChannelID, now time.Time) error {
+	if token == "" {
+		return Reject(ReasonMissingKey, nil)
+	}
+
+	var claims PlaybackClaims
+	if err := parseClaims(secret, token, &claims); err != nil {
+		return err
+	}
+	if claims.Audience != PlaybackAudience {
+		return Reject(ReasonInvalidKey, errors.New("not a playback token"))
+	}
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return Reject(ReasonExpired, nil)
+	}
+	if claims.ChannelID != channelID {
+		return Reject(ReasonWrongChannel, nil)
+	}
+
+	return nil
+}
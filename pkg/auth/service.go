@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"crypto/subtle"
+)
+
+type ServiceKeyConfig struct{}
+
+// ServiceKey checks the stream key against the one the service has for the channel
+type ServiceKey struct {
+	keys KeySource
+}
+
+func NewServiceKey(keys KeySource) *ServiceKey {
+	return &ServiceKey{keys: keys}
+}
+
+func (a *ServiceKey) Authenticate(req Request) (Grant, error) {
+	if req.Proof == nil && len(req.StreamKey) == 0 {
+		return Grant{}, Reject(ReasonMissingKey, nil)
+	}
+
+	key, err := a.keys.GetHmacKey(req.ChannelID)
+	if err != nil {
+		return Grant{}, Reject(ReasonUnavailable, err)
+	}
+
+	var ok bool
+	if req.Proof != nil {
+		ok = req.Proof(key)
+	} else {
+		ok = subtle.ConstantTimeCompare(req.StreamKey, key) == 1
+	}
+	if !ok {
+		return Grant{}, Reject(ReasonInvalidKey, nil)
+	}
+
+	return Grant{ChannelID: req.ChannelID}, nil
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// Claims are what a token allows, they're signed into it by SignToken
+type Claims struct {
+	ChannelID types.ChannelID `json:"channel_id"`
+	// ExpiresAt is a unix timestamp, zero never expires
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// Inputs the token can publish with, eg: ["rtmp", "whip"], empty allows any
+	Inputs []string `json:"inputs,omitempty"`
+	// MaxBitrate of the stream in bits per second, zero is unlimited
+	MaxBitrate int `json:"max_bitrate,omitempty"`
+	// Audience is empty for publishers, it stops playback tokens from being used to publish
+	Audience string `json:"aud,omitempty"`
+}
+
+type TokenConfig struct {
+	Secret string `fig:"secret" secret:"true"`
+	// Leeway allows for clock skew between whatever signs the tokens and Waveguide
+	Leeway time.Duration `fig:"leeway"`
+}
+
+func (cfg *TokenConfig) Validate() error {
+	if cfg.Secret == "" {
+		return errors.New("secret is required")
+	}
+	return nil
+}
+
+// Token checks stream keys that are tokens made by SignToken, the service isn't asked
+type Token struct {
+	secret []byte
+	leeway time.Duration
+	now    func() time.Time
+}
+
+func NewToken(secret []byte, leeway time.Duration) *Token {
+	return &Token{
+		secret: secret,
+		leeway: leeway,
+		now:    time.Now,
+	}
+}
+
+// SignToken creates a stream key of base64url(claims).base64url(HMAC-SHA256(claims))
+func SignToken(secret []byte, claims Claims) (string, error) {
+	claims.Audience = ""
+	return signClaims(secret, claims)
+}
+
+func signClaims(secret []byte, claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(secret, encoded)), nil
+}
+
+func sign(secret []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+func (a *Token) Authenticate(req Request) (Grant, error) {
+	if req.Proof != nil {
+		return Grant{}, Reject(ReasonUnsupported, errors.New("tokens can't be checked by inputs that never send the key"))
+	}
+	if len(req.StreamKey) == 0 {
+		return Grant{}, Reject(ReasonMissingKey, nil)
+	}
+
+	var claims Claims
+	if err := parseClaims(a.secret, string(req.StreamKey), &claims); err != nil {
+		return Grant{}, err
+	}
+	if claims.Audience != "" {
+		return Grant{}, Reject(ReasonInvalidKey, errors.New("not a publisher token"))
+	}
+
+	if claims.ExpiresAt != 0 && a.now().After(time.Unix(claims.ExpiresAt, 0).Add(a.leeway)) {
+		return Grant{}, Reject(ReasonExpired, nil)
+	}
+	if claims.ChannelID != req.ChannelID {
+		return Grant{}, Reject(ReasonWrongChannel, nil)
+	}
+	if len(claims.Inputs) > 0 && !contains(claims.Inputs, req.InputType) {
+		return Grant{}, Reject(ReasonInputNotAllowed, nil)
+	}
+
+	return Grant{
+		ChannelID:  claims.ChannelID,
+		MaxBitrate: claims.MaxBitrate,
+	}, nil
+}
+
+// parseClaims checks the signature of the token and decodes its claims
+func parseClaims(secret []byte, token string, claims interface{}) error {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Reject(ReasonMalformedKey, errors.New("expected a signed token"))
+	}
+	actual, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return Reject(ReasonMalformedKey, err)
+	}
+	if !hmac.Equal(actual, sign(secret, encoded)) {
+		return Reject(ReasonInvalidKey, nil)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Reject(ReasonMalformedKey, err)
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return Reject(ReasonMalformedKey, err)
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type StreamInfo struct {
+	ChannelID      types.ChannelID `json:"channel_id"`
+	StreamID       types.StreamID  `json:"stream_id"`
+	State          string          `json:"state"`
+	InputType      string          `json:"input_type"`
+	VideoCodec     string          `json:"video_codec"`
+	AudioCodec     string          `json:"audio_codec"`
+	VideoWidth     int             `json:"video_width"`
+	VideoHeight    int             `json:"video_height"`
+	VideoBFrames   bool            `json:"video_bframes"`
+	VideoFramerate float64         `json:"video_framerate,omitempty"`
+	Encoder        string          `json:"encoder,omitempty"`
+	VendorName     string          `json:"vendor_name"`
+	VendorVersion  string          `json:"vendor_version"`
+	UptimeSeconds  int64           `json:"uptime_seconds"`
+	AudioPackets   int             `json:"audio_packets"`
+	VideoPackets   int             `json:"video_packets"`
+	AudioBitrate   int             `json:"audio_bitrate"`
+	VideoBitrate   int             `json:"video_bitrate"`
+	LostPackets    int             `json:"lost_packets"`
+	NackPackets    int             `json:"nack_packets"`
+	SourcePing     *int            `json:"source_ping,omitempty"`
+	Viewers        int             `json:"viewers"`
+
+	// The declared bitrates are what the publisher said it would send
+	DeclaredAudioBitrate int `json:"declared_audio_bitrate,omitempty"`
+	DeclaredVideoBitrate int `json:"declared_video_bitrate,omitempty"`
+
+	Tracks []TrackInfo `json:"tracks,omitempty"`
+}
+
+type TrackInfo struct {
+	Type     string `json:"type"`
+	Codec    string `json:"codec"`
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+	Local    bool   `json:"local,omitempty"`
+}
+
+// Info is a point in time snapshot of the stream for operators
+func (s *Stream) Info() StreamInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info := StreamInfo{
+		ChannelID:      s.ChannelID,
+		StreamID:       s.StreamID,
+		State:          s.state.String(),
+		InputType:      s.inputType,
+		VideoCodec:     s.videoCodec,
+		AudioCodec:     s.audioCodec,
+		VideoWidth:     s.videoWidth,
+		VideoHeight:    s.videoHeight,
+		VideoBFrames:   s.videoBFrames,
+		VideoFramerate: s.videoFramerate,
+		Encoder:        s.encoder,
+		VendorName:     s.clientVendorName,
+		VendorVersion:  s.clientVendorVersion,
+		UptimeSeconds:  time.Now().Unix() - s.startTime,
+		AudioBitrate:   s.audioBps,
+		VideoBitrate:   s.videoBps,
+		NackPackets:    s.totalNackPackets,
+		SourcePing:     s.sourcePing,
+		Viewers:        len(s.viewers),
+		Tracks:         make([]TrackInfo, 0, len(s.tracks)),
+
+		DeclaredAudioBitrate: s.declaredAudioBps,
+		DeclaredVideoBitrate: s.declaredVideoBps,
+	}
+	info.AudioPackets, _ = received(s.tracks, webrtc.RTPCodecTypeAudio)
+	info.VideoPackets, _ = received(s.tracks, webrtc.RTPCodecTypeVideo)
+	for _, track := range s.tracks {
+		info.LostPackets += int(track.stats.Lost())
+		info.Tracks = append(info.Tracks, TrackInfo{
+			Type:     track.Type.String(),
+			Codec:    track.Codec,
+			ID:       track.Track.ID(),
+			StreamID: track.Track.StreamID(),
+			Local:    track.Local,
+		})
+	}
+
+	return info
+}
+
+func (ctrl *Control) registerAdminHandlers() {
+	if ctrl.AdminToken == "" {
+		ctrl.log.Info("admin_token is not set, admin endpoints are disabled")
+		return
+	}
+
+	ctrl.httpMux.Handle("/admin/streams", ctrl.adminAuth(http.HandlerFunc(ctrl.adminListStreams)))
+	ctrl.httpMux.Handle("/admin/streams/", ctrl.adminAuth(http.HandlerFunc(ctrl.adminStream)))
+	ctrl.httpMux.Handle("/admin/drain", ctrl.adminAuth(http.HandlerFunc(ctrl.adminDrain)))
+	ctrl.httpMux.Handle("/admin/reload", ctrl.adminAuth(http.HandlerFunc(ctrl.adminReload)))
+
+	ctrl.httpMux.Handle("/debug/pprof/", ctrl.adminAuth(http.HandlerFunc(pprof.Index)))
+	ctrl.httpMux.Handle("/debug/pprof/cmdline", ctrl.adminAuth(http.HandlerFunc(pprof.Cmdline)))
+	ctrl.httpMux.Handle("/debug/pprof/profile", ctrl.adminAuth(http.HandlerFunc(pprof.Profile)))
+	ctrl.httpMux.Handle("/debug/pprof/symbol", ctrl.adminAuth(http.HandlerFunc(pprof.Symbol)))
+	ctrl.httpMux.Handle("/debug/pprof/trace", ctrl.adminAuth(http.HandlerFunc(pprof.Trace)))
+}
+
+func (ctrl *Control) adminAuth(handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + ctrl.AdminToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// GET /admin/streams
+func (ctrl *Control) adminListStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	streams := ctrl.streams.all()
+	infos := make([]StreamInfo, 0, len(streams))
+	for _, stream := range streams {
+		info := stream.Info()
+		info.Tracks = nil
+		infos = append(infos, info)
+	}
+
+	adminJSON(w, http.StatusOK, infos)
+}
+
+// GET /admin/streams/{channelID}
+// DELETE /admin/streams/{channelID}
+func (ctrl *Control) adminStream(w http.ResponseWriter, r *http.Request) {
+	intChannelID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/streams/"))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid channel id")
+		return
+	}
+	channelID := types.ChannelID(intChannelID)
+
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		adminError(w, http.StatusNotFound, "stream not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		adminJSON(w, http.StatusOK, stream.Info())
+	case http.MethodDelete:
+		if err := ctrl.TerminateStream(channelID, StopReasonAdmin); err != nil {
+			ctrl.log.Error(err)
+			adminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type DrainInfo struct {
+	Draining bool `json:"draining"`
+	Streams  int  `json:"streams"`
+}
+
+// GET /admin/drain
+// POST /admin/drain
+func (ctrl *Control) adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		go ctrl.Drain()
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = http.StatusAccepted
+	}
+	adminJSON(w, status, DrainInfo{
+		Draining: ctrl.Draining() || r.Method == http.MethodPost,
+		Streams:  len(ctrl.streams.all()),
+	})
+}
+
+// POST /admin/reload
+func (ctrl *Control) adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	err := ctrl.Reload()
+	if errors.Is(err, ErrReloadUnsupported) {
+		adminError(w, http.StatusNotImplemented, err.Error())
+		return
+	} else if err != nil {
+		ctrl.log.Errorf("Failed to reload config: %v", err)
+		adminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint errcheck
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	adminJSON(w, status, map[string]string{"error": message})
+}
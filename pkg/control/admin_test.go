@@ -0,0 +1,180 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Glimesh/waveguide/config"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "admin-secret"
+
+func newAdminTestControl(t *testing.T, token string) *Control {
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy"}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+	cfg.Control.AdminToken = token
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	ctrl, err := New(context.Background(), cfg, "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctrl.Shutdown)
+
+	return ctrl
+}
+
+// adminRequest makes a request with the given Authorization header, none when it's empty
+func adminRequest(ctrl *Control, method, target, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	ctrl.httpMux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newAdminTestControl(t, testAdminToken)
+
+	paths := []string{"/admin/streams", "/admin/streams/1", "/admin/drain", "/admin/reload", "/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"}
+	for _, path := range paths {
+		for _, authorization := range []string{"", "Bearer wrong", testAdminToken, "Basic " + testAdminToken, "Bearer " + testAdminToken + "x"} {
+			rec := adminRequest(ctrl, http.MethodGet, path, authorization)
+			assert.Equal(http.StatusUnauthorized, rec.Code, "%s with %q", path, authorization)
+			assert.Equal("Bearer", rec.Header().Get("WWW-Authenticate"), path)
+		}
+
+		rec := adminRequest(ctrl, http.MethodGet, path, "Bearer "+testAdminToken)
+		assert.NotEqual(http.StatusUnauthorized, rec.Code, path)
+	}
+
+	assert.Equal(http.StatusOK, adminRequest(ctrl, http.MethodGet, "/debug/pprof/cmdline", "Bearer "+testAdminToken).Code)
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newAdminTestControl(t, "")
+
+	for _, path := range []string{"/admin/streams", "/admin/streams/1", "/admin/drain", "/admin/reload", "/debug/pprof/", "/debug/pprof/cmdline"} {
+		// An empty token mustn't turn into "Bearer " letting anyone in
+		assert.Equal(http.StatusNotFound, adminRequest(ctrl, http.MethodGet, path, "Bearer ").Code, path)
+		assert.Equal(http.StatusNotFound, adminRequest(ctrl, http.MethodGet, path, "").Code, path)
+	}
+}
+
+func TestAdminStreams(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newAdminTestControl(t, testAdminToken)
+	authorization := "Bearer " + testAdminToken
+
+	_, err := ctrl.StartStream(1)
+	assert.NoError(err)
+	_, err = ctrl.StartStream(2)
+	assert.NoError(err)
+
+	rec := adminRequest(ctrl, http.MethodGet, "/admin/streams", authorization)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+	var infos []StreamInfo
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &infos))
+	if assert.Len(infos, 2) {
+		channels := []int{int(infos[0].ChannelID), int(infos[1].ChannelID)}
+		assert.ElementsMatch([]int{1, 2}, channels)
+		assert.Equal(StreamStateLive.String(), infos[0].State)
+	}
+	assert.NotContains(rec.Body.String(), `"tracks"`, "the list leaves the tracks out")
+
+	rec = adminRequest(ctrl, http.MethodGet, "/admin/streams/1", authorization)
+	assert.Equal(http.StatusOK, rec.Code)
+	var info StreamInfo
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.EqualValues(1, info.ChannelID)
+
+	assert.Equal(http.StatusNotFound, adminRequest(ctrl, http.MethodGet, "/admin/streams/3", authorization).Code)
+	assert.Equal(http.StatusBadRequest, adminRequest(ctrl, http.MethodGet, "/admin/streams/abc", authorization).Code)
+	assert.Equal(http.StatusMethodNotAllowed, adminRequest(ctrl, http.MethodPost, "/admin/streams", authorization).Code)
+	assert.Equal(http.StatusMethodNotAllowed, adminRequest(ctrl, http.MethodPost, "/admin/streams/1", authorization).Code)
+
+	// Deleting stops the stream, after that it's gone
+	assert.Equal(http.StatusNoContent, adminRequest(ctrl, http.MethodDelete, "/admin/streams/1", authorization).Code)
+	assert.Equal(http.StatusNotFound, adminRequest(ctrl, http.MethodGet, "/admin/streams/1", authorization).Code)
+	assert.Equal(http.StatusNotFound, adminRequest(ctrl, http.MethodDelete, "/admin/streams/1", authorization).Code)
+	_, err = ctrl.getStream(1)
+	assert.Error(err)
+	_, err = ctrl.getStream(2)
+	assert.NoError(err, "other streams are left alone")
+}
+
+func TestAdminDrain(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newAdminTestControl(t, testAdminToken)
+	authorization := "Bearer " + testAdminToken
+
+	_, err := ctrl.StartStream(1)
+	assert.NoError(err)
+
+	drainInfo := func(rec *httptest.ResponseRecorder) DrainInfo {
+		var info DrainInfo
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &info))
+		return info
+	}
+
+	rec := adminRequest(ctrl, http.MethodGet, "/admin/drain", authorization)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(DrainInfo{Draining: false, Streams: 1}, drainInfo(rec))
+	assert.False(ctrl.Draining(), "GET doesn't start draining")
+
+	rec = adminRequest(ctrl, http.MethodPost, "/admin/drain", authorization)
+	assert.Equal(http.StatusAccepted, rec.Code)
+	assert.Equal(DrainInfo{Draining: true, Streams: 1}, drainInfo(rec))
+
+	assert.Eventually(ctrl.Draining, time.Second, 10*time.Millisecond)
+	rec = adminRequest(ctrl, http.MethodGet, "/admin/drain", authorization)
+	assert.Equal(DrainInfo{Draining: true, Streams: 1}, drainInfo(rec), "the live stream is left to finish")
+	_, err = ctrl.StartStream(2)
+	assert.ErrorIs(err, ErrDraining)
+
+	assert.Equal(http.StatusMethodNotAllowed, adminRequest(ctrl, http.MethodDelete, "/admin/drain", authorization).Code)
+}
+
+func TestAdminReload(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newAdminTestControl(t, testAdminToken)
+	authorization := "Bearer " + testAdminToken
+
+	assert.Equal(http.StatusNotImplemented, adminRequest(ctrl, http.MethodPost, "/admin/reload", authorization).Code)
+
+	reloads := 0
+	var reloadErr error
+	ctrl.SetReloader(func() error {
+		reloads++
+		return reloadErr
+	})
+
+	assert.Equal(http.StatusMethodNotAllowed, adminRequest(ctrl, http.MethodGet, "/admin/reload", authorization).Code)
+	assert.Equal(0, reloads)
+
+	assert.Equal(http.StatusNoContent, adminRequest(ctrl, http.MethodPost, "/admin/reload", authorization).Code)
+	assert.Equal(1, reloads)
+
+	reloadErr = errors.New("rtmp #0 (:1935): address already in use")
+	rec := adminRequest(ctrl, http.MethodPost, "/admin/reload", authorization)
+	assert.Equal(http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(rec.Body.String(), "address already in use")
+	assert.Equal(2, reloads)
+}
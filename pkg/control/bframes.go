@@ -0,0 +1,102 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/service"
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// BFramePolicy decides what happens to a stream publishing H264 with B-frames,
+// which WebRTC viewers can't decode since the frames arrive out of order
+type BFramePolicy string
+
+const (
+	// BFrameReject stops the stream
+	BFrameReject BFramePolicy = "reject"
+	// BFrameWarn lets the stream go on and asks the service to warn the streamer, it's the default
+	BFrameWarn BFramePolicy = "warn"
+	// BFramePassthrough lets the stream go on quietly for outputs that tolerate
+	// reordering such as HLS and recordings, the video is kept away from WebRTC viewers
+	BFramePassthrough BFramePolicy = "passthrough"
+)
+
+// ErrBFramesRejected is returned to inputs when the stream was stopped for having B-frames
+var ErrBFramesRejected = errors.New("stream has b-frames")
+
+// bframeWarning is what streamers are told when their stream has B-frames
+const bframeWarning = "Your stream has B-frames, which web viewers can't play smoothly. Set B-frames to 0 in your encoder settings."
+
+func parseBFramePolicy(policy string) (BFramePolicy, error) {
+	switch BFramePolicy(policy) {
+	case "", BFrameWarn:
+		return BFrameWarn, nil
+	case BFrameReject, BFramePassthrough:
+		return BFramePolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown b-frame policy %s, expected reject, warn or passthrough", policy)
+}
+
+// parseBFramePolicies reads the node's b-frame policy and its per channel overrides
+func parseBFramePolicies(cfg config.Config) (BFramePolicy, map[types.ChannelID]BFramePolicy, error) {
+	policy, err := parseBFramePolicy(cfg.Control.BFramePolicy)
+	if err != nil {
+		return "", nil, fmt.Errorf("control.bframe_policy: %w", err)
+	}
+
+	channels := make(map[types.ChannelID]BFramePolicy, len(cfg.Control.ChannelBFramePolicies))
+	for channelID, channelPolicy := range cfg.Control.ChannelBFramePolicies {
+		id, err := strconv.ParseUint(channelID, 10, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("control.channel_bframe_policies: %s is not a channel ID", channelID)
+		}
+		if channels[types.ChannelID(id)], err = parseBFramePolicy(channelPolicy); err != nil {
+			return "", nil, fmt.Errorf("control.channel_bframe_policies: %w", err)
+		}
+	}
+
+	return policy, channels, nil
+}
+
+func (ctrl *Control) bframePolicy(channelID types.ChannelID) BFramePolicy {
+	if policy, ok := ctrl.channelBFramePolicies[channelID]; ok {
+		return policy
+	}
+	return ctrl.BFramePolicy
+}
+
+// ReportBFrames is called by inputs the first time they see B-frames from the
+// publisher. It returns ErrBFramesRejected when the channel's policy stopped the
+// stream, the input should drop the publisher.
+func (ctrl *Control) ReportBFrames(stream *Stream) error {
+	stream.ReportMetadata(VideoBFramesMetadata(true))
+
+	policy := ctrl.bframePolicy(stream.ChannelID)
+	bframeStreams.WithLabelValues(string(policy)).Inc()
+
+	switch policy {
+	case BFrameReject:
+		stream.log.Warn("Stopping stream, the publisher is sending b-frames")
+		if err := ctrl.TerminateStream(stream.ChannelID, StopReasonBFrames); err != nil {
+			stream.log.Error(err)
+		}
+		return ErrBFramesRejected
+
+	case BFrameWarn:
+		stream.log.Warn("Publisher is sending b-frames, WebRTC viewers may stutter")
+		if warner, ok := ctrl.service.(service.StreamWarningService); ok {
+			if err := warner.WarnStream(stream.ChannelID, stream.StreamID, bframeWarning); err != nil {
+				stream.log.WithError(err).Warn("Could not warn the streamer about b-frames")
+			}
+		}
+
+	default:
+		stream.log.Info("Publisher is sending b-frames, passing the video through to local consumers only")
+		stream.keepVideoLocal()
+	}
+
+	return nil
+}
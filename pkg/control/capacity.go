@@ -0,0 +1,94 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/orchestrator"
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// ErrAtCapacity is returned to new publishers and viewers once a limit is reached
+var ErrAtCapacity = errors.New("node is at capacity")
+
+// capacityReportInterval is how often the orchestrator is told how busy the node is
+const capacityReportInterval = 15 * time.Second
+
+// atPublisherCapacity is a quick check before authenticating, so a full node
+// doesn't ask the service about publishers it can't take anyway
+func (ctrl *Control) atPublisherCapacity(channelID types.ChannelID) bool {
+	if ctrl.MaxPublishers <= 0 {
+		return false
+	}
+	// A reconnecting publisher takes its old place
+	if _, err := ctrl.getStream(channelID); err == nil {
+		return false
+	}
+	return ctrl.streams.count() >= ctrl.MaxPublishers
+}
+
+// reserveViewer adds the viewer to the stream, unless the stream or node is full
+func (ctrl *Control) reserveViewer(stream *Stream, viewerID string) error {
+	ctrl.viewersMu.Lock()
+	defer ctrl.viewersMu.Unlock()
+
+	if ctrl.MaxViewersPerStream > 0 && stream.Viewers() >= ctrl.MaxViewersPerStream {
+		capacityRejections.WithLabelValues("max_viewers_per_stream").Inc()
+		return fmt.Errorf("%w: max_viewers_per_stream=%d", ErrAtCapacity, ctrl.MaxViewersPerStream)
+	}
+	if ctrl.MaxViewers > 0 && ctrl.viewerCount() >= ctrl.MaxViewers {
+		capacityRejections.WithLabelValues("max_viewers").Inc()
+		return fmt.Errorf("%w: max_viewers=%d", ErrAtCapacity, ctrl.MaxViewers)
+	}
+
+	stream.addViewer(viewerID)
+	return nil
+}
+
+func (ctrl *Control) viewerCount() int {
+	viewers := 0
+	for _, stream := range ctrl.streams.all() {
+		viewers += stream.Viewers()
+	}
+	return viewers
+}
+
+// Capacity returns the node's limits and how much of them is used
+func (ctrl *Control) Capacity() types.NodeCapacity {
+	return types.NodeCapacity{
+		Hostname:            ctrl.Hostname,
+		MaxPublishers:       ctrl.MaxPublishers,
+		MaxViewers:          ctrl.MaxViewers,
+		MaxViewersPerStream: ctrl.MaxViewersPerStream,
+		MaxStreamBitrate:    ctrl.MaxStreamBitrate,
+		Publishers:          ctrl.streams.count(),
+		Viewers:             ctrl.viewerCount(),
+	}
+}
+
+// reportCapacity keeps the orchestrator up to date with the node's capacity
+// until Shutdown, if it wants to know
+func (ctrl *Control) reportCapacity() {
+	reporter, ok := ctrl.orchestrator.(orchestrator.CapacityReporter)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(capacityReportInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := reporter.ReportCapacity(ctrl.Capacity()); err != nil {
+			ctrl.log.Warnf("Failed to report capacity: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctrl.stopReports:
+			return
+		case <-ctrl.ctx.Done():
+			return
+		}
+	}
+}
@@ -1,23 +1,24 @@
 package control
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/auth"
 	"github.com/Glimesh/waveguide/pkg/h264"
-	"github.com/Glimesh/waveguide/pkg/keyframer"
 	"github.com/Glimesh/waveguide/pkg/orchestrator"
 	"github.com/Glimesh/waveguide/pkg/service"
 	"github.com/Glimesh/waveguide/pkg/types"
-	"github.com/pion/rtp"
+	"github.com/Glimesh/waveguide/pkg/webhook"
 
+	"github.com/pion/webrtc/v3"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,15 +29,45 @@ type Pipe struct {
 }
 
 type Control struct {
-	ctx                context.Context
-	service            service.Service
-	orchestrator       orchestrator.Orchestrator
-	streams            map[types.ChannelID]*Stream
-	metadataCollectors map[types.ChannelID]chan bool
+	ctx           context.Context
+	service       service.Service
+	orchestrator  orchestrator.Orchestrator
+	authenticator auth.Authenticator
+	publishACL    *auth.ACL
+	viewACL       *auth.ACL
+	lockout       *auth.Lockout
+	audit         *auth.AuditLog
+	streams       *streamRegistry
+	mediaHandlers []MediaHandler
+	webhooks      *webhook.Dispatcher
+
+	draining  int32
+	drainOnce sync.Once
+	drained   chan struct{}
+
+	// viewersMu makes checking the viewer limits and adding the viewer atomic
+	viewersMu    sync.Mutex
+	stopReports  chan struct{}
+	shutdownOnce sync.Once
 
 	log     logrus.FieldLogger
 	httpMux *http.ServeMux
 
+	// handlers registered by inputs and outputs, a nil handler has been
+	// unregistered but its pattern stays on httpMux as it can't be removed
+	handlersMu sync.RWMutex
+	handlers   map[string]http.HandlerFunc
+
+	reloadMu sync.Mutex
+	reloader func() error
+
+	viewerAuthMu     sync.RWMutex
+	viewerAuthorizer ViewerAuthorizer
+
+	httpServerMu     sync.Mutex
+	httpServer       *http.Server
+	httpServerClosed bool
+
 	Hostname       string
 	HTTPServerType string `mapstructure:"http_server_type"`
 	HTTPAddress    string `mapstructure:"http_address"`
@@ -45,6 +76,39 @@ type Control struct {
 	HTTPSCert      string `mapstructure:"https_cert"`
 	HTTPSKey       string `mapstructure:"https_key"`
 
+	// Bearer token for the admin endpoints, they're disabled when empty
+	AdminToken string `mapstructure:"admin_token"`
+
+	// How often a keyframe is decoded into the stream thumbnail
+	ThumbnailInterval time.Duration `mapstructure:"thumbnail_interval"`
+
+	// How long a stream waits for a dropped publisher to reconnect, streams stop straight away when zero
+	ReconnectGrace time.Duration `mapstructure:"reconnect_grace"`
+
+	// How many packets of the latest GOP are kept per video track, so new viewers
+	// start on a keyframe. The cache is disabled when negative.
+	GOPCacheSize int `mapstructure:"gop_cache_size"`
+
+	// TakeoverPolicy is what happens when a channel that's already live is started again
+	TakeoverPolicy          TakeoverPolicy
+	channelTakeoverPolicies map[types.ChannelID]TakeoverPolicy
+	// BFramePolicy is what happens when a publisher sends B-frames
+	BFramePolicy          BFramePolicy
+	channelBFramePolicies map[types.ChannelID]BFramePolicy
+
+	// Limits of the node, zero is unlimited. MaxStreamBitrate is in bits per second.
+	MaxPublishers       int `mapstructure:"max_publishers"`
+	MaxViewers          int `mapstructure:"max_viewers"`
+	MaxViewersPerStream int `mapstructure:"max_viewers_per_stream"`
+	MaxStreamBitrate    int `mapstructure:"max_stream_bitrate"`
+	// RetryAfter is how long rejected publishers and viewers are told to wait
+	RetryAfter time.Duration `mapstructure:"retry_after"`
+
+	// How long Drain waits for publishers to finish before stopping their streams
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// How long Shutdown waits for the streams to stop and the HTTP server to close
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
 	// Flag to enable saving video stream to file
 	// Currently it's global flag toggled from the config file
 	SaveVideo bool `mapstructure:"save_video"`
@@ -56,26 +120,90 @@ func New(
 	hostname string,
 	logger *logrus.Logger,
 ) (*Control, error) {
-	svc := service.New(cfg, logger)
+	svc, err := service.New(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
 	if err := svc.Connect(); err != nil {
 		return nil, fmt.Errorf("service: %w", err)
 	}
 
-	or := orchestrator.New(cfg, hostname, logger)
+	or, err := orchestrator.New(cfg, hostname, logger)
+	if err != nil {
+		return nil, err
+	}
 	if err := or.Connect(); err != nil {
 		return nil, fmt.Errorf("orchestrator: %w", err)
 	}
 
+	authenticator, err := auth.New(cfg.Auth, instrumentedService{svc})
+	if err != nil {
+		return nil, err
+	}
+
+	publishACL, err := auth.ParseACL(cfg.Access.PublishAllow, cfg.Access.PublishDeny)
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	viewACL, err := auth.ParseACL(cfg.Access.ViewAllow, cfg.Access.ViewDeny)
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	var audit *auth.AuditLog
+	if cfg.Access.AuditLog != "" {
+		if audit, err = auth.OpenAuditLog(cfg.Access.AuditLog); err != nil {
+			return nil, fmt.Errorf("access: %w", err)
+		}
+	}
+
 	httpCfg := cfg.Control
+	if httpCfg.ThumbnailInterval <= 0 {
+		httpCfg.ThumbnailInterval = 15 * time.Second
+	}
+	if httpCfg.GOPCacheSize == 0 {
+		httpCfg.GOPCacheSize = 1500
+	}
+	if httpCfg.DrainTimeout <= 0 {
+		httpCfg.DrainTimeout = 30 * time.Second
+	}
+	if httpCfg.ShutdownTimeout <= 0 {
+		httpCfg.ShutdownTimeout = 10 * time.Second
+	}
+	takeoverPolicy, channelTakeoverPolicies, err := parseTakeoverPolicies(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bframePolicy, channelBFramePolicies, err := parseBFramePolicies(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	return &Control{
-		ctx:          ctx,
-		service:      svc,
-		orchestrator: or,
+	limits := cfg.Limits
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = 30 * time.Second
+	}
+
+	ctrl := &Control{
+		ctx:           ctx,
+		service:       instrumentedService{svc},
+		orchestrator:  instrumentedOrchestrator{or},
+		authenticator: authenticator,
+		publishACL:    publishACL,
+		viewACL:       viewACL,
+		lockout: auth.NewLockout(auth.LockoutConfig{
+			MaxFailures:        cfg.Access.MaxFailures,
+			ChannelMaxFailures: cfg.Access.ChannelMaxFailures,
+			Duration:           cfg.Access.Lockout,
+			MaxDuration:        cfg.Access.MaxLockout,
+			Window:             cfg.Access.FailureWindow,
+		}),
+		audit: audit,
 
-		streams:            make(map[types.ChannelID]*Stream),
-		metadataCollectors: make(map[types.ChannelID]chan bool),
-		httpMux:            http.NewServeMux(),
+		streams:     newStreamRegistry(),
+		drained:     make(chan struct{}),
+		stopReports: make(chan struct{}),
+		httpMux:     http.NewServeMux(),
+		handlers:    make(map[string]http.HandlerFunc),
 		log: logger.WithFields(logrus.Fields{
 			"control": "waveguide",
 		}),
@@ -86,10 +214,57 @@ func New(
 		HTTPSHostname:  httpCfg.HTTPSHostname,
 		HTTPSCert:      httpCfg.HTTPSCert,
 		HTTPSKey:       httpCfg.HTTPSKey,
+		AdminToken:     httpCfg.AdminToken,
+		ReconnectGrace: httpCfg.ReconnectGrace,
+
+		TakeoverPolicy:          takeoverPolicy,
+		channelTakeoverPolicies: channelTakeoverPolicies,
+		BFramePolicy:            bframePolicy,
+		channelBFramePolicies:   channelBFramePolicies,
+
+		ThumbnailInterval:   httpCfg.ThumbnailInterval,
+		GOPCacheSize:        httpCfg.GOPCacheSize,
+		MaxPublishers:       limits.MaxPublishers,
+		MaxViewers:          limits.MaxViewers,
+		MaxViewersPerStream: limits.MaxViewersPerStream,
+		MaxStreamBitrate:    limits.MaxStreamBitrate,
+		RetryAfter:          limits.RetryAfter,
+
+		DrainTimeout:    httpCfg.DrainTimeout,
+		ShutdownTimeout: httpCfg.ShutdownTimeout,
 
 		// this should be controlled at a stream level
 		SaveVideo: cfg.Control.SaveVideo,
-	}, nil
+	}
+
+	if cfg.Webhook.URL != "" {
+		ctrl.webhooks = webhook.New(webhook.Config{
+			URL:        cfg.Webhook.URL,
+			Secret:     cfg.Webhook.Secret,
+			QueueSize:  cfg.Webhook.QueueSize,
+			MaxRetries: cfg.Webhook.MaxRetries,
+			Backoff:    cfg.Webhook.Backoff,
+			Timeout:    cfg.Webhook.Timeout,
+		}, logger.WithField("webhook", cfg.Webhook.URL))
+		ctrl.webhooks.Start(ctx)
+	}
+
+	// The stream gauges belong to this control, the rest are process wide
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(streamCollector{ctrl})
+	ctrl.httpMux.Handle("/metrics", promhttp.HandlerFor(
+		prometheus.Gatherers{prometheus.DefaultGatherer, registry},
+		promhttp.HandlerOpts{},
+	))
+	ctrl.httpMux.HandleFunc("/thumbnail/", ctrl.thumbnailHandler)
+	ctrl.registerAdminHandlers()
+
+	go ctrl.reportCapacity()
+	if notifier, ok := svc.(service.TerminationNotifier); ok {
+		go ctrl.watchTerminations(notifier.Terminations())
+	}
+
+	return ctrl, nil
 }
 
 func (ctrl *Control) Context() context.Context {
@@ -100,10 +275,18 @@ func (ctrl *Control) ContextErr() error {
 	return ctrl.Context().Err()
 }
 
+// Shutdown stops every stream in parallel and closes the HTTP server, call Drain
+// first to give publishers a chance to finish. Webhooks still queued are delivered
+// in whatever is left of ShutdownTimeout
 func (ctrl *Control) Shutdown() {
-	for c := range ctrl.streams {
-		ctrl.StopStream(c)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctrl.ShutdownTimeout)
+	defer cancel()
+
+	ctrl.shutdownOnce.Do(func() { close(ctrl.stopReports) })
+	ctrl.stopAll(StopReasonShutdown)
+	ctrl.shutdownHTTPServer()
+	ctrl.webhooks.Close(ctx)
+	ctrl.audit.Close()
 }
 
 func (ctrl *Control) GetTracks(channelID types.ChannelID) ([]StreamTrack, error) {
@@ -112,35 +295,192 @@ func (ctrl *Control) GetTracks(channelID types.ChannelID) ([]StreamTrack, error)
 		return nil, err
 	}
 
-	return stream.tracks, nil
+	return stream.Tracks(), nil
 }
 
-func (ctrl *Control) GetHmacKey(channelID types.ChannelID) (string, error) {
-	actualKey, err := ctrl.service.GetHmacKey(channelID)
+// PlaybackPolicy asks the service who can watch the channel, the policy is empty
+// when the service doesn't decide it and the output's config should be used instead
+func (ctrl *Control) PlaybackPolicy(channelID types.ChannelID) (types.PlaybackPolicy, error) {
+	provider, ok := ctrl.service.(service.PlaybackPolicyService)
+	if !ok {
+		return "", nil
+	}
+	return provider.GetPlaybackPolicy(channelID)
+}
+
+// ViewerAuthorizer checks a viewer's request for the channel, returning the HTTP
+// status to reject the viewer with
+type ViewerAuthorizer func(r *http.Request, channelID types.ChannelID) (int, error)
+
+// SetViewerAuthorizer sets how viewers are checked by the endpoints Control serves
+// itself, eg: thumbnails. The WHEP output sets its playback policy and token check
+func (ctrl *Control) SetViewerAuthorizer(authorize ViewerAuthorizer) {
+	ctrl.viewerAuthMu.Lock()
+	defer ctrl.viewerAuthMu.Unlock()
+
+	ctrl.viewerAuthorizer = authorize
+}
+
+// authorizeViewer runs the viewer authorizer, without one only channels the service
+// doesn't put behind a token can be viewed since there's nothing to check the token with
+func (ctrl *Control) authorizeViewer(r *http.Request, channelID types.ChannelID) (int, error) {
+	ctrl.viewerAuthMu.RLock()
+	authorize := ctrl.viewerAuthorizer
+	ctrl.viewerAuthMu.RUnlock()
+
+	if authorize != nil {
+		return authorize(r, channelID)
+	}
+
+	policy, err := ctrl.PlaybackPolicy(channelID)
 	if err != nil {
-		return "", err
+		return http.StatusServiceUnavailable, auth.Reject(auth.ReasonUnavailable, err)
+	}
+	if policy == types.PlaybackToken {
+		return http.StatusForbidden, auth.Reject(auth.ReasonUnsupported, errors.New("no output checks playback tokens"))
 	}
+	return 0, nil
+}
+
+// SubscribeViewer returns the media for a new viewer, it starts with the cached GOP of
+// the video tracks so the viewer can decode straight away, followed by the live packets.
+// Local tracks are left out
+func (ctrl *Control) SubscribeViewer(channelID types.ChannelID, viewerID string) (*Subscription, error) {
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.Subscribe(viewerID, WithGOP(), WithDropPolicy(DropOldest), WithoutLocalTracks()), nil
+}
 
-	return string(actualKey), nil
+// AddMediaHandler registers a local consumer that is handed every stream started on this node
+func (ctrl *Control) AddMediaHandler(handler MediaHandler) {
+	ctrl.mediaHandlers = append(ctrl.mediaHandlers, handler)
 }
 
-func (ctrl *Control) Authenticate(channelID types.ChannelID, streamKey types.StreamKey) error {
-	actualKey, err := ctrl.service.GetHmacKey(channelID)
+// Authenticate checks a publisher with the configured authenticator, every input
+// goes through here. Rejections are an *auth.Error with the reason.
+func (ctrl *Control) Authenticate(req auth.Request) (auth.Grant, error) {
+	if ctrl.Draining() {
+		return auth.Grant{}, auth.Reject(auth.ReasonDraining, ErrDraining)
+	}
+
+	if ctrl.atPublisherCapacity(req.ChannelID) {
+		capacityRejections.WithLabelValues("max_publishers").Inc()
+		err := auth.Reject(auth.ReasonAtCapacity, fmt.Errorf("%w: max_publishers=%d", ErrAtCapacity, ctrl.MaxPublishers))
+		ctrl.rejectPublisher(req, err)
+		return auth.Grant{}, err
+	}
+
+	// Locked out attempts never reach the authenticator, so they cost the service nothing
+	if remaining := ctrl.lockout.Check(req.RemoteAddr, req.ChannelID); remaining > 0 {
+		err := auth.Reject(auth.ReasonLockedOut, fmt.Errorf("retry in %s", remaining.Round(time.Second)))
+		ctrl.rejectPublisher(req, err)
+		return auth.Grant{}, err
+	}
+
+	grant, err := ctrl.authenticator.Authenticate(req)
 	if err != nil {
-		return err
+		reason := auth.ReasonOf(err)
+		var authErr *auth.Error
+		if !errors.As(err, &authErr) {
+			err = auth.Reject(reason, err)
+		}
+		// Our own failures aren't the publisher's fault
+		if !reason.Retryable() {
+			ctrl.lockout.Failure(req.RemoteAddr, req.ChannelID)
+		}
+		ctrl.rejectPublisher(req, err)
+		return auth.Grant{}, err
 	}
-	if string(streamKey) != string(actualKey) {
-		return errors.New("incorrect stream key")
+	if grant.ChannelID == 0 {
+		grant.ChannelID = req.ChannelID
 	}
 
-	return nil
+	ctrl.lockout.Success(req.RemoteAddr, req.ChannelID)
+	ctrl.recordAudit(auth.AuditEvent{
+		Action:     auth.AuditAccepted,
+		Role:       "publish",
+		Type:       req.InputType,
+		ChannelID:  req.ChannelID,
+		RemoteAddr: req.RemoteAddr,
+	})
+
+	ctrl.webhooks.Send(webhook.EventStreamAuthenticated, req.ChannelID, 0, nil)
+
+	return grant, nil
+}
+
+func (ctrl *Control) rejectPublisher(req auth.Request, err error) {
+	reason := auth.ReasonOf(err)
+	authRejections.WithLabelValues(req.InputType, string(reason)).Inc()
+	ctrl.log.Warnf("Rejected publisher channel=%s input=%s addr=%s: %v", req.ChannelID, req.InputType, req.RemoteAddr, err)
+	ctrl.recordAudit(auth.AuditEvent{
+		Action:     auth.AuditRejected,
+		Role:       "publish",
+		Type:       req.InputType,
+		ChannelID:  req.ChannelID,
+		RemoteAddr: req.RemoteAddr,
+		Reason:     reason,
+	})
+}
+
+// AllowPublisher checks the address against the publish ACL, inputs call it as
+// soon as they accept a connection
+func (ctrl *Control) AllowPublisher(inputType, remoteAddr string) bool {
+	return ctrl.allowAddress(ctrl.publishACL, "publish", inputType, remoteAddr)
+}
+
+// AllowViewer checks the address against the view ACL, outputs call it before
+// setting anything up for the viewer
+func (ctrl *Control) AllowViewer(outputType, remoteAddr string) bool {
+	return ctrl.allowAddress(ctrl.viewACL, "view", outputType, remoteAddr)
+}
+
+func (ctrl *Control) allowAddress(acl *auth.ACL, role, listenerType, remoteAddr string) bool {
+	if acl.Allowed(remoteAddr) {
+		return true
+	}
+
+	accessDenials.WithLabelValues(role, listenerType).Inc()
+	ctrl.log.Debugf("Denied %s connection type=%s addr=%s", role, listenerType, remoteAddr)
+	ctrl.recordAudit(auth.AuditEvent{
+		Action:     auth.AuditDenied,
+		Role:       role,
+		Type:       listenerType,
+		RemoteAddr: remoteAddr,
+		Reason:     auth.ReasonAddressDenied,
+	})
+	return false
+}
+
+func (ctrl *Control) recordAudit(event auth.AuditEvent) {
+	if err := ctrl.audit.Record(event); err != nil {
+		ctrl.log.Errorf("Failed to write audit log: %v", err)
+	}
 }
 
 func (ctrl *Control) StartStream(channelID types.ChannelID) (*Stream, error) {
+	if stream, err := ctrl.getStream(channelID); err == nil {
+		if stream.resume() {
+			stream.log.Info("Publisher reconnected, resuming stream")
+			return stream, nil
+		}
+		if ctrl.takeOver(stream) {
+			return stream, nil
+		}
+	}
+
+	if ctrl.Draining() {
+		return nil, ErrDraining
+	}
+
 	ctx, cancel := context.WithCancel(ctrl.Context())
 
 	stream, err := ctrl.newStream(channelID, cancel)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
@@ -148,31 +488,54 @@ func (ctrl *Control) StartStream(channelID types.ChannelID) (*Stream, error) {
 
 	streamID, err := ctrl.service.StartStream(channelID)
 	if err != nil {
-		ctrl.removeStream(channelID)
+		stream.Stop()
+		ctrl.removeStream(stream)
+		stream.setState(StreamStateStopped)
 		return nil, err
 	}
-	stream.StreamID = streamID
+	stream.setStreamID(streamID)
+
+	if _, ok := stream.transition(StreamStateLive, StreamStateAuthenticating); !ok {
+		// StopStream was called while we were waiting on the service, it's up to us to finish the cleanup
+		if err := ctrl.service.EndStream(streamID); err != nil {
+			stream.log.Error(err)
+		}
+		ctrl.removeStream(stream)
+		stream.setState(StreamStateStopped)
+		return nil, ErrStreamStopped
+	}
 
 	err = ctrl.orchestrator.StartStream(stream.ChannelID, stream.StreamID)
 	if err != nil {
-		ctrl.StopStream(channelID)
+		ctrl.stopChannel(channelID, StopReasonError)
 		return nil, err
 	}
 
-	go ctrl.setupHeartbeat(channelID)
+	ctrl.webhooks.Send(webhook.EventStreamStarted, stream.ChannelID, stream.StreamID, nil)
+
+	for _, handler := range ctrl.mediaHandlers {
+		handler(stream)
+	}
+
+	go ctrl.setupHeartbeat(stream)
+	go ctrl.setupThumbnailer(stream)
 
 	go func() {
 		if err := stream.Ingest(ctx); err != nil { //nolint not shadowed
 			stream.log.Error(err)
-			ctrl.StopStream(channelID)
+			ctrl.stopChannel(channelID, StopReasonError)
 		}
 	}()
 
 	return stream, err
 }
 
+// StopStream ends the stream everywhere, it's safe to call multiple times and from multiple goroutines
 func (ctrl *Control) StopStream(channelID types.ChannelID) error {
-	// StopStream is called
+	return ctrl.stopChannel(channelID, StopReasonPublisher)
+}
+
+func (ctrl *Control) stopChannel(channelID types.ChannelID, reason StopReason) error {
 	ctrl.log.Debug("Stop Stream")
 	stream, err := ctrl.getStream(channelID)
 	if err != nil {
@@ -182,16 +545,33 @@ func (ctrl *Control) StopStream(channelID types.ChannelID) error {
 		return err
 	}
 
-	if !stream.Stopped() {
-		stream.Stop()
+	return ctrl.stopStream(stream, reason, StreamStateAuthenticating, StreamStateLive, StreamStateReconnecting)
+}
+
+// stopStream only stops the stream if it's in one of the given states
+func (ctrl *Control) stopStream(stream *Stream, reason StopReason, from ...StreamState) error {
+	previous, ok := stream.transition(StreamStateStopping, from...)
+	if !ok {
+		// Someone else is already stopping this stream
+		return nil
+	}
+
+	stream.Stop()
+
+	if previous == StreamStateAuthenticating {
+		// StartStream is still waiting on the service and will finish the cleanup
+		return nil
 	}
-	ctrl.metadataCollectors[channelID] <- true
-	ctrl.log.Debug("sent metadata collector signal")
 
 	// Make sure we send stop commands to everyone, and don't return until they've all been sent
 	serviceErr := ctrl.service.EndStream(stream.StreamID)
 	orchestratorErr := ctrl.orchestrator.StopStream(stream.ChannelID, stream.StreamID)
-	controlErr := ctrl.removeStream(channelID)
+	controlErr := ctrl.removeStream(stream)
+	stream.setState(StreamStateStopped)
+
+	ctrl.webhooks.Send(webhook.EventStreamStopped, stream.ChannelID, stream.StreamID, map[string]interface{}{
+		"reason": reason,
+	})
 
 	if serviceErr != nil {
 		stream.log.Error(serviceErr)
@@ -209,20 +589,106 @@ func (ctrl *Control) StopStream(channelID types.ChannelID) error {
 	return nil
 }
 
+// StreamDisconnected is called by inputs when the publisher drops without ending the stream,
+// the stream is kept for ReconnectGrace so the publisher can resume it with StartStream
+func (ctrl *Control) StreamDisconnected(channelID types.ChannelID) error {
+	if ctrl.ReconnectGrace <= 0 {
+		return ctrl.StopStream(channelID)
+	}
+
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		if errors.Is(err, errStreamRemoved) {
+			return nil
+		}
+		return err
+	}
+
+	detached := stream.detachPublisher(ctrl.ReconnectGrace, func() {
+		stream.log.Infof("Stopping stream reason=%s", StopReasonReconnectTimeout)
+		if err := ctrl.stopStream(stream, StopReasonReconnectTimeout, StreamStateReconnecting); err != nil {
+			stream.log.Error(err)
+		}
+	})
+	if !detached {
+		if stream.State() == StreamStateReconnecting {
+			// Inputs can report the same disconnect more than once
+			return nil
+		}
+		// Never went live or is already stopping, there's nothing to resume
+		return ctrl.StopStream(channelID)
+	}
+
+	stream.log.Infof("Publisher disconnected, waiting %s for it to reconnect", ctrl.ReconnectGrace)
+
+	return nil
+}
+
+// TerminateStream ends the stream and tells the input to disconnect the publisher
+func (ctrl *Control) TerminateStream(channelID types.ChannelID, reason StopReason) error {
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		return err
+	}
+
+	stream.log.Infof("Terminating stream reason=%s", reason)
+
+	// Stop first so the input closing the connection doesn't race us to StopStream
+	err = ctrl.stopChannel(channelID, reason)
+
+	stream.mu.RLock()
+	disconnect := stream.disconnect
+	stream.mu.RUnlock()
+	if disconnect != nil {
+		disconnect(reason)
+	}
+
+	return err
+}
+
+// AddViewer is called by outputs before they set anything up for a new peer, it
+// returns ErrAtCapacity when the stream or node has all the viewers it can take
+func (ctrl *Control) AddViewer(channelID types.ChannelID, viewerID string) error {
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		return err
+	}
+
+	if err := ctrl.reserveViewer(stream, viewerID); err != nil {
+		return err
+	}
+	ctrl.webhooks.Send(webhook.EventViewerJoined, channelID, stream.StreamID, map[string]interface{}{
+		"viewer_id": viewerID,
+	})
+
+	return nil
+}
+
+// RemoveViewer is called by outputs when a peer goes away, it's safe to call more than once per peer
+func (ctrl *Control) RemoveViewer(channelID types.ChannelID, viewerID string) {
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		return
+	}
+
+	if stream.removeViewer(viewerID) {
+		ctrl.webhooks.Send(webhook.EventViewerLeft, channelID, stream.StreamID, map[string]interface{}{
+			"viewer_id": viewerID,
+		})
+	}
+}
+
 var (
 	ErrHeartbeatThumbnail             = errors.New("error sending thumbnail")
 	ErrHeartbeatSendMetadata          = errors.New("error sending metadata")
 	ErrHeartbeatOrchestratorHeartbeat = errors.New("error sending orchestrator heartbeat")
+	ErrHeartbeatCheckStream           = errors.New("error checking stream with service")
 )
 
-func (ctrl *Control) setupHeartbeat(channelID types.ChannelID) {
+func (ctrl *Control) setupHeartbeat(stream *Stream) {
 	ticker := time.NewTicker(15 * time.Second)
 	tickFailed := 0
-
-	stream, err := ctrl.getStream(channelID)
-	if err != nil {
-		return
-	}
+	channelID := stream.ChannelID
 
 	for {
 		select {
@@ -234,21 +700,37 @@ func (ctrl *Control) setupHeartbeat(channelID types.ChannelID) {
 			err = ctrl.sendThumbnail(channelID)
 			if err != nil {
 				stream.log.Error(errors.Wrap(err, ErrHeartbeatThumbnail.Error()))
+				heartbeatFailures.WithLabelValues("thumbnail").Inc()
+				ctrl.heartbeatFailed(stream, "thumbnail", err)
 				hasErrors = true
 			}
 
 			err = ctrl.sendMetadata(channelID)
 			if err != nil {
 				stream.log.Error(errors.Wrap(err, ErrHeartbeatSendMetadata.Error()))
+				heartbeatFailures.WithLabelValues("metadata").Inc()
+				ctrl.heartbeatFailed(stream, "metadata", err)
 				hasErrors = true
 			}
 
 			err = ctrl.orchestrator.Heartbeat(channelID)
 			if err != nil {
 				stream.log.Error(errors.Wrap(err, ErrHeartbeatOrchestratorHeartbeat.Error()))
+				heartbeatFailures.WithLabelValues("orchestrator").Inc()
+				ctrl.heartbeatFailed(stream, "orchestrator", err)
 				hasErrors = true
 			}
 
+			if revoked, err := ctrl.checkStream(stream); err != nil {
+				stream.log.Error(errors.Wrap(err, ErrHeartbeatCheckStream.Error()))
+				heartbeatFailures.WithLabelValues("check_stream").Inc()
+				ctrl.heartbeatFailed(stream, "check_stream", err)
+				hasErrors = true
+			} else if revoked {
+				ticker.Stop()
+				return
+			}
+
 			if hasErrors {
 				tickFailed++
 			} else if tickFailed > 0 {
@@ -258,158 +740,154 @@ func (ctrl *Control) setupHeartbeat(channelID types.ChannelID) {
 			// Look for 3 consecutive failures
 			if tickFailed >= 5 {
 				stream.log.Warn("Stopping stream due to excessive heartbeat errors")
-				stream.Stop()
 				ticker.Stop()
+				ctrl.stopChannel(channelID, StopReasonHeartbeat)
+				return
+			}
+
+			if bitrate, max := stream.exceedsMaxBitrate(); max > 0 {
+				stream.log.Warnf("Stopping stream, bitrate=%d is over the max_bitrate=%d it was granted", bitrate, max)
+				ticker.Stop()
+				ctrl.TerminateStream(channelID, StopReasonBitrate)
 				return
 			}
 
-		case <-ctrl.metadataCollectors[channelID]:
+		case <-stream.stopHeartbeat:
 			ticker.Stop()
 			return
 		}
 	}
 }
 
+func (ctrl *Control) heartbeatFailed(stream *Stream, failure string, err error) {
+	ctrl.webhooks.Send(webhook.EventHeartbeatFailed, stream.ChannelID, stream.StreamID, map[string]interface{}{
+		"type":  failure,
+		"error": err.Error(),
+	})
+}
+
 func (ctrl *Control) sendMetadata(channelID types.ChannelID) error {
 	stream, err := ctrl.getStream(channelID)
 	if err != nil {
 		return err
 	}
 
-	stream.lastTime = time.Now().Unix()
+	lostPackets := stream.lostPackets()
 
-	return ctrl.service.UpdateStreamMetadata(stream.StreamID, types.StreamMetadata{
+	stream.mu.Lock()
+	now := time.Now().Unix()
+	since := stream.lastTime
+	if since == 0 {
+		since = stream.startTime
+	}
+	audioPackets, audioBytes := received(stream.tracks, webrtc.RTPCodecTypeAudio)
+	videoPackets, videoBytes := received(stream.tracks, webrtc.RTPCodecTypeVideo)
+	if elapsed := int(now - since); elapsed > 0 {
+		stream.audioBps = (audioBytes - stream.lastAudioBytes) * 8 / elapsed
+		stream.videoBps = (videoBytes - stream.lastVideoBytes) * 8 / elapsed
+	}
+	stream.lastTime = now
+	stream.lastAudioBytes = audioBytes
+	stream.lastVideoBytes = videoBytes
+	metadata := types.StreamMetadata{
 		AudioCodec:        stream.audioCodec,
 		IngestServer:      ctrl.Hostname,
-		IngestViewers:     0,
-		LostPackets:       0, // Don't exist
-		NackPackets:       0, // Don't exist
-		RecvPackets:       stream.totalAudioPackets + stream.totalVideoPackets,
-		SourceBitrate:     0, // Likely just need to calculate the bytes between two 5s snapshots?
-		SourcePing:        0, // Not accessible unless we ping them manually
+		IngestViewers:     len(stream.viewers),
+		LostPackets:       lostPackets,
+		NackPackets:       stream.totalNackPackets,
+		RecvPackets:       audioPackets + videoPackets,
+		SourceBitrate:     stream.audioBps + stream.videoBps,
+		SourcePing:        stream.sourcePing,
 		StreamTimeSeconds: int(stream.lastTime - stream.startTime),
 		VendorName:        stream.clientVendorName,
 		VendorVersion:     stream.clientVendorVersion,
 		VideoCodec:        stream.videoCodec,
 		VideoHeight:       stream.videoHeight,
 		VideoWidth:        stream.videoWidth,
-	})
+		VideoBFrames:      stream.videoBFrames,
+
+		VideoFramerate:       stream.videoFramerate,
+		DeclaredVideoBitrate: stream.declaredVideoBps,
+		DeclaredAudioBitrate: stream.declaredAudioBps,
+		Encoder:              stream.encoder,
+	}
+	stream.mu.Unlock()
+
+	return ctrl.service.UpdateStreamMetadata(stream.StreamID, metadata)
 }
 
+// sendThumbnail uploads the latest thumbnail to the service, if it hasn't been already
 func (ctrl *Control) sendThumbnail(channelID types.ChannelID) (err error) {
 	stream, err := ctrl.getStream(channelID)
 	if err != nil {
 		return err
 	}
 
-	// signal the stream thumnailer to get me some thumbnails
-	select {
-	case stream.requestThumbnail <- struct{}{}:
-	default:
+	if !stream.thumbnails.markUploaded() {
+		return nil
+	}
+
+	data, _, err := stream.thumbnails.encode("jpg", 0)
+	if err != nil {
+		return err
 	}
 
-	ctrl.log.Debug("thumbnail requested")
+	return ctrl.service.SendJpegPreviewImage(stream.StreamID, data)
+}
+
+// setupThumbnailer asks the stream for a keyframe every ThumbnailInterval, and
+// decodes every keyframe it hands back into the stream thumbnail cache
+func (ctrl *Control) setupThumbnailer(stream *Stream) {
+	ticker := time.NewTicker(ctrl.ThumbnailInterval)
+	defer ticker.Stop()
 
-	var data []byte
-	// Since stream.lastThumbnail is a buffered chan, let's read all values to get the newest
-	for len(stream.lastThumbnail) > 0 {
-		data = <-stream.lastThumbnail
+	for {
+		select {
+		case <-ticker.C:
+			stream.RequestThumbnail()
+		case data := <-stream.lastThumbnail:
+			if err := ctrl.decodeThumbnail(stream, data); err != nil {
+				stream.log.Error(errors.Wrap(err, "error decoding thumbnail"))
+			}
+		case <-stream.stopHeartbeat:
+			return
+		}
 	}
+}
 
+func (ctrl *Control) decodeThumbnail(stream *Stream, data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
 
-	var img image.Image
 	h264dec, err := h264.NewH264Decoder()
 	if err != nil {
 		return err
 	}
 	defer h264dec.Close()
-	img, err = h264dec.Decode(data)
+	decodeStart := time.Now()
+	img, err := h264dec.Decode(data)
+	thumbnailDecodeSeconds.Observe(time.Since(decodeStart).Seconds())
 	if err != nil {
 		return err
 	}
 	if img == nil {
-		ctrl.log.WithField("channel_id", channelID).Debug("img is nil")
+		stream.log.Debug("img is nil")
 		return nil
 	}
 
-	buff := new(bytes.Buffer)
-	err = jpeg.Encode(buff, img, &jpeg.Options{
-		Quality: 75,
+	stream.thumbnails.set(img)
+	stream.log.Debug("Got screenshot!")
+	ctrl.webhooks.Send(webhook.EventThumbnailGenerated, stream.ChannelID, stream.StreamID, map[string]interface{}{
+		"width":  img.Bounds().Dx(),
+		"height": img.Bounds().Dy(),
 	})
-	if err != nil {
-		return err
-	}
-
-	err = ctrl.service.SendJpegPreviewImage(stream.StreamID, buff.Bytes())
-	if err != nil {
-		return err
-	}
-
-	ctrl.log.WithField("channel_id", channelID).Debug("Got screenshot!")
 
 	// Also update our metadata
-	stream.videoWidth = img.Bounds().Dx()
-	stream.videoHeight = img.Bounds().Dy()
-
-	return nil
-}
-
-func (ctrl *Control) newStream(channelID types.ChannelID, cancelFunc context.CancelFunc) (*Stream, error) {
-	stream := &Stream{ //nolint exhaustive struct
-		ChannelID: channelID,
-
-		log:           ctrl.log.WithField("channel_id", channelID),
-		whepURI:       ctrl.HTTPServerURL() + "/whep/endpoint/" + channelID.String(),
-		authenticated: true,
-
-		cancelFunc:        cancelFunc,
-		kf:                keyframer.New(),
-		rtpIngest:         make(chan *rtp.Packet),
-		stopHeartbeat:     make(chan struct{}, 1),
-		stopThumbnailer:   make(chan struct{}, 1),
-		thumbnailReceiver: make(chan *rtp.Packet, 50),
-		requestThumbnail:  make(chan struct{}, 1),
-
-		lastThumbnail: make(chan []byte, 1),
-
-		startTime: time.Now().Unix(),
-	}
-
-	// TODO: this shouldn't be a global flag
-	// but rather configured on per stream basis
-	if ctrl.SaveVideo {
-		stream.saveVideo = true
-		stream.videoWriterChan = make(chan *rtp.Packet, 100) // not sure what the buffer size here should be
-	}
-
-	if _, exists := ctrl.streams[channelID]; exists {
-		return stream, errors.New("stream already exists in stream manager state")
-	}
-	ctrl.streams[channelID] = stream
-	ctrl.metadataCollectors[channelID] = make(chan bool, 1)
-
-	return stream, nil
-}
-
-func (ctrl *Control) removeStream(id types.ChannelID) error {
-	if _, exists := ctrl.streams[id]; !exists {
-		return errors.New("RemoveStream stream does not exist in state")
-	}
-
-	delete(ctrl.streams, id)
-	delete(ctrl.metadataCollectors, id)
+	stream.ReportMetadata(
+		VideoWidthMetadata(img.Bounds().Dx()),
+		VideoHeightMetadata(img.Bounds().Dy()),
+	)
 
 	return nil
 }
-
-var errStreamRemoved = errors.New("stream does not exist in state")
-
-func (ctrl *Control) getStream(id types.ChannelID) (*Stream, error) {
-	if _, exists := ctrl.streams[id]; !exists {
-		return nil, errStreamRemoved
-	}
-	return ctrl.streams[id], nil
-}
@@ -0,0 +1,819 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/auth"
+	"github.com/Glimesh/waveguide/pkg/registry"
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestControl(t *testing.T) *Control {
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy"}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	ctrl, err := New(context.Background(), cfg, "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctrl.Shutdown)
+
+	return ctrl
+}
+
+func TestStopStreamIsIdempotent(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	assert.Equal(StreamStateLive, stream.State())
+
+	assert.NoError(ctrl.StopStream(1234))
+	assert.NoError(ctrl.StopStream(1234))
+	assert.Equal(StreamStateStopped, stream.State())
+	assert.True(stream.Stopped())
+
+	_, err = ctrl.GetTracks(1234)
+	assert.ErrorIs(err, errStreamRemoved)
+}
+
+func TestConcurrentStartStreamRejectsDuplicates(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	var started, rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ctrl.StartStream(1234)
+			if err == nil {
+				atomic.AddInt32(&started, 1)
+			} else if assert.ErrorIs(err, ErrStreamExists) {
+				atomic.AddInt32(&rejected, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(1), started)
+	assert.Equal(int32(49), rejected)
+}
+
+func TestConcurrentStreamLifecycle(t *testing.T) {
+	ctrl := newTestControl(t)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		channelID := types.ChannelID(worker % 3)
+
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				stream, err := ctrl.StartStream(channelID)
+				if err != nil {
+					continue
+				}
+
+				track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				stream.AddTrack(track, webrtc.MimeTypeH264)
+				stream.WriteRTP(track, &rtp.Packet{})
+				stream.ReportMetadata(VideoWidthMetadata(1280))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ctrl.StopStream(channelID)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ctrl.GetTracks(channelID)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSubscriptionDropPolicies(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	audio, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	assert.NoError(stream.AddTrack(audio, webrtc.MimeTypeOpus))
+
+	// Nobody reads from the slow subscribers until every packet is published
+	newest := stream.Subscribe("newest", WithQueueSize(3), WithDropPolicy(DropNewest))
+	oldest := stream.Subscribe("oldest", WithQueueSize(3), WithDropPolicy(DropOldest))
+	video := stream.Subscribe("video", WithQueueSize(1), WithTrackType(webrtc.RTPCodecTypeVideo))
+	fast := stream.Subscribe("fast", WithQueueSize(10))
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 10; i++ {
+			assert.NoError(stream.WriteRTP(audio, &rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+				Payload: []byte{byte(i)},
+			}))
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow subscriber blocked publishing")
+	}
+
+	queued := func(sub *Subscription) []byte {
+		var payloads []byte
+		for len(sub.Packets()) > 0 {
+			payloads = append(payloads, (<-sub.Packets()).Packet.Payload[0])
+		}
+		return payloads
+	}
+
+	assert.Equal([]byte{0, 1, 2}, queued(newest), "drop newest keeps the oldest packets")
+	assert.Equal(uint64(7), newest.Dropped())
+	assert.Equal([]byte{7, 8, 9}, queued(oldest), "drop oldest keeps the newest packets")
+	assert.Equal(uint64(7), oldest.Dropped())
+	assert.Equal([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, queued(fast))
+	assert.Equal(uint64(0), fast.Dropped())
+	assert.Empty(queued(video), "audio isn't delivered to video subscribers")
+	assert.Equal(uint64(0), video.Dropped())
+}
+
+func TestTrackStatsLostPackets(t *testing.T) {
+	assert := assert.New(t)
+	stats := newTrackStats(webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264)
+
+	for _, seq := range []uint16{65533, 65534, 1, 2, 5, 0, 0, 65530, 3000, 3001} {
+		stats.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+	}
+
+	// 65535 and 0 were skipped over the wraparound, 3 and 4 were skipped, 0 arrived
+	// late and only counts once, 65530 was never missing and the jump to 3000 is
+	// treated as a restart
+	assert.Equal(uint64(3), stats.Lost())
+	assert.Equal(uint64(10), stats.Packets())
+
+	// A late packet from before the restart isn't taken off
+	stats.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: 3}})
+	assert.Equal(uint64(3), stats.Lost())
+}
+
+func TestReconnectResumesStream(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.ReconnectGrace = time.Minute
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	first, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "first")
+	assert.NoError(stream.AddTrack(first, webrtc.MimeTypeH264))
+
+	sub := stream.Subscribe("test", WithQueueSize(10))
+	assert.NoError(stream.WriteRTP(first, &rtp.Packet{Header: rtp.Header{SequenceNumber: 100, Timestamp: 9000, SSRC: 1}}))
+
+	assert.NoError(ctrl.StreamDisconnected(1234))
+	assert.NoError(ctrl.StreamDisconnected(1234))
+	assert.Equal(StreamStateReconnecting, stream.State())
+	assert.Error(stream.WriteRTP(first, &rtp.Packet{}), "the old publisher can't write anymore")
+
+	resumed, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	assert.Same(stream, resumed)
+	assert.Equal(StreamStateLive, stream.State())
+
+	second, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "second")
+	assert.NoError(stream.AddTrack(second, webrtc.MimeTypeH264))
+	assert.Len(stream.Tracks(), 1)
+	assert.NoError(stream.WriteRTP(second, &rtp.Packet{Header: rtp.Header{SequenceNumber: 5, Timestamp: 10, SSRC: 2}}))
+
+	firstPacket := (<-sub.Packets()).Packet
+	secondPacket := (<-sub.Packets()).Packet
+	assert.Equal(uint16(101), secondPacket.SequenceNumber)
+	assert.Greater(secondPacket.Timestamp, firstPacket.Timestamp)
+	assert.Equal(uint32(1), secondPacket.SSRC)
+}
+
+func TestReconnectGraceExpires(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.ReconnectGrace = 10 * time.Millisecond
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	assert.NoError(ctrl.StreamDisconnected(1234))
+
+	assert.Eventually(func() bool {
+		return stream.State() == StreamStateStopped
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestThumbnailHandler(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+
+	rec := httptest.NewRecorder()
+	ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/thumbnail/1234.jpg", nil))
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	stream.thumbnails.set(image.NewRGBA(image.Rect(0, 0, 640, 360)))
+
+	for format, contentType := range thumbnailContentTypes {
+		rec = httptest.NewRecorder()
+		ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/thumbnail/1234."+format+"?width=320", nil))
+		assert.Equal(http.StatusOK, rec.Code, format)
+		assert.Equal(contentType, rec.Header().Get("Content-Type"), format)
+
+		img, _, err := image.Decode(rec.Body)
+		if assert.NoError(err, format) {
+			assert.Equal(image.Rect(0, 0, 320, 180), img.Bounds(), format)
+		}
+	}
+
+	// Widths are snapped so only a few sizes are ever encoded
+	for width, expected := range map[string]int{"1": 160, "161": 320, "500": 640, "4000": 640} {
+		rec = httptest.NewRecorder()
+		ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/thumbnail/1234.png?width="+width, nil))
+		img, _, err := image.Decode(rec.Body)
+		if assert.NoError(err, width) {
+			assert.Equal(expected, img.Bounds().Dx(), width)
+		}
+	}
+
+	assert.True(stream.thumbnails.refresh())
+	assert.False(stream.thumbnails.refresh(), "refreshes are rate limited per stream")
+}
+
+func TestThumbnailAuthorization(t *testing.T) {
+	assert := assert.New(t)
+
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy", "token_channels": []int{1234}}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctrl, err := New(context.Background(), cfg, "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Shutdown()
+
+	for _, channelID := range []types.ChannelID{1, 1234} {
+		stream, err := ctrl.StartStream(channelID)
+		assert.NoError(err)
+		stream.thumbnails.set(image.NewRGBA(image.Rect(0, 0, 640, 360)))
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// Without an output checking tokens, private channels are refused
+	assert.Equal(http.StatusOK, get("/thumbnail/1.jpg").Code)
+	assert.Equal(http.StatusForbidden, get("/thumbnail/1234.jpg?token=abc").Code)
+
+	ctrl.SetViewerAuthorizer(func(r *http.Request, channelID types.ChannelID) (int, error) {
+		if channelID == 1234 && r.URL.Query().Get("token") != "valid" {
+			return http.StatusUnauthorized, auth.Reject(auth.ReasonMissingKey, errors.New("no token"))
+		}
+		return 0, nil
+	})
+	assert.Equal(http.StatusUnauthorized, get("/thumbnail/1234.jpg").Code)
+	rec := get("/thumbnail/1234.jpg?token=valid")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Header().Get("Cache-Control"), "private")
+	assert.Contains(get("/thumbnail/1.jpg").Header().Get("Cache-Control"), "public")
+}
+
+func TestSubscribeViewerStartsWithGOP(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	video, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	assert.NoError(stream.AddTrack(video, webrtc.MimeTypeH264))
+
+	sps := []byte{0x67, 0x42}
+	idr := []byte{0x65, 0x88}
+	slice := []byte{0x41, 0x9a}
+	packets := []struct {
+		payload   []byte
+		timestamp uint32
+	}{
+		// Only the second GOP should be cached
+		{idr, 0}, {slice, 3000},
+		{sps, 6000}, {idr, 6000}, {slice, 9000}, {slice, 12000},
+	}
+	for i, p := range packets {
+		assert.NoError(stream.WriteRTP(video, &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: uint16(i), Timestamp: p.timestamp},
+			Payload: p.payload,
+		}))
+	}
+
+	sub, err := ctrl.SubscribeViewer(1234, "viewer")
+	assert.NoError(err)
+	assert.NoError(stream.WriteRTP(video, &rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 6, Timestamp: 15000},
+		Payload: slice,
+	}))
+
+	var sequences []uint16
+	var timestamps []uint32
+	for i := 0; i < 5; i++ {
+		pkt := (<-sub.Packets()).Packet
+		sequences = append(sequences, pkt.SequenceNumber)
+		timestamps = append(timestamps, pkt.Timestamp)
+	}
+	assert.Equal([]uint16{2, 3, 4, 5, 6}, sequences)
+	// The burst is squashed up against the latest frame, then the live packets carry on
+	assert.Equal([]uint32{12000 - 2*gopBurstFrameTicks, 12000 - 2*gopBurstFrameTicks, 12000 - gopBurstFrameTicks, 12000, 15000}, timestamps)
+}
+
+func TestRequestKeyframeCoalesces(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	assert.ErrorIs(ctrl.RequestKeyframe(1234), ErrKeyframeUnsupported)
+
+	var requests int32
+	stream.SetKeyframeRequester(func() error {
+		atomic.AddInt32(&requests, 1)
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(ctrl.RequestKeyframe(1234))
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	// The requests that came in too soon are sent together once the interval is up
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&requests) == 2
+	}, 2*keyframeRequestInterval, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestDrainRefusesNewStreams(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.DrainTimeout = 50 * time.Millisecond
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+
+	go ctrl.Drain()
+	assert.Eventually(ctrl.Draining, time.Second, time.Millisecond)
+
+	_, err = ctrl.StartStream(5678)
+	assert.ErrorIs(err, ErrDraining)
+	_, err = ctrl.Authenticate(auth.Request{ChannelID: 5678})
+	assert.ErrorIs(err, ErrDraining)
+
+	// The publisher didn't finish in time, so the stream is ended for it
+	ctrl.Drain()
+	assert.Equal(StreamStateStopped, stream.State())
+	assert.Empty(ctrl.streams.all())
+}
+
+func TestCapacityLimits(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.MaxPublishers = 1
+	ctrl.MaxViewersPerStream = 1
+
+	_, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+
+	_, err = ctrl.StartStream(5678)
+	assert.ErrorIs(err, ErrAtCapacity)
+	_, err = ctrl.Authenticate(auth.Request{ChannelID: 5678})
+	assert.ErrorIs(err, ErrAtCapacity)
+	assert.True(auth.ReasonOf(err).Retryable())
+
+	assert.NoError(ctrl.AddViewer(1234, "first"))
+	assert.ErrorIs(ctrl.AddViewer(1234, "second"), ErrAtCapacity)
+	ctrl.RemoveViewer(1234, "first")
+	assert.NoError(ctrl.AddViewer(1234, "second"))
+
+	assert.Equal(1, ctrl.Capacity().Publishers)
+	assert.Equal(1, ctrl.Capacity().Viewers)
+}
+
+func TestServiceEndsStream(t *testing.T) {
+	assert := assert.New(t)
+
+	var cfg config.Config
+	cfg.Service = config.Source{"type": "dummy", "revoked_channels": []int{1234}}
+	cfg.Orchestrator = config.Source{"type": "dummy"}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctrl, err := New(context.Background(), cfg, "test", logger)
+	assert.NoError(err)
+	t.Cleanup(ctrl.Shutdown)
+
+	revoked, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	var reason StopReason
+	revoked.SetDisconnect(func(r StopReason) { reason = r })
+
+	ended, err := ctrl.checkStream(revoked)
+	assert.NoError(err)
+	assert.True(ended)
+	assert.Equal(StopReasonRevoked, reason)
+	assert.Equal(StreamStateStopped, revoked.State())
+
+	stream, err := ctrl.StartStream(5678)
+	assert.NoError(err)
+	ended, err = ctrl.checkStream(stream)
+	assert.NoError(err)
+	assert.False(ended)
+
+	// Pushed terminations for an older stream on the channel are ignored
+	terminations := make(chan types.Termination)
+	go ctrl.watchTerminations(terminations)
+	terminations <- types.Termination{ChannelID: 5678, StreamID: stream.StreamID + 1, Reason: "old"}
+	assert.Equal(StreamStateLive, stream.State())
+	terminations <- types.Termination{ChannelID: 5678, StreamID: stream.StreamID, Reason: "banned"}
+	close(terminations)
+	assert.Eventually(func() bool {
+		return stream.State() == StreamStateStopped
+	}, time.Second, time.Millisecond)
+}
+
+func TestTakeover(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	oldTrack, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "old")
+	assert.NoError(stream.AddTrack(oldTrack, webrtc.MimeTypeH264))
+	var reason StopReason
+	stream.SetDisconnect(func(r StopReason) { reason = r })
+
+	_, err = ctrl.StartStream(1234)
+	assert.ErrorIs(err, ErrStreamExists, "the default policy rejects the new publisher")
+	assert.Empty(reason)
+
+	ctrl.channelTakeoverPolicies = map[types.ChannelID]TakeoverPolicy{1234: TakeoverKick}
+	takenOver, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	assert.Same(stream, takenOver)
+	assert.Equal(StopReasonTakeover, reason)
+	assert.Equal(StreamStateLive, stream.State())
+
+	// The new publisher's track is aliased onto the one viewers are watching
+	newTrack, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "new")
+	assert.NoError(stream.AddTrack(newTrack, webrtc.MimeTypeH264))
+	assert.Len(stream.Tracks(), 1)
+	assert.Error(stream.WriteRTP(oldTrack, &rtp.Packet{}))
+	assert.NoError(stream.WriteRTP(newTrack, &rtp.Packet{}))
+}
+
+func TestBFramePolicy(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.channelBFramePolicies = map[types.ChannelID]BFramePolicy{1234: BFrameReject}
+
+	warned, err := ctrl.StartStream(1)
+	assert.NoError(err)
+	assert.NoError(ctrl.ReportBFrames(warned), "the default policy only warns")
+	assert.True(warned.Info().VideoBFrames)
+	assert.False(warned.Stopped())
+
+	rejected, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	var reason StopReason
+	rejected.SetDisconnect(func(r StopReason) { reason = r })
+	assert.ErrorIs(ctrl.ReportBFrames(rejected), ErrBFramesRejected)
+	assert.Equal(StopReasonBFrames, reason)
+	assert.True(rejected.Stopped())
+}
+
+func TestBFramePassthroughKeepsVideoLocal(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+	ctrl.channelBFramePolicies = map[types.ChannelID]BFramePolicy{1234: BFramePassthrough}
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	video, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	audio, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	assert.NoError(stream.AddTrack(video, webrtc.MimeTypeH264))
+	assert.NoError(stream.AddTrack(audio, webrtc.MimeTypeOpus))
+
+	viewer, err := ctrl.SubscribeViewer(1234, "viewer")
+	assert.NoError(err)
+	local := stream.Subscribe("recording", WithQueueSize(10))
+
+	assert.NoError(ctrl.ReportBFrames(stream))
+	assert.False(stream.Stopped())
+
+	idr := &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: []byte{0x65, 0x88}}
+	assert.NoError(stream.WriteRTP(video, idr))
+	assert.NoError(stream.WriteRTP(audio, &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}}))
+
+	assert.Equal(webrtc.MimeTypeOpus, (<-viewer.Packets()).Codec, "viewers only get the audio")
+	assert.Len(viewer.Packets(), 0)
+	assert.Equal(webrtc.MimeTypeH264, (<-local.Packets()).Codec, "local consumers get the video")
+	assert.Equal(webrtc.MimeTypeOpus, (<-local.Packets()).Codec)
+
+	newViewer, err := ctrl.SubscribeViewer(1234, "new")
+	assert.NoError(err)
+	assert.Len(newViewer.Packets(), 0, "the b-frame GOP isn't burst to new viewers")
+
+	tracks, err := ctrl.GetTracks(1234)
+	assert.NoError(err)
+	assert.True(tracks[0].Local, "new viewers don't get a video track")
+	assert.False(tracks[1].Local)
+}
+
+func TestLocalTracks(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	opus, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "opus")
+	aac, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: MimeTypeAAC, ClockRate: 44100}, "aac", "aac")
+	assert.NoError(stream.AddTrack(opus, webrtc.MimeTypeOpus))
+	assert.NoError(stream.AddLocalTrack(aac, MimeTypeAAC))
+
+	sub := stream.Subscribe("test", WithTrackType(webrtc.RTPCodecTypeAudio))
+	defer sub.Close()
+	assert.NoError(stream.WriteRTP(aac, &rtp.Packet{}))
+	assert.Equal(MimeTypeAAC, (<-sub.Packets()).Codec, "local consumers get the local track")
+
+	tracks := stream.Tracks()
+	assert.Len(tracks, 2)
+	assert.False(tracks[0].Local)
+	assert.True(tracks[1].Local)
+	assert.Equal(webrtc.MimeTypeOpus, stream.Info().AudioCodec, "the stream reports what viewers get")
+}
+
+func TestReceivedCountsTheOriginalTracks(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	stream, err := ctrl.StartStream(1234)
+	assert.NoError(err)
+	video, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+	opus, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "opus")
+	aac, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: MimeTypeAAC, ClockRate: 44100}, "aac", "aac")
+	assert.NoError(stream.AddTrack(video, webrtc.MimeTypeH264))
+	assert.NoError(stream.AddTrack(opus, webrtc.MimeTypeOpus))
+
+	write := func(track webrtc.TrackLocal, packets int) {
+		for i := 0; i < packets; i++ {
+			assert.NoError(stream.WriteRTP(track, &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}, Payload: make([]byte, 100)}))
+		}
+	}
+	write(video, 3)
+	write(opus, 2)
+
+	info := stream.Info()
+	assert.Equal(3, info.VideoPackets)
+	assert.Equal(2, info.AudioPackets)
+
+	// The AAC the publisher sent is counted instead of the Opus transcoded from it
+	assert.NoError(stream.AddLocalTrack(aac, MimeTypeAAC))
+	write(aac, 4)
+	info = stream.Info()
+	assert.Equal(4, info.AudioPackets)
+	packets, bytes := received(stream.Tracks(), webrtc.RTPCodecTypeAudio)
+	assert.Equal(4, packets)
+	assert.Equal(4*112, bytes, "the rtp header and payload")
+}
+
+type testListener struct {
+	address string
+	path    string
+	ctrl    *Control
+	closed  int32
+}
+
+func (l *testListener) SetControl(ctrl *Control)         { l.ctrl = ctrl }
+func (l *testListener) SetLogger(log logrus.FieldLogger) {}
+func (l *testListener) Listen(ctx context.Context) {
+	l.ctrl.RegisterHandleFunc(l.path, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, l.address)
+	})
+}
+func (l *testListener) Close() error {
+	atomic.AddInt32(&l.closed, 1)
+	l.ctrl.UnregisterHandle(l.path)
+	return nil
+}
+
+func TestListenersReload(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	var created []*testListener
+	inputTypes := registry.New[Input]("input")
+	registry.Register(inputTypes, "test", func(cfg struct {
+		Address string `fig:"address"`
+		Path    string `fig:"path"`
+		Secret  string `fig:"playback_secret"`
+	}) (Input, error) {
+		l := &testListener{address: cfg.Address, path: cfg.Path}
+		created = append(created, l)
+		return l, nil
+	})
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Body.String()
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	listeners := NewListeners("input", inputTypes, ctrl, logger)
+	assert.NoError(listeners.Start(context.Background(), []config.Source{
+		{"type": "test", "address": ":1935", "path": "/a"},
+		{"type": "test", "address": ":8084", "path": "/b", "playback_secret": "hunter2"},
+	}))
+	assert.Eventually(func() bool { return get("/b") == ":8084" }, time.Second, time.Millisecond)
+
+	// An invalid config leaves everything running
+	err := listeners.Reload([]config.Source{{"type": "other"}})
+	assert.Error(err)
+	assert.Len(created, 2)
+
+	assert.NoError(listeners.Reload([]config.Source{
+		{"type": "test", "address": ":1935", "path": "/a"},
+		{"type": "test", "address": ":9000", "path": "/b"},
+	}))
+	assert.Len(created, 3, "only the changed source is created again")
+	assert.Equal(int32(0), atomic.LoadInt32(&created[0].closed))
+	assert.Equal(int32(1), atomic.LoadInt32(&created[1].closed))
+	assert.Eventually(func() bool { return get("/b") == ":9000" }, time.Second, time.Millisecond)
+	assert.Equal(":1935", get("/a"))
+
+	// Closed sources are logged without their secrets
+	assert.Contains(logs.String(), "Closing input test #1 (:8084)")
+	assert.NotContains(logs.String(), "hunter2")
+}
+
+// addresses stands in for the ports bindingListeners take
+type addresses struct {
+	mu    sync.Mutex
+	bound map[string]bool
+}
+
+type bindingListener struct {
+	testListener
+	addresses *addresses
+	bound     bool
+}
+
+func (l *bindingListener) Bind() error {
+	l.addresses.mu.Lock()
+	defer l.addresses.mu.Unlock()
+
+	if l.addresses.bound[l.address] {
+		return errors.New("address already in use")
+	}
+	l.addresses.bound[l.address] = true
+	l.bound = true
+	return nil
+}
+
+func (l *bindingListener) Close() error {
+	l.addresses.mu.Lock()
+	if l.bound {
+		delete(l.addresses.bound, l.address)
+	}
+	l.addresses.mu.Unlock()
+	return l.testListener.Close()
+}
+
+func TestListenersReloadBind(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	addresses := &addresses{bound: map[string]bool{":8000": true}}
+	var created []*bindingListener
+	inputTypes := registry.New[Input]("input")
+	registry.Register(inputTypes, "test", func(cfg struct {
+		Address string `fig:"address"`
+		Path    string `fig:"path"`
+	}) (Input, error) {
+		l := &bindingListener{testListener: testListener{address: cfg.Address, path: cfg.Path}, addresses: addresses}
+		created = append(created, l)
+		return l, nil
+	})
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Body.String()
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	listeners := NewListeners("input", inputTypes, ctrl, logger)
+
+	err := listeners.Start(context.Background(), []config.Source{{"type": "test", "address": ":8000", "path": "/a"}})
+	assert.ErrorContains(err, "input test #0 (:8000): address already in use", "binding is checked before starting")
+
+	assert.NoError(listeners.Reload([]config.Source{{"type": "test", "address": ":1935", "path": "/a"}}))
+	assert.Eventually(func() bool { return get("/a") == ":1935" }, time.Second, time.Millisecond)
+
+	// A changed source takes over the address of the one it replaces
+	assert.NoError(listeners.Reload([]config.Source{{"type": "test", "address": ":1935", "path": "/b"}}))
+	assert.Equal(int32(1), atomic.LoadInt32(&created[1].closed))
+	assert.Eventually(func() bool { return get("/b") == ":1935" }, time.Second, time.Millisecond)
+
+	// A new source on an address that's in use leaves the running ones alone
+	err = listeners.Reload([]config.Source{
+		{"type": "test", "address": ":1935", "path": "/b"},
+		{"type": "test", "address": ":8000", "path": "/c"},
+	})
+	assert.ErrorContains(err, "address already in use")
+	assert.Equal(int32(0), atomic.LoadInt32(&created[2].closed))
+	assert.Equal(int32(1), atomic.LoadInt32(&created[3].closed), "the new source is closed")
+	assert.Equal(":1935", get("/b"))
+
+	// Moving to an address that's in use puts the old source back
+	err = listeners.Reload([]config.Source{{"type": "test", "address": ":8000", "path": "/b"}})
+	assert.ErrorContains(err, "address already in use")
+	assert.Equal(int32(1), atomic.LoadInt32(&created[2].closed))
+	assert.Len(created, 6, "the old source is restarted")
+	assert.Eventually(func() bool { return get("/b") == ":1935" }, time.Second, time.Millisecond)
+
+	// The restarted source is the one running now
+	assert.NoError(listeners.Reload(nil))
+	assert.Equal(int32(1), atomic.LoadInt32(&created[5].closed))
+}
+
+func TestMetricsAreNodeLevel(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := newTestControl(t)
+
+	for _, channelID := range []types.ChannelID{1, 2} {
+		stream, err := ctrl.StartStream(channelID)
+		assert.NoError(err)
+		track, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+		assert.NoError(stream.AddTrack(track, webrtc.MimeTypeH264))
+		assert.NoError(stream.WriteRTP(track, &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}}))
+		assert.NoError(stream.WriteRTP(track, &rtp.Packet{Header: rtp.Header{SequenceNumber: 3}}))
+	}
+
+	rec := httptest.NewRecorder()
+	ctrl.httpMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.NotContains(body, "channel_id")
+	assert.Contains(body, `waveguide_track_lost_packets{codec="video/H264",type="video"} 2`)
+	assert.Contains(body, "waveguide_viewers 0")
+	assert.Contains(body, "waveguide_track_packets_total")
+}
@@ -0,0 +1,83 @@
+package control
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is returned to new publishers while the node is draining
+var ErrDraining = errors.New("node is draining")
+
+// drainPollInterval is how often Drain checks whether the publishers have finished
+const drainPollInterval = 500 * time.Millisecond
+
+// Draining is true once Drain has been called, new streams are refused from then on
+func (ctrl *Control) Draining() bool {
+	return atomic.LoadInt32(&ctrl.draining) == 1
+}
+
+// Drain stops accepting new streams and tells the orchestrator the node is going away,
+// then waits up to DrainTimeout for the publishers to finish before ending the rest.
+// It's safe to call from multiple goroutines, they all return once the node is drained.
+func (ctrl *Control) Drain() {
+	ctrl.drainOnce.Do(func() {
+		atomic.StoreInt32(&ctrl.draining, 1)
+		go ctrl.drain()
+	})
+	<-ctrl.drained
+}
+
+func (ctrl *Control) drain() {
+	defer close(ctrl.drained)
+
+	ctrl.log.Infof("Draining node, waiting up to %s for %d streams to finish", ctrl.DrainTimeout, len(ctrl.streams.all()))
+	if err := ctrl.orchestrator.Drain(); err != nil {
+		ctrl.log.Warnf("Could not tell the orchestrator we're draining: %v", err)
+	}
+
+	deadline := time.NewTimer(ctrl.DrainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for len(ctrl.streams.all()) > 0 {
+		select {
+		case <-deadline.C:
+			ctrl.log.Warnf("Drain timed out, stopping the remaining %d streams", len(ctrl.streams.all()))
+			ctrl.stopAll(StopReasonDrain)
+			return
+		case <-ticker.C:
+		}
+	}
+
+	ctrl.log.Info("Node drained")
+}
+
+// stopAll ends every stream in parallel, giving up on slow service and orchestrator
+// calls after ShutdownTimeout so a single stream can't hold up the rest
+func (ctrl *Control) stopAll(reason StopReason) {
+	var wg sync.WaitGroup
+	for _, stream := range ctrl.streams.all() {
+		wg.Add(1)
+		go func(stream *Stream) {
+			defer wg.Done()
+			if err := ctrl.stopChannel(stream.ChannelID, reason); err != nil {
+				stream.log.Error(err)
+			}
+		}(stream)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ctrl.ShutdownTimeout):
+		ctrl.log.Warnf("Gave up waiting for streams to stop after %s", ctrl.ShutdownTimeout)
+	}
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Glimesh/waveguide/pkg/h264"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// gopBurstFrameTicks is the 90kHz timestamp spacing of the frames in a GOP burst,
+// the burst is squashed to 1ms per frame so the viewer catches up to live straight away
+const gopBurstFrameTicks = 90
+
+// gopCache keeps the packets of the most recent GOP of a H264 track, starting
+// at the SPS/PPS/IDR packets, so new viewers can start decoding immediately.
+type gopCache struct {
+	mu   sync.Mutex
+	size int
+
+	packets []*rtp.Packet
+	// started is set once a keyframe has been seen, until then there's nothing worth caching
+	started bool
+	// lastKeyframePart is used to tell a new keyframe from the rest of the current one
+	lastKeyframePart bool
+}
+
+func newGOPCache(size int) *gopCache {
+	return &gopCache{
+		size: size,
+	}
+}
+
+// supportsGOPCache is true for the codecs we can find keyframes in
+func supportsGOPCache(kind webrtc.RTPCodecType, codec string) bool {
+	return kind == webrtc.RTPCodecTypeVideo && strings.EqualFold(codec, webrtc.MimeTypeH264)
+}
+
+// add appends the packet to the current GOP, the packet must not be modified afterwards
+func (g *gopCache) add(p *rtp.Packet) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keyframePart := h264.IsKeyframePart(p.Payload)
+	if keyframePart && (!g.started || !g.lastKeyframePart) {
+		g.packets = g.packets[:0]
+		g.started = true
+	}
+	g.lastKeyframePart = keyframePart
+
+	if !g.started {
+		return
+	}
+
+	// The GOP doesn't fit, a partial GOP is useless so wait for the next keyframe
+	if len(g.packets) >= g.size {
+		g.packets = nil
+		g.started = false
+		return
+	}
+
+	g.packets = append(g.packets, p)
+}
+
+// burst returns a copy of the cached GOP with the timestamps squashed together,
+// the last frame keeps its timestamp so the live packets carry on from it.
+func (g *gopCache) burst() []*rtp.Packet {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.packets) == 0 {
+		return nil
+	}
+
+	frames := 0
+	for i, p := range g.packets {
+		if i == 0 || p.Timestamp != g.packets[i-1].Timestamp {
+			frames++
+		}
+	}
+
+	last := g.packets[len(g.packets)-1].Timestamp
+	burst := make([]*rtp.Packet, len(g.packets))
+	frame := 0
+	for i, p := range g.packets {
+		if i > 0 && p.Timestamp != g.packets[i-1].Timestamp {
+			frame++
+		}
+		burst[i] = p.Clone()
+		burst[i].Timestamp = last - uint32(frames-1-frame)*gopBurstFrameTicks
+	}
+
+	return burst
+}
+
+// reset drops the cached GOP, used when the publisher changes
+func (g *gopCache) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.packets = nil
+	g.started = false
+	g.lastKeyframePart = false
+}
@@ -1,7 +1,9 @@
 package control
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -12,36 +14,112 @@ import (
 // This http server should combine any of the inputs / outputs http endpoints into a singular server
 
 func (ctrl *Control) StartHTTPServer() {
+	var err error
 	switch ctrl.HTTPServerType {
 	case "acme":
 		ctrl.log.Infof("Starting ACME http server on %s:443", ctrl.HTTPSHostname)
-		ctrl.log.Fatal(http.Serve(
-			autocert.NewListener(ctrl.HTTPSHostname),
-			logRequest(ctrl.log, ctrl.httpMux),
-		))
+		srv := ctrl.setHTTPServer(&http.Server{
+			Handler: logRequest(ctrl.log, ctrl.httpMux),
+		})
+		err = srv.Serve(autocert.NewListener(ctrl.HTTPSHostname))
 	case "https":
 		ctrl.log.Infof("Starting https server on %s", ctrl.HTTPAddress)
-		ctrl.log.Fatal(httpsServer(
+		srv := ctrl.setHTTPServer(httpsServer(
 			ctrl.HTTPAddress,
-			ctrl.HTTPSCert,
-			ctrl.HTTPSKey,
 			ctrl.log,
 			ctrl.httpMux,
 		))
+		err = srv.ListenAndServeTLS(ctrl.HTTPSCert, ctrl.HTTPSKey)
 	case "http":
 		ctrl.log.Infof("Starting http server on %s", ctrl.HTTPAddress)
-		ctrl.log.Fatal(httpServer(
+		srv := ctrl.setHTTPServer(httpServer(
 			ctrl.HTTPAddress,
 			ctrl.log,
 			ctrl.httpMux,
 		))
+		err = srv.ListenAndServe()
 	default:
 		ctrl.log.Fatalf("unknown http_server_type server option %s", ctrl.HTTPServerType)
 	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		ctrl.log.Fatal(err)
+	}
+}
+
+// setHTTPServer keeps the server around for Shutdown, a server created after
+// Shutdown is closed straight away so it never starts serving
+func (ctrl *Control) setHTTPServer(srv *http.Server) *http.Server {
+	ctrl.httpServerMu.Lock()
+	defer ctrl.httpServerMu.Unlock()
+
+	ctrl.httpServer = srv
+	if ctrl.httpServerClosed {
+		srv.Close()
+	}
+	return srv
+}
+
+// shutdownHTTPServer lets in flight requests finish for up to ShutdownTimeout
+func (ctrl *Control) shutdownHTTPServer() {
+	ctrl.httpServerMu.Lock()
+	srv := ctrl.httpServer
+	ctrl.httpServerClosed = true
+	ctrl.httpServerMu.Unlock()
+
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ctrl.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		ctrl.log.Warnf("HTTP server did not shut down cleanly: %v", err)
+	}
 }
 
+// RegisterHandleFunc adds a handler to the Control HTTP server, it can be removed
+// with UnregisterHandle so inputs and outputs can be stopped and started again
 func (ctrl *Control) RegisterHandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	ctrl.httpMux.HandleFunc(pattern, handler)
+	ctrl.handlersMu.Lock()
+	defer ctrl.handlersMu.Unlock()
+
+	existing, ok := ctrl.handlers[pattern]
+	if !ok {
+		ctrl.httpMux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			ctrl.serveHandler(pattern, w, r)
+		})
+	} else if existing != nil {
+		ctrl.log.Warnf("%s is already handled, replacing it", pattern)
+	}
+	ctrl.handlers[pattern] = handler
+}
+
+// UnregisterHandle removes a handler added with RegisterHandleFunc, requests get a 404 after
+func (ctrl *Control) UnregisterHandle(pattern string) {
+	ctrl.handlersMu.Lock()
+	defer ctrl.handlersMu.Unlock()
+
+	if _, ok := ctrl.handlers[pattern]; ok {
+		ctrl.handlers[pattern] = nil
+	}
+}
+
+func (ctrl *Control) serveHandler(pattern string, w http.ResponseWriter, r *http.Request) {
+	ctrl.handlersMu.RLock()
+	handler := ctrl.handlers[pattern]
+	ctrl.handlersMu.RUnlock()
+
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r)
+}
+
+// Handler serves the endpoints registered on the Control HTTP server without starting it, eg: in tests
+func (ctrl *Control) Handler() http.Handler {
+	return ctrl.httpMux
 }
 
 func (ctrl *Control) HTTPServerURL() string {
@@ -58,15 +136,14 @@ func (ctrl *Control) HTTPServerURL() string {
 	return fmt.Sprintf("%s://%s", protocol, host)
 }
 
-func httpServer(address string, log logrus.FieldLogger, mux *http.ServeMux) error {
-	srv := &http.Server{
+func httpServer(address string, log logrus.FieldLogger, mux *http.ServeMux) *http.Server {
+	return &http.Server{
 		Addr:    address,
 		Handler: logRequest(log, mux),
 	}
-	return srv.ListenAndServe()
 }
 
-func httpsServer(address, cert, key string, log logrus.FieldLogger, mux *http.ServeMux) error {
+func httpsServer(address string, log logrus.FieldLogger, mux *http.ServeMux) *http.Server {
 	cfg := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -78,13 +155,12 @@ func httpsServer(address, cert, key string, log logrus.FieldLogger, mux *http.Se
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
 	}
-	srv := &http.Server{
+	return &http.Server{
 		Addr:         address,
 		Handler:      logRequest(log, mux),
 		TLSConfig:    cfg,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
-	return srv.ListenAndServeTLS(cert, key)
 }
 
 func logRequest(log logrus.FieldLogger, handler http.Handler) http.Handler {
@@ -1,16 +1,11 @@
 package control
 
 import (
-	"context"
-
-	"github.com/sirupsen/logrus"
+	"github.com/Glimesh/waveguide/pkg/registry"
 )
 
 type Input interface {
-	SetControl(ctrl *Control)
-	SetLogger(log logrus.FieldLogger)
-
-	Listen(ctx context.Context)
+	Listener
 
 	// // Blocking Functions
 	// // These functions are gatekeepers to the connection
@@ -34,21 +29,5 @@ type Input interface {
 	// OnStreamStart(channelID int, streamID int)
 }
 
-type InputConfig[C any] struct {
-	ReadConfig func(map[string]interface{}) C
-}
-
-type InputType struct {
-	Name       string
-	New        func(*Control, interface{}) (Input, error)
-	ReadConfig InputConfig[any]
-	Options    []InputOption
-	Config     interface{}
-}
-
-type InputOption struct {
-	Name     string
-	Default  interface{}
-	Value    interface{}
-	Required bool
-}
+// InputTypes holds every input that can be picked with `type` in [[input.sources]]
+var InputTypes = registry.New[Input]("input")
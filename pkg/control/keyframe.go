@@ -0,0 +1,90 @@
+package control
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// keyframeRequestInterval is the minimum time between keyframe requests sent to the
+// publisher, viewer requests in between are coalesced into a single one
+const keyframeRequestInterval = time.Second
+
+// KeyframeRequestFunc is provided by inputs that can ask the publisher for a keyframe, eg: with a PLI
+type KeyframeRequestFunc func() error
+
+// ErrKeyframeUnsupported is returned for inputs that can't be asked for a keyframe,
+// new viewers have to rely on the GOP cache instead
+var ErrKeyframeUnsupported = errors.New("input can't be asked for a keyframe")
+
+// SetKeyframeRequester registers the input specific way of asking the publisher for a keyframe
+func (s *Stream) SetKeyframeRequester(fn KeyframeRequestFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requestKeyframe = fn
+}
+
+// RequestKeyframe asks the publisher for a keyframe on behalf of a viewer. Requests are
+// rate limited, one arriving too soon is sent once the interval is up along with any
+// other requests that came in meanwhile.
+func (s *Stream) RequestKeyframe() error {
+	s.mu.Lock()
+	fn := s.requestKeyframe
+	if fn == nil {
+		s.mu.Unlock()
+		keyframeRequests.WithLabelValues("unsupported").Inc()
+		return ErrKeyframeUnsupported
+	}
+
+	wait := keyframeRequestInterval - time.Since(s.lastKeyframeRequest)
+	if s.pendingKeyframeTimer != nil || wait > 0 {
+		if s.pendingKeyframeTimer == nil {
+			s.pendingKeyframeTimer = time.AfterFunc(wait, s.sendPendingKeyframeRequest)
+		}
+		s.mu.Unlock()
+		keyframeRequests.WithLabelValues("coalesced").Inc()
+		return nil
+	}
+	s.lastKeyframeRequest = time.Now()
+	s.mu.Unlock()
+
+	return sendKeyframeRequest(fn)
+}
+
+func (s *Stream) sendPendingKeyframeRequest() {
+	s.mu.Lock()
+	fn := s.requestKeyframe
+	s.pendingKeyframeTimer = nil
+	s.lastKeyframeRequest = time.Now()
+	stopped := s.stopped
+	s.mu.Unlock()
+
+	if fn == nil || stopped {
+		return
+	}
+	if err := sendKeyframeRequest(fn); err != nil {
+		s.log.Debugf("keyframe request failed: %v", err)
+	}
+}
+
+func sendKeyframeRequest(fn KeyframeRequestFunc) error {
+	if err := fn(); err != nil {
+		keyframeRequests.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	keyframeRequests.WithLabelValues("forwarded").Inc()
+	return nil
+}
+
+// RequestKeyframe forwards a viewer PLI/FIR to the publisher of the stream
+func (ctrl *Control) RequestKeyframe(channelID types.ChannelID) error {
+	stream, err := ctrl.getStream(channelID)
+	if err != nil {
+		return err
+	}
+
+	return stream.RequestKeyframe()
+}
@@ -0,0 +1,216 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/registry"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrReloadUnsupported = errors.New("reloading is not supported")
+
+// Listener is the lifecycle shared by inputs and outputs
+type Listener interface {
+	SetControl(ctrl *Control)
+	SetLogger(log logrus.FieldLogger)
+
+	// Listen starts accepting publishers or viewers, it's run in its own goroutine
+	Listen(ctx context.Context)
+	// Close stops accepting new connections, streams that are already live keep
+	// running until they end on their own
+	Close() error
+}
+
+// Binder is implemented by listeners with an address of their own, Bind is called
+// before Listen so an address that's in use fails the reload instead of the listener
+type Binder interface {
+	Bind() error
+}
+
+// Listeners runs the inputs or outputs of the config, and swaps them when it's reloaded
+type Listeners[T Listener] struct {
+	// kind is used in config paths and log fields, eg: input
+	kind  string
+	types *registry.Registry[T]
+	ctrl  *Control
+	log   *logrus.Logger
+
+	mu      sync.Mutex
+	ctx     context.Context
+	running []runningListener[T]
+}
+
+type runningListener[T Listener] struct {
+	// key identifies the source config, a listener is kept running while its config is unchanged
+	key string
+	// name is safe to log, the key has the secrets of the source in it
+	name     string
+	src      config.Source
+	listener T
+}
+
+func NewListeners[T Listener](kind string, types *registry.Registry[T], ctrl *Control, logger *logrus.Logger) *Listeners[T] {
+	return &Listeners[T]{
+		kind:  kind,
+		types: types,
+		ctrl:  ctrl,
+		log:   logger,
+	}
+}
+
+// Start creates and starts a listener for every source
+func (l *Listeners[T]) Start(ctx context.Context, sources []config.Source) error {
+	l.mu.Lock()
+	l.ctx = ctx
+	l.mu.Unlock()
+
+	return l.Reload(sources)
+}
+
+// Reload starts the sources that are new or changed and closes the ones that
+// are gone, nothing is changed if any of the sources is invalid or can't bind
+func (l *Listeners[T]) Reload(sources []config.Source) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	unchanged := make([]runningListener[T], len(l.running))
+	copy(unchanged, l.running)
+
+	next := make([]runningListener[T], 0, len(sources))
+	var added []runningListener[T]
+	for i, src := range sources {
+		key := sourceKey(src)
+
+		if j := indexOfListener(unchanged, key); j >= 0 {
+			next = append(next, unchanged[j])
+			unchanged = append(unchanged[:j], unchanged[j+1:]...)
+			continue
+		}
+
+		running, err := l.create(sourceName(i, src), src)
+		if err != nil {
+			return fmt.Errorf("%s.sources[%d]: %w", l.kind, i, err)
+		}
+		next = append(next, running)
+		added = append(added, running)
+	}
+
+	// Bind the new listeners while the old ones are still running, the ones that
+	// fail may be taking over the address of one that's been removed or changed
+	var unbound []runningListener[T]
+	for _, running := range added {
+		if err := bind(running.listener); err != nil {
+			unbound = append(unbound, running)
+		}
+	}
+
+	// Whatever is left over has been removed or changed
+	l.close(unchanged)
+	for _, running := range unbound {
+		if err := bind(running.listener); err != nil {
+			l.close(added)
+			l.restart(unchanged)
+			return fmt.Errorf("%s %s: %w", l.kind, running.name, err)
+		}
+	}
+
+	for _, running := range added {
+		go running.listener.Listen(l.ctx)
+	}
+
+	l.running = next
+	return nil
+}
+
+func (l *Listeners[T]) create(name string, src config.Source) (runningListener[T], error) {
+	listener, err := l.types.New(src)
+	if err != nil {
+		return runningListener[T]{}, err
+	}
+	listener.SetControl(l.ctrl)
+	listener.SetLogger(l.log.WithFields(logrus.Fields{l.kind: src.Type()}))
+
+	return runningListener[T]{key: sourceKey(src), name: name, src: src, listener: listener}, nil
+}
+
+// restart puts back listeners that were closed for a reload that failed, so a bad
+// address doesn't stop anything that was running
+func (l *Listeners[T]) restart(closed []runningListener[T]) {
+	for _, old := range closed {
+		running, err := l.create(old.name, old.src)
+		if err == nil {
+			err = bind(running.listener)
+		}
+		if err != nil {
+			l.log.Errorf("Failed to restart %s %s: %v", l.kind, old.name, err)
+			continue
+		}
+
+		l.running[indexOfListener(l.running, old.key)] = running
+		go running.listener.Listen(l.ctx)
+	}
+}
+
+func (l *Listeners[T]) close(listeners []runningListener[T]) {
+	for _, running := range listeners {
+		l.log.Infof("Closing %s %s", l.kind, running.name)
+		if err := running.listener.Close(); err != nil {
+			l.log.Warnf("Failed to close %s %s: %v", l.kind, running.name, err)
+		}
+	}
+}
+
+// bind binds the listeners that have an address of their own
+func bind(listener Listener) error {
+	if binder, ok := listener.(Binder); ok {
+		return binder.Bind()
+	}
+	return nil
+}
+
+func indexOfListener[T Listener](listeners []runningListener[T], key string) int {
+	for i, running := range listeners {
+		if running.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// sourceKey prints the table with its keys sorted, so equal configs have equal keys
+func sourceKey(src config.Source) string {
+	return fmt.Sprint(map[string]interface{}(src))
+}
+
+// sourceName describes the source by its type, position and address only, eg: rtmp #0 (:1935)
+func sourceName(i int, src config.Source) string {
+	name := fmt.Sprintf("%s #%d", src.Type(), i)
+	if address, ok := src["address"].(string); ok && address != "" {
+		name += fmt.Sprintf(" (%s)", address)
+	}
+	return name
+}
+
+// SetReloader sets what Reload does, eg: re-reading the config file and reloading the inputs and outputs
+func (ctrl *Control) SetReloader(reloader func() error) {
+	ctrl.reloadMu.Lock()
+	defer ctrl.reloadMu.Unlock()
+
+	ctrl.reloader = reloader
+}
+
+// Reload runs the reloader, one at a time
+func (ctrl *Control) Reload() error {
+	ctrl.reloadMu.Lock()
+	defer ctrl.reloadMu.Unlock()
+
+	if ctrl.reloader == nil {
+		return ErrReloadUnsupported
+	}
+	return ctrl.reloader()
+}
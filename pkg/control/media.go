@@ -0,0 +1,295 @@
+package control
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// MimeTypeAAC is for AAC tracks packetized as RFC 3640 AAC-hbr, the audio specific config is in the fmtp line
+const MimeTypeAAC = "audio/aac"
+
+// MediaPacket is a single RTP packet an input published on one of the stream tracks.
+// The packet is shared between every subscriber, so it must be cloned before it's modified.
+type MediaPacket struct {
+	Type   webrtc.RTPCodecType
+	Codec  string
+	Packet *rtp.Packet
+	// Local is set for packets of tracks WebRTC viewers don't get, see StreamTrack.Local
+	Local bool
+}
+
+// MediaHandler is called for every new stream on this node, and is the place for
+// local consumers (thumbnails, recording, HLS, etc) to subscribe to the stream media.
+type MediaHandler func(stream *Stream)
+
+type DropPolicy int
+
+const (
+	// DropNewest discards the incoming packet when the subscriber queue is full
+	DropNewest DropPolicy = iota
+	// DropOldest evicts the oldest queued packet to make room for the incoming one
+	DropOldest
+)
+
+type SubscribeOption func(*Subscription)
+
+// WithQueueSize sets how many packets can be waiting for the subscriber before the drop policy kicks in
+func WithQueueSize(size int) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.queueSize = size
+	}
+}
+
+func WithDropPolicy(policy DropPolicy) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.policy = policy
+	}
+}
+
+// WithGOP starts the subscription with the cached GOP of every video track, for
+// viewers that need a keyframe before they can show anything
+func WithGOP() SubscribeOption {
+	return func(sub *Subscription) {
+		sub.gop = true
+	}
+}
+
+// WithTrackType only delivers packets from tracks of the given kind
+func WithTrackType(kind webrtc.RTPCodecType) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.kind = kind
+	}
+}
+
+// WithoutLocalTracks leaves out the packets of local tracks, for WebRTC viewers
+func WithoutLocalTracks() SubscribeOption {
+	return func(sub *Subscription) {
+		sub.noLocal = true
+	}
+}
+
+type Subscription struct {
+	name string
+	bus  *mediaBus
+
+	kind      webrtc.RTPCodecType
+	queueSize int
+	policy    DropPolicy
+	gop       bool
+	noLocal   bool
+
+	packets chan MediaPacket
+	closed  bool
+	dropped uint64
+}
+
+func (sub *Subscription) Name() string {
+	return sub.name
+}
+
+// Packets is closed when either the subscription or the stream is closed
+func (sub *Subscription) Packets() <-chan MediaPacket {
+	return sub.packets
+}
+
+// Dropped is the amount of packets discarded because the subscriber couldn't keep up
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+}
+
+func (sub *Subscription) deliver(pkt MediaPacket) {
+	if sub.kind != 0 && sub.kind != pkt.Type {
+		return
+	}
+	if sub.noLocal && pkt.Local {
+		return
+	}
+
+	select {
+	case sub.packets <- pkt:
+		return
+	default:
+	}
+
+	if sub.policy == DropOldest {
+		select {
+		case <-sub.packets:
+		default:
+		}
+
+		select {
+		case sub.packets <- pkt:
+		default:
+		}
+	}
+
+	atomic.AddUint64(&sub.dropped, 1)
+}
+
+// mediaBus fans out the packets of a single stream to all of its local subscribers
+type mediaBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	// gops holds the latest GOP per video codec, it's disabled when gopSize is zero
+	gopSize int
+	gopsMu  sync.Mutex
+	gops    map[string]*gopCache
+}
+
+func newMediaBus(gopSize int) *mediaBus {
+	return &mediaBus{
+		subs:    make(map[*Subscription]struct{}),
+		gopSize: gopSize,
+		gops:    make(map[string]*gopCache),
+	}
+}
+
+func (b *mediaBus) gopCache(kind webrtc.RTPCodecType, codec string) *gopCache {
+	if b.gopSize <= 0 || !supportsGOPCache(kind, codec) {
+		return nil
+	}
+
+	b.gopsMu.Lock()
+	defer b.gopsMu.Unlock()
+
+	gop, ok := b.gops[codec]
+	if !ok {
+		gop = newGOPCache(b.gopSize)
+		b.gops[codec] = gop
+	}
+	return gop
+}
+
+// resetGOPs forgets the cached GOPs, the next publisher starts from its own keyframe
+func (b *mediaBus) resetGOPs() {
+	b.gopsMu.Lock()
+	defer b.gopsMu.Unlock()
+
+	for _, gop := range b.gops {
+		gop.reset()
+	}
+}
+
+func (b *mediaBus) subscribe(name string, opts ...SubscribeOption) *Subscription {
+	sub := &Subscription{
+		name:      name,
+		bus:       b,
+		queueSize: 100,
+		policy:    DropNewest,
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Publishing is blocked while we hold the lock, so the burst and the live
+	// packets line up without gaps or duplicates
+	var burst []MediaPacket
+	if sub.gop && !b.closed {
+		burst = b.gopBurst(sub.kind)
+	}
+	sub.packets = make(chan MediaPacket, sub.queueSize+len(burst))
+	for _, pkt := range burst {
+		sub.packets <- pkt
+	}
+
+	if b.closed {
+		sub.closed = true
+		close(sub.packets)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (b *mediaBus) gopBurst(kind webrtc.RTPCodecType) []MediaPacket {
+	if kind != 0 && kind != webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+
+	b.gopsMu.Lock()
+	defer b.gopsMu.Unlock()
+
+	var burst []MediaPacket
+	for codec, gop := range b.gops {
+		for _, p := range gop.burst() {
+			burst = append(burst, MediaPacket{
+				Type:   webrtc.RTPCodecTypeVideo,
+				Codec:  codec,
+				Packet: p,
+			})
+		}
+	}
+	return burst
+}
+
+func (b *mediaBus) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, sub)
+	if !sub.closed {
+		sub.closed = true
+		close(sub.packets)
+	}
+}
+
+func (b *mediaBus) publish(kind webrtc.RTPCodecType, codec string, local bool, p *rtp.Packet) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return
+	}
+
+	// The GOP cache is only burst to viewers, who don't get local tracks
+	var gop *gopCache
+	if !local {
+		gop = b.gopCache(kind, codec)
+	}
+	if gop == nil && len(b.subs) == 0 {
+		return
+	}
+
+	// Inputs are free to reuse their read buffers, so subscribers get their own copy
+	pkt := MediaPacket{
+		Type:   kind,
+		Codec:  codec,
+		Packet: p.Clone(),
+		Local:  local,
+	}
+	if gop != nil {
+		gop.add(pkt.Packet)
+	}
+	for sub := range b.subs {
+		sub.deliver(pkt)
+	}
+}
+
+func (b *mediaBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for sub := range b.subs {
+		sub.closed = true
+		close(sub.packets)
+	}
+	b.subs = make(map[*Subscription]struct{})
+}
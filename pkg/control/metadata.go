@@ -2,15 +2,25 @@ package control
 
 type Metadata func(*Stream)
 
-func AudioPacketsMetadata(packets int) Metadata {
+// NackPacketsMetadata is the number of packets the input has asked the publisher to retransmit
+func NackPacketsMetadata(packets int) Metadata {
 	return func(s *Stream) {
-		s.totalAudioPackets += packets
+		s.totalNackPackets += packets
 	}
 }
 
-func VideoPacketsMetadata(packets int) Metadata {
+// SourcePingMetadata is a measured round trip time to the publisher in milliseconds,
+// streams that are never measured don't report a ping at all
+func SourcePingMetadata(ms int) Metadata {
 	return func(s *Stream) {
-		s.totalVideoPackets += packets
+		s.sourcePing = &ms
+	}
+}
+
+// InputTypeMetadata is the name of the input the publisher is connected to, eg: rtmp
+func InputTypeMetadata(name string) Metadata {
+	return func(s *Stream) {
+		s.inputType = name
 	}
 }
 
@@ -47,3 +57,36 @@ func VideoWidthMetadata(width int) Metadata {
 		s.videoWidth = width
 	}
 }
+func VideoBFramesMetadata(bframes bool) Metadata {
+	return func(s *Stream) {
+		s.videoBFrames = bframes
+	}
+}
+
+// VideoFramerateMetadata is the frames per second the publisher says it's sending
+func VideoFramerateMetadata(fps float64) Metadata {
+	return func(s *Stream) {
+		s.videoFramerate = fps
+	}
+}
+
+// DeclaredVideoBitrateMetadata is the video bitrate the publisher's encoder is set to, in bits per second
+func DeclaredVideoBitrateMetadata(bps int) Metadata {
+	return func(s *Stream) {
+		s.declaredVideoBps = bps
+	}
+}
+
+// DeclaredAudioBitrateMetadata is the audio bitrate the publisher's encoder is set to, in bits per second
+func DeclaredAudioBitrateMetadata(bps int) Metadata {
+	return func(s *Stream) {
+		s.declaredAudioBps = bps
+	}
+}
+
+// EncoderMetadata is the encoder software as the publisher names it, eg: obs-output module (libobs version 29.1.3)
+func EncoderMetadata(encoder string) Metadata {
+	return func(s *Stream) {
+		s.encoder = encoder
+	}
+}
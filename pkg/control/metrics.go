@@ -0,0 +1,389 @@
+package control
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/orchestrator"
+	"github.com/Glimesh/waveguide/pkg/service"
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	heartbeatFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_heartbeat_failures_total",
+		Help: "Heartbeat failures by type.",
+	}, []string{"type"})
+	thumbnailDecodeSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "waveguide_thumbnail_decode_seconds",
+		Help: "Time taken to decode a keyframe into a thumbnail.",
+	})
+	serviceRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "waveguide_service_request_seconds",
+		Help: "Latency of calls to the service.",
+	}, []string{"service", "method"})
+	serviceRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_service_request_errors_total",
+		Help: "Failed calls to the service.",
+	}, []string{"service", "method"})
+	orchestratorRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "waveguide_orchestrator_request_seconds",
+		Help: "Latency of calls to the orchestrator.",
+	}, []string{"orchestrator", "method"})
+	orchestratorRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_orchestrator_request_errors_total",
+		Help: "Failed calls to the orchestrator.",
+	}, []string{"orchestrator", "method"})
+	keyframeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_keyframe_requests_total",
+		Help: "Viewer keyframe requests by what happened to them.",
+	}, []string{"result"})
+	authRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_auth_rejections_total",
+		Help: "Publishers rejected by input type and reason.",
+	}, []string{"input", "reason"})
+	accessDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_access_denied_total",
+		Help: "Connections refused by the access lists, by role and input or output type.",
+	}, []string{"role", "type"})
+	takeovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "waveguide_stream_takeovers_total",
+		Help: "Live streams handed to a new publisher that kicked the old one.",
+	})
+	bframeStreams = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_bframe_streams_total",
+		Help: "Publishers caught sending B-frames, by the b-frame policy applied to them.",
+	}, []string{"policy"})
+	capacityRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_capacity_rejections_total",
+		Help: "Publishers and viewers turned away by the limit they hit.",
+	}, []string{"limit"})
+	trackPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_track_packets_total",
+		Help: "RTP packets received on this node by track type and codec.",
+	}, []string{"type", "codec"})
+	trackBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "waveguide_track_bytes_total",
+		Help: "RTP bytes received on this node by track type and codec.",
+	}, []string{"type", "codec"})
+)
+
+// maxSequenceGap is the largest jump in sequence numbers counted as loss, anything
+// bigger is treated as the publisher restarting its sequence
+const maxSequenceGap = 1000
+
+// trackStats is shared by every copy of a StreamTrack
+type trackStats struct {
+	packets uint64
+	bytes   uint64
+	// nodePackets and nodeBytes are the node totals for the track's type and codec,
+	// looked up once so the hot path doesn't go through the label map
+	nodePackets prometheus.Counter
+	nodeBytes   prometheus.Counter
+	// lost is the number of packets still missing, it goes down when one arrives late
+	lost uint64
+
+	// seqMu guards the sequence tracking, tracks are usually only written from one goroutine
+	seqMu   sync.Mutex
+	hasSeq  bool
+	lastSeq uint16
+	// missing has a bit set for each sequence number skipped in the last half of
+	// the sequence space, so only those are taken off lost when they turn up
+	missing [1 << 16 / 64]uint64
+}
+
+func newTrackStats(kind webrtc.RTPCodecType, codec string) *trackStats {
+	return &trackStats{
+		nodePackets: trackPackets.WithLabelValues(kind.String(), codec),
+		nodeBytes:   trackBytes.WithLabelValues(kind.String(), codec),
+	}
+}
+
+func (t *trackStats) add(p *rtp.Packet) {
+	size := uint64(p.MarshalSize())
+	atomic.AddUint64(&t.packets, 1)
+	atomic.AddUint64(&t.bytes, size)
+	t.nodePackets.Inc()
+	t.nodeBytes.Add(float64(size))
+
+	t.seqMu.Lock()
+	defer t.seqMu.Unlock()
+
+	if !t.hasSeq {
+		t.hasSeq = true
+		t.lastSeq = p.SequenceNumber
+		return
+	}
+
+	// uint16 arithmetic handles the sequence number wrapping around
+	gap := p.SequenceNumber - t.lastSeq
+	switch {
+	case gap == 0:
+		return
+	case gap >= 0x8000:
+		// Reordered or duplicate packet, it's only found if it was skipped over
+		if t.isMissing(p.SequenceNumber) {
+			t.setMissing(p.SequenceNumber, false)
+			atomic.AddUint64(&t.lost, ^uint64(0))
+		}
+		return
+	case gap <= maxSequenceGap:
+		for seq := t.lastSeq + 1; seq != p.SequenceNumber+1; seq++ {
+			// Packets skipped half the sequence space ago stay lost
+			t.setMissing(seq-0x8000, false)
+			t.setMissing(seq, seq != p.SequenceNumber)
+		}
+		atomic.AddUint64(&t.lost, uint64(gap-1))
+	default:
+		t.missing = [len(t.missing)]uint64{}
+	}
+	t.lastSeq = p.SequenceNumber
+}
+
+func (t *trackStats) isMissing(seq uint16) bool {
+	return t.missing[seq/64]&(1<<(seq%64)) != 0
+}
+
+func (t *trackStats) setMissing(seq uint16, missing bool) {
+	if missing {
+		t.missing[seq/64] |= 1 << (seq % 64)
+	} else {
+		t.missing[seq/64] &^= 1 << (seq % 64)
+	}
+}
+
+func (t *trackStats) Packets() uint64 {
+	return atomic.LoadUint64(&t.packets)
+}
+
+func (t *trackStats) Bytes() uint64 {
+	return atomic.LoadUint64(&t.bytes)
+}
+
+func (t *trackStats) Lost() uint64 {
+	return atomic.LoadUint64(&t.lost)
+}
+
+// received is the packets and bytes the publisher sent of the track type, when an input
+// transcodes it keeps the original as a local track and that's what's counted, eg: AAC
+func received(tracks []StreamTrack, kind webrtc.RTPCodecType) (packets, bytes int) {
+	original := false
+	for _, track := range tracks {
+		original = original || track.Type == kind && track.Local
+	}
+	for _, track := range tracks {
+		if track.Type == kind && track.Local == original {
+			packets += int(track.stats.Packets())
+			bytes += int(track.stats.Bytes())
+		}
+	}
+	return packets, bytes
+}
+
+// lostPackets is the number of packets missing from the sequence of every stream track
+func (s *Stream) lostPackets() int {
+	var total uint64
+	for _, track := range s.Tracks() {
+		total += track.stats.Lost()
+	}
+	return int(total)
+}
+
+var (
+	streamsDesc = prometheus.NewDesc(
+		"waveguide_streams",
+		"Streams on this node by input type and state.",
+		[]string{"input_type", "state"}, nil,
+	)
+	viewersDesc = prometheus.NewDesc(
+		"waveguide_viewers",
+		"Output peers watching the streams on this node.",
+		nil, nil,
+	)
+	lostDesc = prometheus.NewDesc(
+		"waveguide_track_lost_packets",
+		"RTP packets still missing from the sequence of the live tracks on this node by track type and codec, late packets are taken off.",
+		[]string{"type", "codec"}, nil,
+	)
+)
+
+// streamCollector computes the stream gauges from the registry at scrape time. Only
+// node totals are exported, the per channel detail is in /admin/streams.
+type streamCollector struct {
+	ctrl *Control
+}
+
+func (c streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- streamsDesc
+	ch <- viewersDesc
+	ch <- lostDesc
+}
+
+func (c streamCollector) Collect(ch chan<- prometheus.Metric) {
+	streams := make(map[[2]string]int)
+	lost := make(map[[2]string]uint64)
+	viewers := 0
+	for _, stream := range c.ctrl.streams.all() {
+		info := stream.Info()
+		streams[[2]string{info.InputType, info.State}]++
+		viewers += info.Viewers
+
+		for _, track := range stream.Tracks() {
+			lost[[2]string{track.Type.String(), track.Codec}] += track.stats.Lost()
+		}
+	}
+
+	for key, count := range streams {
+		ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+	ch <- prometheus.MustNewConstMetric(viewersDesc, prometheus.GaugeValue, float64(viewers))
+	for key, count := range lost {
+		ch <- prometheus.MustNewConstMetric(lostDesc, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+}
+
+func observeRequest(latency *prometheus.HistogramVec, errs *prometheus.CounterVec, name, method string, start time.Time, err error) {
+	latency.WithLabelValues(name, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errs.WithLabelValues(name, method).Inc()
+	}
+}
+
+// instrumentedService records the latency and errors of every remote service call
+type instrumentedService struct {
+	service.Service
+}
+
+func (s instrumentedService) observe(method string, start time.Time, err error) {
+	observeRequest(serviceRequestSeconds, serviceRequestErrors, s.Name(), method, start, err)
+}
+
+func (s instrumentedService) GetHmacKey(channelID types.ChannelID) ([]byte, error) {
+	start := time.Now()
+	key, err := s.Service.GetHmacKey(channelID)
+	s.observe("get_hmac_key", start, err)
+	return key, err
+}
+
+// GetPlaybackPolicy is only asked of services that implement it, others return an empty policy
+func (s instrumentedService) GetPlaybackPolicy(channelID types.ChannelID) (types.PlaybackPolicy, error) {
+	provider, ok := s.Service.(service.PlaybackPolicyService)
+	if !ok {
+		return "", nil
+	}
+
+	start := time.Now()
+	policy, err := provider.GetPlaybackPolicy(channelID)
+	s.observe("get_playback_policy", start, err)
+	return policy, err
+}
+
+// WarnStream is only asked of services that implement it, others can't reach the streamer
+func (s instrumentedService) WarnStream(channelID types.ChannelID, streamID types.StreamID, message string) error {
+	warner, ok := s.Service.(service.StreamWarningService)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := warner.WarnStream(channelID, streamID, message)
+	s.observe("warn_stream", start, err)
+	return err
+}
+
+// CheckStream is only asked of services that implement it, others never end streams
+func (s instrumentedService) CheckStream(channelID types.ChannelID, streamID types.StreamID) (string, error) {
+	checker, ok := s.Service.(service.StreamCheckService)
+	if !ok {
+		return "", nil
+	}
+
+	start := time.Now()
+	reason, err := checker.CheckStream(channelID, streamID)
+	s.observe("check_stream", start, err)
+	return reason, err
+}
+
+func (s instrumentedService) StartStream(channelID types.ChannelID) (types.StreamID, error) {
+	start := time.Now()
+	streamID, err := s.Service.StartStream(channelID)
+	s.observe("start_stream", start, err)
+	return streamID, err
+}
+
+func (s instrumentedService) EndStream(streamID types.StreamID) error {
+	start := time.Now()
+	err := s.Service.EndStream(streamID)
+	s.observe("end_stream", start, err)
+	return err
+}
+
+func (s instrumentedService) UpdateStreamMetadata(streamID types.StreamID, metadata types.StreamMetadata) error {
+	start := time.Now()
+	err := s.Service.UpdateStreamMetadata(streamID, metadata)
+	s.observe("update_stream_metadata", start, err)
+	return err
+}
+
+func (s instrumentedService) SendJpegPreviewImage(streamID types.StreamID, img []byte) error {
+	start := time.Now()
+	err := s.Service.SendJpegPreviewImage(streamID, img)
+	s.observe("send_jpeg_preview_image", start, err)
+	return err
+}
+
+// instrumentedOrchestrator records the latency and errors of every orchestrator call
+type instrumentedOrchestrator struct {
+	orchestrator.Orchestrator
+}
+
+func (o instrumentedOrchestrator) observe(method string, start time.Time, err error) {
+	observeRequest(orchestratorRequestSeconds, orchestratorRequestErrors, o.Name(), method, start, err)
+}
+
+func (o instrumentedOrchestrator) StartStream(channelID types.ChannelID, streamID types.StreamID) error {
+	start := time.Now()
+	err := o.Orchestrator.StartStream(channelID, streamID)
+	o.observe("start_stream", start, err)
+	return err
+}
+
+func (o instrumentedOrchestrator) StopStream(channelID types.ChannelID, streamID types.StreamID) error {
+	start := time.Now()
+	err := o.Orchestrator.StopStream(channelID, streamID)
+	o.observe("stop_stream", start, err)
+	return err
+}
+
+func (o instrumentedOrchestrator) Heartbeat(channelID types.ChannelID) error {
+	start := time.Now()
+	err := o.Orchestrator.Heartbeat(channelID)
+	o.observe("heartbeat", start, err)
+	return err
+}
+
+// ReportCapacity is only sent to orchestrators that implement it
+func (o instrumentedOrchestrator) ReportCapacity(capacity types.NodeCapacity) error {
+	reporter, ok := o.Orchestrator.(orchestrator.CapacityReporter)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := reporter.ReportCapacity(capacity)
+	o.observe("report_capacity", start, err)
+	return err
+}
+
+func (o instrumentedOrchestrator) Drain() error {
+	start := time.Now()
+	err := o.Orchestrator.Drain()
+	o.observe("drain", start, err)
+	return err
+}
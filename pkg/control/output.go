@@ -1,14 +1,12 @@
 package control
 
 import (
-	"context"
-
-	"github.com/sirupsen/logrus"
+	"github.com/Glimesh/waveguide/pkg/registry"
 )
 
 type Output interface {
-	SetControl(ctrl *Control)
-	SetLogger(log logrus.FieldLogger)
-
-	Listen(ctx context.Context)
+	Listener
 }
+
+// OutputTypes holds every output that can be picked with `type` in [[output.sources]]
+var OutputTypes = registry.New[Output]("output")
@@ -0,0 +1,175 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/keyframer"
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type StreamState int
+
+const (
+	// StreamStateAuthenticating is set while the service is starting the stream
+	StreamStateAuthenticating StreamState = iota
+	// StreamStateLive is set once the service and orchestrator know about the stream
+	StreamStateLive
+	// StreamStateReconnecting is set while the stream waits for a dropped publisher to come back
+	StreamStateReconnecting
+	// StreamStateStopping is set as soon as anyone asks for the stream to stop
+	StreamStateStopping
+	// StreamStateStopped is set once the stream has been ended everywhere and removed from state
+	StreamStateStopped
+)
+
+func (state StreamState) String() string {
+	switch state {
+	case StreamStateAuthenticating:
+		return "authenticating"
+	case StreamStateLive:
+		return "live"
+	case StreamStateReconnecting:
+		return "reconnecting"
+	case StreamStateStopping:
+		return "stopping"
+	case StreamStateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+var (
+	ErrStreamExists  = errors.New("stream already exists in stream manager state")
+	ErrStreamStopped = errors.New("stream was stopped while starting")
+	errStreamRemoved = errors.New("stream does not exist in state")
+)
+
+// streamRegistry is the only place streams are added to or removed from, it's
+// safe to use from any input, output or control goroutine.
+type streamRegistry struct {
+	mu      sync.RWMutex
+	streams map[types.ChannelID]*Stream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		streams: make(map[types.ChannelID]*Stream),
+	}
+}
+
+// add registers the stream, unless the channel already has a stream that hasn't been
+// removed yet or there are already max streams. Max is unlimited when zero.
+func (r *streamRegistry) add(stream *Stream, max int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.streams[stream.ChannelID]; exists {
+		return ErrStreamExists
+	}
+	if max > 0 && len(r.streams) >= max {
+		return fmt.Errorf("%w: max_publishers=%d", ErrAtCapacity, max)
+	}
+	r.streams[stream.ChannelID] = stream
+
+	return nil
+}
+
+// remove only removes the exact stream given, so a newer stream on the same channel is left alone
+func (r *streamRegistry) remove(stream *Stream) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current, exists := r.streams[stream.ChannelID]; !exists || current != stream {
+		return errors.New("RemoveStream stream does not exist in state")
+	}
+	delete(r.streams, stream.ChannelID)
+
+	return nil
+}
+
+func (r *streamRegistry) get(id types.ChannelID) (*Stream, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stream, exists := r.streams[id]
+	if !exists {
+		return nil, errStreamRemoved
+	}
+	return stream, nil
+}
+
+func (r *streamRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.streams)
+}
+
+func (r *streamRegistry) all() []*Stream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	streams := make([]*Stream, 0, len(r.streams))
+	for _, stream := range r.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (ctrl *Control) newStream(channelID types.ChannelID, cancelFunc context.CancelFunc) (*Stream, error) {
+	stream := &Stream{ //nolint exhaustive struct
+		ChannelID: channelID,
+
+		log:           ctrl.log.WithField("channel_id", channelID),
+		authenticated: true,
+		state:         StreamStateAuthenticating,
+
+		cancelFunc:        cancelFunc,
+		bus:               newMediaBus(ctrl.GOPCacheSize),
+		kf:                keyframer.New(),
+		thumbnails:        newThumbnailCache(),
+		stopHeartbeat:     make(chan struct{}),
+		sources:           make(map[webrtc.TrackLocal]int),
+		viewers:           make(map[string]struct{}),
+		stopThumbnailer:   make(chan struct{}, 1),
+		thumbnailReceiver: make(chan *rtp.Packet, 50),
+		requestThumbnail:  make(chan struct{}, 1),
+
+		lastThumbnail: make(chan []byte, 1),
+
+		startTime: time.Now().Unix(),
+
+		bitrateLimit: ctrl.MaxStreamBitrate,
+	}
+
+	// TODO: this shouldn't be a global flag
+	// but rather configured on per stream basis
+	if ctrl.SaveVideo {
+		stream.saveVideo = true
+		stream.videoWriterChan = make(chan *rtp.Packet, 100) // not sure what the buffer size here should be
+	}
+
+	if err := ctrl.streams.add(stream, ctrl.MaxPublishers); err != nil {
+		if errors.Is(err, ErrAtCapacity) {
+			capacityRejections.WithLabelValues("max_publishers").Inc()
+		}
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (ctrl *Control) removeStream(stream *Stream) error {
+	return ctrl.streams.remove(stream)
+}
+
+func (ctrl *Control) getStream(id types.ChannelID) (*Stream, error) {
+	return ctrl.streams.get(id)
+}
@@ -0,0 +1,77 @@
+package control
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtpRewriter keeps the sequence numbers and timestamps of a track continuous
+// when a reconnected publisher takes over, so viewers never notice the switch.
+type rtpRewriter struct {
+	mu        sync.Mutex
+	clockRate uint32
+
+	source    webrtc.TrackLocal
+	seqOffset uint16
+	tsOffset  uint32
+	ssrc      uint32
+
+	started       bool
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastWrite     time.Time
+}
+
+func newRTPRewriter(track webrtc.TrackLocal, codec string) *rtpRewriter {
+	clockRate := uint32(90000)
+	if codec == webrtc.MimeTypeOpus {
+		clockRate = 48000
+	}
+	if static, ok := track.(*webrtc.TrackLocalStaticRTP); ok && static.Codec().ClockRate != 0 {
+		clockRate = static.Codec().ClockRate
+	}
+
+	return &rtpRewriter{clockRate: clockRate}
+}
+
+// rewrite returns the packet as it should be sent to viewers, the given packet
+// is never modified since the input may still be using it.
+func (r *rtpRewriter) rewrite(source webrtc.TrackLocal, p *rtp.Packet) *rtp.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if !r.started {
+		r.started = true
+		r.source = source
+		r.ssrc = p.SSRC
+	} else if source != r.source {
+		// Continue from where the last publisher left off, keeping the wall clock gap
+		// between them so players don't try to catch up
+		elapsed := uint32(now.Sub(r.lastWrite).Seconds()*float64(r.clockRate)) + 1
+		r.source = source
+		r.seqOffset = r.lastSeq + 1 - p.SequenceNumber
+		r.tsOffset = r.lastTimestamp + elapsed - p.Timestamp
+	}
+
+	out := p
+	if r.seqOffset != 0 || r.tsOffset != 0 || p.SSRC != r.ssrc {
+		rewritten := *p
+		rewritten.SequenceNumber += r.seqOffset
+		rewritten.Timestamp += r.tsOffset
+		rewritten.SSRC = r.ssrc
+		out = &rewritten
+	}
+
+	// Only move forward, reordered packets shouldn't drag the offsets backwards
+	if r.lastWrite.IsZero() || out.SequenceNumber-r.lastSeq < 0x8000 {
+		r.lastSeq = out.SequenceNumber
+		r.lastTimestamp = out.Timestamp
+	}
+	r.lastWrite = now
+
+	return out
+}
@@ -3,7 +3,10 @@ package control
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
 
+	"github.com/Glimesh/waveguide/pkg/auth"
 	"github.com/Glimesh/waveguide/pkg/keyframer"
 	"github.com/Glimesh/waveguide/pkg/types"
 
@@ -12,22 +15,68 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// StopReason explains why a stream was ended
+type StopReason string
+
+const (
+	StopReasonPublisher StopReason = "publisher_disconnected"
+	StopReasonAdmin     StopReason = "admin"
+	StopReasonHeartbeat StopReason = "heartbeat_failed"
+	StopReasonShutdown  StopReason = "shutdown"
+	StopReasonError     StopReason = "error"
+	// StopReasonDrain is used for streams still running when the drain timeout is up
+	StopReasonDrain StopReason = "drain_timeout"
+	// StopReasonReconnectTimeout is used when the publisher didn't come back within the reconnect grace period
+	StopReasonReconnectTimeout StopReason = "reconnect_timeout"
+	// StopReasonBitrate is used when the publisher goes over the max bitrate it was granted
+	StopReasonBitrate StopReason = "bitrate_exceeded"
+	// StopReasonRevoked is used when the service says the stream can't go on, eg: the channel was banned
+	StopReasonRevoked StopReason = "revoked"
+	// StopReasonTakeover is only given to the disconnect of a publisher replaced by
+	// another one, the stream itself goes on. Inputs must not stop the stream for it.
+	StopReasonTakeover StopReason = "takeover"
+	// StopReasonBFrames is used when the publisher sends B-frames on a channel that rejects them
+	StopReasonBFrames StopReason = "bframes_rejected"
+	// StopReasonUnsupportedCodec is used when the publisher sends media WebRTC viewers can't play
+	StopReasonUnsupportedCodec StopReason = "unsupported_codec"
+)
+
+// DisconnectFunc is provided by inputs so Control can force the publisher off the server
+type DisconnectFunc func(reason StopReason)
+
 type StreamTrack struct {
 	Type  webrtc.RTPCodecType
 	Codec string
 	Track webrtc.TrackLocal
+	// Local tracks are only for local consumers like HLS and recording, WebRTC viewers can't play them
+	Local bool
+
+	stats    *trackStats
+	rewriter *rtpRewriter
 }
 
 type Stream struct {
 	log logrus.FieldLogger
 
+	// mu guards the stream state, tracks and metadata which are touched by
+	// inputs, outputs and the heartbeat from their own goroutines
+	mu    sync.RWMutex
+	state StreamState
+
 	cancelFunc context.CancelFunc
+	stopOnce   sync.Once
 	stopped    bool
 
 	// authenticated is set after the stream has successfully authed with a remote service
 	authenticated bool
 
-	whepURI string
+	// disconnect is set by the input to kick the publisher
+	disconnect DisconnectFunc
+
+	// requestKeyframe is set by inputs that can ask the publisher for a keyframe
+	requestKeyframe      KeyframeRequestFunc
+	lastKeyframeRequest  time.Time
+	pendingKeyframeTimer *time.Timer
 
 	saveVideo   bool
 	videoWriter FileWriter
@@ -37,8 +86,11 @@ type Stream struct {
 	hasSomeAudio bool
 	hasSomeVideo bool
 
+	// bus fans out the packets written to the stream tracks to local consumers
+	bus *mediaBus
+
 	kf            *keyframer.Keyframer
-	rtpIngest     chan *rtp.Packet
+	thumbnails    *thumbnailCache
 	lastThumbnail chan []byte
 	// channel used to signal thumbnailer to stop
 	stopThumbnailer   chan struct{}
@@ -53,46 +105,229 @@ type Stream struct {
 	StreamKey types.StreamKey
 
 	tracks []StreamTrack
+	// sources maps the tracks the current publisher writes to onto the index of
+	// the stream track, a resumed publisher brings its own tracks which are
+	// aliased onto the ones viewers are already watching.
+	sources map[webrtc.TrackLocal]int
+
+	// reconnects is the number of times a publisher resumed this stream
+	reconnects     int
+	reconnectTimer *time.Timer
+
+	// viewers are the output peers currently watching the stream
+	viewers map[string]struct{}
+
+	// maxBitrate comes from the publisher's auth grant, zero is unlimited
+	maxBitrate int
+	// bitrateLimit is the node's max_stream_bitrate, the lower of the two applies
+	bitrateLimit int
 
 	// Raw Metadata
+	inputType           string
 	startTime           int64
 	lastTime            int64 // Last time the metadata collector ran
 	audioBps            int
 	videoBps            int
-	totalAudioPackets   int
-	totalVideoPackets   int
-	lastAudioPackets    int
-	lastVideoPackets    int
+	lastAudioBytes      int
+	lastVideoBytes      int
+	totalNackPackets    int
+	sourcePing          *int
 	clientVendorName    string
 	clientVendorVersion string
 	videoCodec          string
 	audioCodec          string
 	videoHeight         int
 	videoWidth          int
+	videoBFrames        bool
+	videoFramerate      float64
+	declaredVideoBps    int
+	declaredAudioBps    int
+	encoder             string
 }
 
 func (s *Stream) AddTrack(track webrtc.TrackLocal, codec string) error {
+	return s.addTrack(track, codec, false)
+}
+
+// AddLocalTrack adds a track only local consumers get, eg: the original audio
+// of a publisher kept alongside the transcode for viewers
+func (s *Stream) AddLocalTrack(track webrtc.TrackLocal, codec string) error {
+	return s.addTrack(track, codec, true)
+}
+
+func (s *Stream) addTrack(track webrtc.TrackLocal, codec string, local bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reconnects > 0 {
+		for i, existing := range s.tracks {
+			if existing.Type == track.Kind() && existing.Codec == codec {
+				s.sources[track] = i
+				return nil
+			}
+		}
+		s.log.Warnf("Resumed publisher added a new %s track, existing viewers will not receive it", codec)
+	}
+
 	// TODO: Needs better support for tracks with different codecs
-	if track.Kind() == webrtc.RTPCodecTypeAudio {
+	if track.Kind() != webrtc.RTPCodecTypeAudio && track.Kind() != webrtc.RTPCodecTypeVideo {
+		return errors.New("unexpected track kind")
+	}
+	// The codecs reported for the stream are what viewers get
+	if !local && track.Kind() == webrtc.RTPCodecTypeAudio {
 		s.hasSomeAudio = true
 		s.audioCodec = codec
-	} else if track.Kind() == webrtc.RTPCodecTypeVideo {
+	} else if !local {
 		s.hasSomeVideo = true
 		s.videoCodec = codec
-	} else {
-		return errors.New("unexpected track kind")
 	}
 
 	s.tracks = append(s.tracks, StreamTrack{
-		Type:  track.Kind(),
-		Track: track,
-		Codec: codec,
+		Type:     track.Kind(),
+		Track:    track,
+		Codec:    codec,
+		Local:    local,
+		stats:    newTrackStats(track.Kind(), codec),
+		rewriter: newRTPRewriter(track, codec),
 	})
+	s.sources[track] = len(s.tracks) - 1
 
 	return nil
 }
 
+// keepVideoLocal stops sending the video to WebRTC viewers, for video only
+// local consumers can play, the viewers already watching keep the audio
+func (s *Stream) keepVideoLocal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.tracks {
+		if s.tracks[i].Type == webrtc.RTPCodecTypeVideo {
+			s.tracks[i].Local = true
+		}
+	}
+	s.bus.resetGOPs()
+}
+
+// WriteRTP writes the packet to the given track for viewers, and publishes it to any local subscribers
+func (s *Stream) WriteRTP(track webrtc.TrackLocal, p *rtp.Packet) error {
+	s.mu.RLock()
+	var streamTrack StreamTrack
+	index, ok := s.sources[track]
+	if ok {
+		streamTrack = s.tracks[index]
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		return errors.New("track is not a source of the stream")
+	}
+
+	p = streamTrack.rewriter.rewrite(track, p)
+
+	if writer, ok := streamTrack.Track.(rtpWriter); ok {
+		if err := writer.WriteRTP(p); err != nil {
+			return err
+		}
+	}
+
+	streamTrack.stats.add(p)
+	s.bus.publish(streamTrack.Type, streamTrack.Codec, streamTrack.Local, p)
+
+	return nil
+}
+
+// RequestThumbnail asks the thumbnailer for the next keyframe, the result ends up in the thumbnail cache
+func (s *Stream) RequestThumbnail() {
+	select {
+	case s.requestThumbnail <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe to the packets of all the stream tracks, the subscription is closed when the stream stops
+func (s *Stream) Subscribe(name string, opts ...SubscribeOption) *Subscription {
+	return s.bus.subscribe(name, opts...)
+}
+
+type rtpWriter interface {
+	WriteRTP(p *rtp.Packet) error
+}
+
+// SetDisconnect registers the input specific way of kicking the publisher
+func (s *Stream) SetDisconnect(fn DisconnectFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disconnect = fn
+}
+
+// ApplyGrant limits the stream to what the publisher was authenticated for
+func (s *Stream) ApplyGrant(grant auth.Grant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxBitrate = grant.MaxBitrate
+}
+
+// exceedsMaxBitrate returns the bitrate from the last metadata collection and the
+// max bitrate, the max is only returned when the stream is over it
+func (s *Stream) exceedsMaxBitrate() (int, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	max := s.maxBitrate
+	if s.bitrateLimit > 0 && (max == 0 || s.bitrateLimit < max) {
+		max = s.bitrateLimit
+	}
+
+	bitrate := s.audioBps + s.videoBps
+	if max == 0 || bitrate <= max {
+		return bitrate, 0
+	}
+	return bitrate, max
+}
+
+func (s *Stream) Viewers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.viewers)
+}
+
+func (s *Stream) addViewer(viewerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.viewers[viewerID] = struct{}{}
+}
+
+// removeViewer returns false if the viewer was already removed
+func (s *Stream) removeViewer(viewerID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.viewers[viewerID]; !ok {
+		return false
+	}
+	delete(s.viewers, viewerID)
+	return true
+}
+
+// Tracks returns a copy of the tracks added to the stream so far
+func (s *Stream) Tracks() []StreamTrack {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tracks := make([]StreamTrack, len(s.tracks))
+	copy(tracks, s.tracks)
+	return tracks
+}
+
 func (s *Stream) ReportMetadata(metadatas ...Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, metadata := range metadatas {
 		metadata(s)
 	}
@@ -100,18 +335,132 @@ func (s *Stream) ReportMetadata(metadatas ...Metadata) error {
 	return nil
 }
 
+// Stop cancels the stream context and closes every local consumer, only the first call does anything
 func (s *Stream) Stop() {
-	s.log.Infof("stopping stream")
+	s.stopOnce.Do(func() {
+		s.log.Infof("stopping stream")
+
+		close(s.stopHeartbeat)
+
+		s.mu.Lock()
+		if s.reconnectTimer != nil {
+			s.reconnectTimer.Stop()
+		}
+		if s.pendingKeyframeTimer != nil {
+			s.pendingKeyframeTimer.Stop()
+		}
+		s.mu.Unlock()
 
-	s.stopHeartbeat <- struct{}{} // not being used anywhere, is it really needed?
+		s.cancelFunc()
+		s.bus.close()
 
-	s.cancelFunc()
-	s.stopped = true
-	s.log.Debug("sent stop thumbnailer signal")
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
 
-	s.log.Debug("canceled stream ctx")
+		s.log.Debug("canceled stream ctx")
+	})
 }
 
 func (s *Stream) Stopped() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.stopped
 }
+
+func (s *Stream) State() StreamState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state
+}
+
+func (s *Stream) setState(state StreamState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+}
+
+// transition moves the stream to the next state if it's currently in one of the
+// allowed states, returning the state it was in before.
+func (s *Stream) transition(next StreamState, from ...StreamState) (StreamState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.state
+	for _, allowed := range from {
+		if previous == allowed {
+			s.state = next
+			return previous, true
+		}
+	}
+	return previous, false
+}
+
+// detachPublisher moves a live stream to reconnecting and forgets the current publisher,
+// its tracks can't write to the stream anymore and onExpire is called if nobody resumes
+// the stream in time.
+func (s *Stream) detachPublisher(grace time.Duration, onExpire func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StreamStateLive {
+		return false
+	}
+
+	s.state = StreamStateReconnecting
+	s.forgetPublisher()
+	s.reconnectTimer = time.AfterFunc(grace, onExpire)
+
+	return true
+}
+
+// takeOver hands a live stream straight to a new publisher, returning how to
+// disconnect the old one
+func (s *Stream) takeOver() (DisconnectFunc, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StreamStateLive {
+		return nil, false
+	}
+
+	disconnect := s.disconnect
+	s.forgetPublisher()
+	s.reconnects++
+
+	return disconnect, true
+}
+
+// forgetPublisher stops the current publisher's tracks writing to the stream, s.mu must be held
+func (s *Stream) forgetPublisher() {
+	s.sources = make(map[webrtc.TrackLocal]int)
+	s.disconnect = nil
+	s.requestKeyframe = nil
+	s.bus.resetGOPs()
+}
+
+// resume hands the stream to a new publisher if it's waiting for one
+func (s *Stream) resume() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StreamStateReconnecting {
+		return false
+	}
+
+	s.state = StreamStateLive
+	s.reconnectTimer.Stop()
+	s.reconnects++
+
+	return true
+}
+
+func (s *Stream) setStreamID(id types.StreamID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.StreamID = id
+}
@@ -0,0 +1,90 @@
+package control
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/types"
+	"github.com/Glimesh/waveguide/pkg/webhook"
+)
+
+// TakeoverPolicy decides what happens when a publisher starts a channel that's already live
+type TakeoverPolicy string
+
+const (
+	// TakeoverReject turns the new publisher away, it's the default
+	TakeoverReject TakeoverPolicy = "reject"
+	// TakeoverKick disconnects the old publisher and hands its tracks to the new one,
+	// viewers stay connected. It's for encoders reconnecting before their old session times out.
+	TakeoverKick TakeoverPolicy = "takeover"
+)
+
+func parseTakeoverPolicy(policy string) (TakeoverPolicy, error) {
+	switch TakeoverPolicy(policy) {
+	case "", TakeoverReject:
+		return TakeoverReject, nil
+	case TakeoverKick:
+		return TakeoverKick, nil
+	}
+	return "", fmt.Errorf("unknown takeover policy %s, expected reject or takeover", policy)
+}
+
+// parseTakeoverPolicies reads the node's takeover policy and its per channel overrides
+func parseTakeoverPolicies(cfg config.Config) (TakeoverPolicy, map[types.ChannelID]TakeoverPolicy, error) {
+	policy, err := parseTakeoverPolicy(cfg.Control.TakeoverPolicy)
+	if err != nil {
+		return "", nil, fmt.Errorf("control.takeover_policy: %w", err)
+	}
+
+	channels := make(map[types.ChannelID]TakeoverPolicy, len(cfg.Control.ChannelTakeoverPolicies))
+	for channelID, channelPolicy := range cfg.Control.ChannelTakeoverPolicies {
+		id, err := strconv.ParseUint(channelID, 10, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("control.channel_takeover_policies: %s is not a channel ID", channelID)
+		}
+		if channels[types.ChannelID(id)], err = parseTakeoverPolicy(channelPolicy); err != nil {
+			return "", nil, fmt.Errorf("control.channel_takeover_policies: %w", err)
+		}
+	}
+
+	return policy, channels, nil
+}
+
+// Validate checks the [control] config
+func Validate(cfg config.Config) error {
+	if _, _, err := parseTakeoverPolicies(cfg); err != nil {
+		return err
+	}
+	_, _, err := parseBFramePolicies(cfg)
+	return err
+}
+
+func (ctrl *Control) takeoverPolicy(channelID types.ChannelID) TakeoverPolicy {
+	if policy, ok := ctrl.channelTakeoverPolicies[channelID]; ok {
+		return policy
+	}
+	return ctrl.TakeoverPolicy
+}
+
+// takeOver hands a live stream to a new publisher if the channel's policy allows it,
+// the old publisher is disconnected with StopReasonTakeover
+func (ctrl *Control) takeOver(stream *Stream) bool {
+	if ctrl.takeoverPolicy(stream.ChannelID) != TakeoverKick {
+		return false
+	}
+
+	disconnect, ok := stream.takeOver()
+	if !ok {
+		return false
+	}
+
+	stream.log.Info("New publisher took over the stream, disconnecting the old one")
+	takeovers.Inc()
+	ctrl.webhooks.Send(webhook.EventStreamTakenOver, stream.ChannelID, stream.StreamID, nil)
+
+	if disconnect != nil {
+		disconnect(StopReasonTakeover)
+	}
+	return true
+}
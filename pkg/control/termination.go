@@ -0,0 +1,56 @@
+package control
+
+import (
+	"github.com/Glimesh/waveguide/pkg/service"
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// checkStream asks the service whether the stream can go on, and terminates it
+// when it can't. It returns true when the stream was terminated.
+func (ctrl *Control) checkStream(stream *Stream) (bool, error) {
+	checker, ok := ctrl.service.(service.StreamCheckService)
+	if !ok {
+		return false, nil
+	}
+
+	reason, err := checker.CheckStream(stream.ChannelID, stream.StreamID)
+	if err != nil || reason == "" {
+		return false, err
+	}
+
+	ctrl.revokeStream(stream, reason)
+	return true, nil
+}
+
+// watchTerminations ends the streams the service pushes, until the service closes the channel
+func (ctrl *Control) watchTerminations(terminations <-chan types.Termination) {
+	for {
+		select {
+		case t, ok := <-terminations:
+			if !ok {
+				return
+			}
+
+			stream, err := ctrl.getStream(t.ChannelID)
+			if err != nil {
+				continue
+			}
+			// The channel could have started a new stream since
+			if t.StreamID != 0 && t.StreamID != stream.StreamID {
+				stream.log.Debugf("Ignoring termination of old stream_id=%d", t.StreamID)
+				continue
+			}
+			ctrl.revokeStream(stream, t.Reason)
+
+		case <-ctrl.ctx.Done():
+			return
+		}
+	}
+}
+
+func (ctrl *Control) revokeStream(stream *Stream, reason string) {
+	stream.log.Warnf("Service ended the stream: %s", reason)
+	if err := ctrl.TerminateStream(stream.ChannelID, StopReasonRevoked); err != nil {
+		stream.log.Error(err)
+	}
+}
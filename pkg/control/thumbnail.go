@@ -1,9 +1,17 @@
 package control
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"sync"
 	"time"
 
 	"github.com/pion/rtp"
+	"golang.org/x/image/draw"
 )
 
 func (s *Stream) thumbnailer(done chan struct{}) {
@@ -57,3 +65,159 @@ OUTER:
 	}
 	s.log.Debug("ending thumbnailer")
 }
+
+// thumbnailWidths are the sizes thumbnails are scaled down to, requested widths are
+// rounded up to one of them so only a few variants are ever encoded
+var thumbnailWidths = []int{160, 320, 640}
+
+// thumbnailRefreshInterval is how often ?refresh can ask a stream for a new keyframe
+const thumbnailRefreshInterval = 5 * time.Second
+
+var errNoThumbnail = errors.New("no thumbnail has been decoded yet")
+
+type thumbnailKey struct {
+	format string
+	width  int
+}
+
+// thumbnailCache holds the latest decoded thumbnail, along with every size and
+// format that has been requested for it
+type thumbnailCache struct {
+	mu       sync.RWMutex
+	img      image.Image
+	updated  time.Time
+	uploaded time.Time
+	encoded  map[thumbnailKey][]byte
+	// changed is closed and replaced every time a new thumbnail is set
+	changed chan struct{}
+	// refreshed is when a refresh was last requested
+	refreshed time.Time
+}
+
+func newThumbnailCache() *thumbnailCache {
+	return &thumbnailCache{
+		encoded: make(map[thumbnailKey][]byte),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *thumbnailCache) set(img image.Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.img = img
+	c.updated = time.Now()
+	c.encoded = make(map[thumbnailKey][]byte)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// next returns a channel that's closed when the next thumbnail is set
+func (c *thumbnailCache) next() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.changed
+}
+
+// refresh returns true if a new keyframe can be requested, at most once every thumbnailRefreshInterval
+func (c *thumbnailCache) refresh() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.refreshed) < thumbnailRefreshInterval {
+		return false
+	}
+	c.refreshed = time.Now()
+	return true
+}
+
+// snapThumbnailWidth rounds the width up to the next of thumbnailWidths, or 0
+// for the source width when it's bigger than all of them
+func snapThumbnailWidth(width int) int {
+	for _, snapped := range thumbnailWidths {
+		if width <= snapped {
+			return snapped
+		}
+	}
+	return 0
+}
+
+// encode returns the thumbnail in the given format, scaled down to width when it's
+// set, and the time the thumbnail was decoded. Callers snap the width first, every
+// width is kept in the cache
+func (c *thumbnailCache) encode(format string, width int) ([]byte, time.Time, error) {
+	c.mu.RLock()
+	img, updated := c.img, c.updated
+	if img == nil {
+		c.mu.RUnlock()
+		return nil, time.Time{}, errNoThumbnail
+	}
+	if width <= 0 || width > img.Bounds().Dx() {
+		width = img.Bounds().Dx()
+	}
+	key := thumbnailKey{format: format, width: width}
+	data, ok := c.encoded[key]
+	c.mu.RUnlock()
+	if ok {
+		return data, updated, nil
+	}
+
+	data, err := encodeThumbnail(img, format, width)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Don't cache against a newer thumbnail that arrived while we were encoding
+	if c.updated.Equal(updated) {
+		c.encoded[key] = data
+	}
+
+	return data, updated, nil
+}
+
+// markUploaded returns true if the thumbnail hasn't been sent to the service yet
+func (c *thumbnailCache) markUploaded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.img == nil || !c.updated.After(c.uploaded) {
+		return false
+	}
+	c.uploaded = c.updated
+	return true
+}
+
+func encodeThumbnail(img image.Image, format string, width int) ([]byte, error) {
+	bounds := img.Bounds()
+	if width < bounds.Dx() {
+		height := bounds.Dy() * width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+
+	buff := new(bytes.Buffer)
+	var err error
+	switch format {
+	case "jpg":
+		err = jpeg.Encode(buff, img, &jpeg.Options{
+			Quality: 75,
+		})
+	case "png":
+		err = png.Encode(buff, img)
+	default:
+		err = fmt.Errorf("unsupported thumbnail format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
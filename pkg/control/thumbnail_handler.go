@@ -0,0 +1,107 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+)
+
+// thumbnailRefreshTimeout is how long ?refresh waits for a new keyframe before serving the cached thumbnail
+const thumbnailRefreshTimeout = 5 * time.Second
+
+var thumbnailContentTypes = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+}
+
+// GET /thumbnail/{channelID}.{jpg,png}?width=320&refresh=1
+// The width is rounded up to 160, 320 or 640, anything wider gets the source size.
+// Viewers are checked like WHEP viewers, with the token in ?token= or the Authorization header
+func (ctrl *Control) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	format := strings.TrimPrefix(path.Ext(name), ".")
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	contentType, ok := thumbnailContentTypes[format]
+	if !ok {
+		http.Error(w, "unsupported format", http.StatusNotFound)
+		return
+	}
+
+	intChannelID, err := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
+	if err != nil {
+		http.Error(w, "invalid channel id", http.StatusBadRequest)
+		return
+	}
+
+	width := 0
+	if value := r.URL.Query().Get("width"); value != "" {
+		width, err = strconv.Atoi(value)
+		if err != nil || width < 1 {
+			http.Error(w, "invalid width", http.StatusBadRequest)
+			return
+		}
+		width = snapThumbnailWidth(width)
+	}
+
+	// Thumbnails of private channels are as private as their video
+	if status, err := ctrl.authorizeViewer(r, types.ChannelID(intChannelID)); err != nil {
+		ctrl.log.Debugf("Thumbnail rejected channel=%d status=%d: %v", intChannelID, status, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	stream, err := ctrl.getStream(types.ChannelID(intChannelID))
+	if err != nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+
+	// Decoding a keyframe is expensive, a stream refreshed moments ago is served from the cache
+	if _, refresh := r.URL.Query()["refresh"]; refresh && stream.thumbnails.refresh() {
+		next := stream.thumbnails.next()
+		stream.RequestThumbnail()
+
+		select {
+		case <-next:
+		case <-time.After(thumbnailRefreshTimeout):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	data, updated, err := stream.thumbnails.encode(format, width)
+	if err != nil {
+		if errors.Is(err, errNoThumbnail) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ctrl.log.Error(err)
+		http.Error(w, "error encoding thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	// Shared caches mustn't hand a token viewer's thumbnail to anyone else
+	cacheControl := "public"
+	if r.Header.Get("Authorization") != "" || r.URL.Query().Has("token") {
+		cacheControl = "private"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", cacheControl, int(ctrl.ThumbnailInterval.Seconds())))
+	http.ServeContent(w, r, name, updated, bytes.NewReader(data))
+}
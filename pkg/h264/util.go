@@ -111,3 +111,83 @@ func WhichKeyframePart(packetPayload []byte) string {
 
 	return fmt.Sprintf("%d - %s ", nalType, "Unknown Type")
 }
+
+// IsBSlice is true for a coded slice NALU, without a start code, that's a B slice.
+// B slices reference frames that come after them, which WebRTC decoders don't expect.
+func IsBSlice(nalu []byte) bool {
+	if len(nalu) < 2 {
+		return false
+	}
+	// nalType 1 = Non IDR slice / nalType 5 = IDR slice
+	nalType := nalu[0] & 0b00011111
+	if nalType != 1 && nalType != 5 {
+		return false
+	}
+
+	// The slice header starts with first_mb_in_slice and slice_type, both Exp-Golomb
+	// coded so they fit in the first few bytes once emulation prevention bytes are removed
+	header := make([]byte, 0, 8)
+	zeros := 0
+	for _, b := range nalu[1:] {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		header = append(header, b)
+		if len(header) == cap(header) {
+			break
+		}
+	}
+
+	r := bitReader{data: header}
+	if _, ok := r.readUE(); !ok {
+		return false
+	}
+	sliceType, ok := r.readUE()
+	// slice_type 1 and 6 are B slices, 6 meaning every slice of the picture is
+	return ok && sliceType%5 == 1
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint32, bool) {
+	if r.pos >= len(r.data)*8 {
+		return 0, false
+	}
+	bit := uint32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, true
+}
+
+// readUE reads an unsigned Exp-Golomb value
+func (r *bitReader) readUE() (uint32, bool) {
+	leadingZeros := 0
+	for {
+		bit, ok := r.readBit()
+		if !ok || leadingZeros > 31 {
+			return 0, false
+		}
+		if bit == 1 {
+			break
+		}
+		leadingZeros++
+	}
+
+	value := uint32(0)
+	for i := 0; i < leadingZeros; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		value = value<<1 | bit
+	}
+	return (1<<leadingZeros - 1) + value, true
+}
@@ -0,0 +1,23 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsBSlice(t *testing.T) {
+	assert := assert.New(t)
+
+	// first_mb_in_slice = 0, slice_type = 1
+	assert.True(IsBSlice([]byte{0x01, 0xa0}))
+	// slice_type = 6, every slice of the picture is a B slice
+	assert.True(IsBSlice([]byte{0x41, 0x9c}))
+	// slice_type = 0, a P slice
+	assert.False(IsBSlice([]byte{0x41, 0xc0}))
+	// An IDR with slice_type = 7
+	assert.False(IsBSlice([]byte{0x65, 0x88, 0x00}))
+	// SPS
+	assert.False(IsBSlice([]byte{0x67, 0xa0}))
+	assert.False(IsBSlice([]byte{0x01}))
+}
@@ -26,13 +26,13 @@ type Callbacks struct {
 
 type Config struct {
 	// RegionCode we are representing
-	RegionCode string
+	RegionCode string `fig:"region_code"`
 	// Hostname for ourselves, so edges know how to reach us
-	Hostname string
+	Hostname string `fig:"hostname"`
 	// Logger for orchestrator client messages
-	Logger logrus.FieldLogger
+	Logger logrus.FieldLogger `fig:"-"`
 	// Handler for callbacks
-	Callbacks Callbacks
+	Callbacks Callbacks `fig:"-"`
 }
 
 func New(config Config, hostname string) *Client {
@@ -76,3 +76,10 @@ func (client *Client) StopStream(channelID types.ChannelID, streamID types.Strea
 func (client *Client) Heartbeat(channelID types.ChannelID) error {
 	return nil
 }
+func (client *Client) Drain() error {
+	return nil
+}
+func (client *Client) ReportCapacity(capacity types.NodeCapacity) error {
+	client.log.Debugf("Capacity publishers=%d/%d viewers=%d/%d", capacity.Publishers, capacity.MaxPublishers, capacity.Viewers, capacity.MaxViewers)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/Glimesh/waveguide/config"
 	"github.com/Glimesh/waveguide/pkg/orchestrator/dummy"
 	"github.com/Glimesh/waveguide/pkg/orchestrator/rt"
+	"github.com/Glimesh/waveguide/pkg/registry"
 	"github.com/Glimesh/waveguide/pkg/types"
 
 	"github.com/sirupsen/logrus"
@@ -25,6 +26,8 @@ type Orchestrator interface {
 	StartStream(channelID types.ChannelID, streamID types.StreamID) error
 	StopStream(channelID types.ChannelID, streamID types.StreamID) error
 	Heartbeat(channelID types.ChannelID) error
+	// Drain tells the orchestrator this node is going away and shouldn't be sent new streams
+	Drain() error
 
 	// TODO: Be less specific to the FTL Orchestrator
 	// SendIntro(message interface{})
@@ -35,25 +38,49 @@ type Orchestrator interface {
 	// SendStreamRelaying(message interface{})
 }
 
-func New(cfg config.Config, hostname string, logger *logrus.Logger) Orchestrator {
-	orCfg := cfg.Orchestrator
+// CapacityReporter is implemented by orchestrators that route streams and viewers
+// by how busy each node is, the capacity is reported periodically
+type CapacityReporter interface {
+	ReportCapacity(capacity types.NodeCapacity) error
+}
+
+// Types holds every orchestrator that can be picked with `type` in the [orchestrator] config
+var Types = registry.New[Orchestrator]("orchestrator")
 
-	var or Orchestrator
+func init() {
+	registry.Register(Types, "dummy", func(cfg dummy.Config) (Orchestrator, error) {
+		return dummy.New(cfg, cfg.Hostname), nil
+	})
+	registry.Register(Types, "rt", func(cfg rt.Config) (Orchestrator, error) {
+		return rt.New(cfg.Hostname, cfg.Endpoint, cfg.Key, cfg.WHEPEndpoint), nil
+	})
+	// TODO: ftl orchestrator
+}
 
-	switch orCfg.Type {
-	case "dummy":
-		or = dummy.New(dummy.Config{}, hostname)
-	case "rt":
-		or = rt.New(hostname, orCfg.Endpoint, orCfg.Key, orCfg.WHEPEndpoint)
-		// case "ftl":
-		// TODO: ftl orchestrator
-	default:
-		panic("unknown orchestrator type")
+// New creates the configured orchestrator, `hostname` is taken from the machine unless it's set in the config
+func New(cfg config.Config, hostname string, logger *logrus.Logger) (Orchestrator, error) {
+	or, err := Types.New(withHostname(cfg.Orchestrator, hostname))
+	if err != nil {
+		return nil, err
 	}
 
 	or.SetLogger(logger.WithFields(logrus.Fields{
 		"orchestrator": or.Name(),
 	}))
 
-	return or
+	return or, nil
+}
+
+// Validate checks the [orchestrator] config without connecting to anything
+func Validate(cfg config.Config, hostname string) error {
+	return Types.Validate(withHostname(cfg.Orchestrator, hostname))
+}
+
+func withHostname(src config.Source, hostname string) config.Source {
+	table := make(config.Source, len(src)+1)
+	table["hostname"] = hostname
+	for k, v := range src {
+		table[k] = v
+	}
+	return table
 }
@@ -1,6 +1,7 @@
 package rt
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -26,6 +27,20 @@ type Client struct {
 	WHEPEndpoint string
 }
 
+type Config struct {
+	Hostname     string `fig:"hostname"`
+	Endpoint     string `fig:"endpoint"`
+	Key          string `fig:"key" secret:"true"`
+	WHEPEndpoint string `fig:"whep_endpoint"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Endpoint == "" || cfg.Key == "" || cfg.WHEPEndpoint == "" {
+		return errors.New("endpoint, key and whep_endpoint are required")
+	}
+	return nil
+}
+
 func New(hostname, endpoint, key, whepEndpoint string) *Client {
 	return &Client{
 		hostname:     hostname,
@@ -129,6 +144,62 @@ func (client *Client) Heartbeat(channelID types.ChannelID) error {
 	return nil
 }
 
+// Drain asks RTRouter to stop routing new streams to this node, the streams already
+// here are removed as they stop
+func (client *Client) Drain() error {
+	form := url.Values{}
+	form.Add("hostname", client.hostname)
+
+	req, err := http.NewRequest("POST", client.routerEndpoint("v1/state/drain"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", client.Key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if status := resp.StatusCode; status != http.StatusOK {
+		return fmt.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	return nil
+}
+
+// ReportCapacity tells RTRouter this node's limits and usage, so it can send streams
+// and viewers to another node before this one starts turning them away
+func (client *Client) ReportCapacity(capacity types.NodeCapacity) error {
+	form := url.Values{}
+	form.Add("hostname", client.hostname)
+	form.Add("max_publishers", fmt.Sprint(capacity.MaxPublishers))
+	form.Add("max_viewers", fmt.Sprint(capacity.MaxViewers))
+	form.Add("max_viewers_per_stream", fmt.Sprint(capacity.MaxViewersPerStream))
+	form.Add("max_stream_bitrate", fmt.Sprint(capacity.MaxStreamBitrate))
+	form.Add("publishers", fmt.Sprint(capacity.Publishers))
+	form.Add("viewers", fmt.Sprint(capacity.Viewers))
+
+	req, err := http.NewRequest("POST", client.routerEndpoint("v1/state/capacity"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", client.Key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if status := resp.StatusCode; status != http.StatusOK {
+		return fmt.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	return nil
+}
+
 func (client *Client) routerEndpoint(path string) string {
 	return fmt.Sprintf("%s/%s", client.Endpoint, path)
 }
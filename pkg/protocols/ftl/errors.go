@@ -3,6 +3,7 @@ package ftl
 import "errors"
 
 var ErrClosed = errors.New("connection is closed")
+var ErrServerClosed = errors.New("server is closed")
 var ErrRead = errors.New("error during read")
 var ErrWrite = errors.New("error during write")
 var ErrUnexpectedArguments = errors.New("unexpected arguments")
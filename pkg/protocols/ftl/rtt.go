@@ -0,0 +1,65 @@
+package ftl
+
+import (
+	"sync"
+	"time"
+)
+
+// nackTimeout is how long we wait for a retransmission before giving up on the RTT sample
+const nackTimeout = time.Second
+
+// nackTracker remembers when we asked the client to retransmit a packet, the
+// retransmitted packet arriving gives us a round trip time sample.
+type nackTracker struct {
+	mu     sync.Mutex
+	sentAt map[uint16]time.Time
+	// srtt is smoothed the same way as TCP, see RFC 6298
+	srtt time.Duration
+}
+
+func newNackTracker() *nackTracker {
+	return &nackTracker{
+		sentAt: make(map[uint16]time.Time),
+	}
+}
+
+func (t *nackTracker) sent(seqs []uint16, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for seq, at := range t.sentAt {
+		if now.Sub(at) > nackTimeout {
+			delete(t.sentAt, seq)
+		}
+	}
+	for _, seq := range seqs {
+		if _, ok := t.sentAt[seq]; !ok {
+			t.sentAt[seq] = now
+		}
+	}
+}
+
+// received returns the smoothed round trip time if seq is a packet we've asked to be retransmitted
+func (t *nackTracker) received(seq uint16, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at, ok := t.sentAt[seq]
+	if !ok {
+		return 0, false
+	}
+	delete(t.sentAt, seq)
+
+	sample := now.Sub(at)
+	if sample > nackTimeout {
+		return 0, false
+	}
+
+	if t.srtt == 0 {
+		t.srtt = sample
+	} else {
+		t.srtt = (7*t.srtt + sample) / 8
+	}
+
+	return t.srtt, true
+}
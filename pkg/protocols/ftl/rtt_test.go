@@ -0,0 +1,36 @@
+package ftl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNackTrackerRTT(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newNackTracker()
+	now := time.Now()
+
+	tracker.sent([]uint16{10, 11}, now)
+
+	_, ok := tracker.received(9, now.Add(10*time.Millisecond))
+	assert.False(ok)
+
+	rtt, ok := tracker.received(10, now.Add(80*time.Millisecond))
+	assert.True(ok)
+	assert.Equal(80*time.Millisecond, rtt)
+
+	rtt, ok = tracker.received(11, now.Add(160*time.Millisecond))
+	assert.True(ok)
+	assert.Equal(90*time.Millisecond, rtt)
+
+	// Only the first retransmission counts
+	_, ok = tracker.received(11, now.Add(200*time.Millisecond))
+	assert.False(ok)
+
+	// Retransmissions that took too long are dropped
+	tracker.sent([]uint16{12}, now)
+	_, ok = tracker.received(12, now.Add(2*nackTimeout))
+	assert.False(ok)
+}
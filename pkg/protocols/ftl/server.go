@@ -12,6 +12,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/interceptor"
@@ -49,17 +50,29 @@ type ConnConfig struct {
 }
 
 type Handler interface {
-	GetHmacKey() (string, error)
-
-	OnConnect(ChannelID) error
+	// OnConnect is called once the client has sent its HMAC, verify reports whether
+	// it was signed with the key. Returning ErrInvalidHmacHash tells the client its
+	// stream key is wrong, any other error tells it to try another server.
+	OnConnect(channelID ChannelID, verify func(key []byte) bool) error
 	OnPlay(FtlConnectionMetadata) error
 	OnVideo(*rtp.Packet) error
 	OnAudio(*rtp.Packet) error
+	// OnNack is called with the number of packets we've asked the client to retransmit
+	OnNack(count int)
+	// OnRTT is called with the smoothed round trip time, measured from NACKs to their retransmission.
+	// It's only called once packets have been lost, the client's PING packets are echoed back
+	// for the client to time and carry nothing the server can time on its own
+	OnRTT(rtt time.Duration)
+	// OnDisconnect is called when the client ends the stream on purpose, OnClose is called after
+	OnDisconnect()
 	OnClose()
 }
 
 type ServerConfig struct {
 	Log logrus.FieldLogger
+	// Allow is checked as soon as a client connects, it's disconnected straight
+	// away when it returns false. Every client is allowed when it's nil.
+	Allow func(net.Conn) bool
 	// OnNewConnect is triggered on any connect to the FTL port, however it's not a
 	// qualified FTL client until Handler.OnConnect is called.
 	OnNewConnect func(net.Conn) (net.Conn, *ConnConfig)
@@ -76,20 +89,37 @@ type Server struct {
 	config *ServerConfig
 	log    logrus.FieldLogger
 
+	mu       sync.Mutex
 	listener net.Listener
+	closed   bool
 }
 
 func (srv *Server) Serve(listener net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
 	srv.listener = listener
+	srv.mu.Unlock()
 
 	for {
 		// Each client
 		socket, err := listener.Accept()
 		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
 			srv.log.Error(err)
 			continue
 		}
 
+		if srv.config.Allow != nil && !srv.config.Allow(socket) {
+			socket.Close()
+			continue
+		}
+
 		conn, clientConfig := srv.config.OnNewConnect(socket)
 
 		ftlConn := FtlConnection{
@@ -143,6 +173,29 @@ func (srv *Server) Serve(listener net.Listener) error {
 	}
 }
 
+// Close stops accepting connections, connected clients are left to finish their streams
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return nil
+	}
+	srv.closed = true
+
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Close()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
 type FtlConnection struct {
 	log logrus.FieldLogger
 
@@ -187,6 +240,16 @@ type FtlConnectionMetadata struct {
 	AudioIngestSsrc  uint
 }
 
+// Terminate tells the client we've ended its stream and closes the control connection,
+// the rest of the connection is cleaned up as the read fails
+func Terminate(transport net.Conn) error {
+	_, err := transport.Write([]byte(responseServerTerminate + "\n"))
+	if closeErr := transport.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (conn *FtlConnection) SendMessage(message string) error {
 	message = message + "\n"
 	conn.log.Debugf("FTL SEND: %s", message)
@@ -242,6 +305,7 @@ func (conn *FtlConnection) processHmacCommand() error {
 
 func (conn *FtlConnection) processDisconnectCommand(message string) error {
 	conn.log.Println("Got Disconnect command, closing stuff.")
+	conn.handler.OnDisconnect()
 
 	return conn.Close()
 }
@@ -273,31 +337,30 @@ func (conn *FtlConnection) processConnectCommand(message string) error {
 
 	conn.channelID = channelId
 
-	if err := conn.handler.OnConnect(ChannelID(conn.channelID)); err != nil {
-		return err
-	}
-
-	hmacKey, err := conn.handler.GetHmacKey()
-	if err != nil {
-		return err
-	}
-
-	hash := hmac.New(sha512.New, []byte(hmacKey))
-	hash.Write(conn.hmacPayload)
-	conn.hmacPayload = hash.Sum(nil)
-
 	hmacBytes, err := hex.DecodeString(hmacHashStr)
 	if err != nil {
 		return ErrInvalidHmacHex
 	}
-
-	conn.hasAuthenticated = true
 	conn.clientHmacHash = hmacBytes
 
-	if !hmac.Equal(conn.clientHmacHash, conn.hmacPayload) {
-		return ErrInvalidHmacHash
+	verify := func(key []byte) bool {
+		hash := hmac.New(sha512.New, key)
+		hash.Write(conn.hmacPayload)
+		return hmac.Equal(conn.clientHmacHash, hash.Sum(nil))
 	}
 
+	if err := conn.handler.OnConnect(ChannelID(conn.channelID), verify); err != nil {
+		if errors.Is(err, ErrInvalidHmacHash) {
+			conn.SendMessage(responseInvalidStreamKey)
+		} else {
+			// Let the client know it's us, so it can try another server
+			conn.SendMessage(responseInternalServerError)
+		}
+		return err
+	}
+
+	conn.hasAuthenticated = true
+
 	return conn.SendMessage(responseOk)
 }
 
@@ -432,6 +495,8 @@ func (conn *FtlConnection) listenForMedia() error {
 		return err
 	}
 
+	nacks := newNackTracker()
+
 	// Create our interceptor chain with just a NACK Generator
 	chain := interceptor.NewChain([]interceptor.Interceptor{generator})
 
@@ -471,6 +536,10 @@ func (conn *FtlConnection) listenForMedia() error {
 
 			// The FTL client actually tells us what PayloadType to use for these: VideoPayloadType & AudioPayloadType
 			if packet.Header.PayloadType == conn.Metadata.VideoPayloadType {
+				if rtt, ok := nacks.received(packet.SequenceNumber, time.Now()); ok {
+					conn.handler.OnRTT(rtt)
+				}
+
 				if err := conn.handler.OnVideo(packet); err != nil {
 					conn.log.Error(errors.Wrap(ErrWrite, err.Error()))
 					return
@@ -535,6 +604,13 @@ func (conn *FtlConnection) listenForMedia() error {
 						switch report := r.(type) {
 						case *rtcp.TransportLayerNack:
 							conn.log.Infof("RTCP: Sending NACK to SSRC=%d for Media SSRC=%d", report.SenderSSRC, report.MediaSSRC)
+
+							var seqs []uint16
+							for _, pair := range report.Nacks {
+								seqs = append(seqs, pair.PacketList()...)
+							}
+							nacks.sent(seqs, time.Now())
+							conn.handler.OnNack(len(seqs))
 						default:
 							if stringer, canString := r.(fmt.Stringer); canString {
 								conn.log.Debugf("RTCP: Unexpected RTCP packet: %s", stringer.String())
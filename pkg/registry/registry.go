@@ -0,0 +1,184 @@
+// Package registry maps the type names used in the config onto their constructors,
+// so inputs, outputs, services and orchestrators can be added without touching a switch.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Glimesh/waveguide/config"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Table is the raw TOML table of a single input, output, service or orchestrator
+type Table = map[string]interface{}
+
+// TypeKey is the key in the table naming the registered type
+const TypeKey = "type"
+
+// Validator is implemented by configs that need checking after they're decoded
+type Validator interface {
+	Validate() error
+}
+
+var ErrMissingType = errors.New("missing type")
+
+// factory decodes and validates the table, returning the constructor call for it
+type factory[T any] func(Table) (func() (T, error), error)
+
+type Registry[T any] struct {
+	// kind is used in errors, eg: input
+	kind string
+
+	mu        sync.RWMutex
+	factories map[string]factory[T]
+}
+
+func New[T any](kind string) *Registry[T] {
+	return &Registry[T]{
+		kind:      kind,
+		factories: make(map[string]factory[T]),
+	}
+}
+
+// Register adds a type to the registry. Its config is decoded from the rest of the
+// table using the `fig` struct tags, and validated if it implements Validator.
+func Register[T, C any](r *Registry[T], name string, constructor func(C) (T, error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.factories[name]; ok {
+		panic(fmt.Sprintf("registry: %s type %s registered twice", r.kind, name))
+	}
+
+	r.factories[name] = func(table Table) (func() (T, error), error) {
+		var cfg C
+		if err := Decode(table, &cfg); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", r.kind, name, err)
+		}
+		if v, ok := interface{}(&cfg).(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", r.kind, name, err)
+			}
+		}
+
+		return func() (T, error) {
+			return constructor(cfg)
+		}, nil
+	}
+}
+
+// New creates whatever type the table names
+func (r *Registry[T]) New(table Table) (T, error) {
+	construct, err := r.build(table)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return construct()
+}
+
+// Validate checks the table without creating anything
+func (r *Registry[T]) Validate(table Table) error {
+	_, err := r.build(table)
+	return err
+}
+
+func (r *Registry[T]) build(table Table) (func() (T, error), error) {
+	name, _ := table[TypeKey].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%s: %w", r.kind, ErrMissingType)
+	}
+
+	r.mu.RLock()
+	factory, ok := r.factories[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported %s type %s, expected one of %v", r.kind, name, r.Names())
+	}
+
+	return factory(table)
+}
+
+// Names of the registered types, sorted
+func (r *Registry[T]) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decode the table into the config struct, unknown keys are an error so typos don't go unnoticed.
+// Fields tagged `secret:"true"` can also be read from a file given as `<key>_file`.
+// Values are weakly typed since environment variables are always strings.
+func Decode(table Table, cfg interface{}) error {
+	fields := make(Table, len(table))
+	for k, v := range table {
+		if k != TypeKey {
+			fields[k] = v
+		}
+	}
+
+	if err := readSecretFiles(fields, cfg); err != nil {
+		return err
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:          "fig",
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		Result:           cfg,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(fields)
+}
+
+// readSecretFiles replaces `<key>_file` with the contents of the file for every secret field of cfg
+func readSecretFiles(fields Table, cfg interface{}) error {
+	t := reflect.TypeOf(cfg)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+
+		key := strings.Split(field.Tag.Get("fig"), ",")[0]
+		path, ok := fields[key+"_file"].(string)
+		if !ok {
+			continue
+		}
+		if _, ok := fields[key]; ok {
+			return fmt.Errorf("%s is set directly as well as from %s_file", key, key)
+		}
+
+		secret, err := config.ReadSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_file: %w", key, err)
+		}
+		fields[key] = secret
+		delete(fields, key+"_file")
+	}
+
+	return nil
+}
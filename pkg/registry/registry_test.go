@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfig struct {
+	Address string        `fig:"address"`
+	Timeout time.Duration `fig:"timeout"`
+}
+
+func (cfg *testConfig) Validate() error {
+	if cfg.Address == "" {
+		return errors.New("address is required")
+	}
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New[string]("input")
+	Register(r, "test", func(cfg testConfig) (string, error) {
+		return cfg.Address + " " + cfg.Timeout.String(), nil
+	})
+
+	v, err := r.New(Table{"type": "test", "address": ":1935", "timeout": "5s"})
+	assert.NoError(err)
+	assert.Equal(":1935 5s", v)
+
+	_, err = r.New(Table{"type": "test"})
+	assert.EqualError(err, "input test: address is required")
+
+	_, err = r.New(Table{"type": "test", "address": ":1935", "adress": ":1935"})
+	assert.Error(err, "unknown keys are rejected")
+
+	_, err = r.New(Table{"address": ":1935"})
+	assert.ErrorIs(err, ErrMissingType)
+
+	_, err = r.New(Table{"type": "other"})
+	assert.EqualError(err, "unsupported input type other, expected one of [test]")
+
+	assert.Panics(func() {
+		Register(r, "test", func(cfg testConfig) (string, error) { return "", nil })
+	})
+}
+
+func TestDecodeSecretFile(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "key")
+	assert.NoError(os.WriteFile(path, []byte("hunter2\n"), 0600))
+
+	var cfg struct {
+		Key  string `fig:"key" secret:"true"`
+		Port int    `fig:"port"`
+	}
+	assert.NoError(Decode(Table{"key_file": path, "port": "8080"}, &cfg))
+	assert.Equal("hunter2", cfg.Key)
+	assert.Equal(8080, cfg.Port, "strings from the environment are converted")
+
+	err := Decode(Table{"key": "hunter2", "key_file": path}, &cfg)
+	assert.Error(err, "the secret can only be set once")
+}
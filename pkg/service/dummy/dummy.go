@@ -15,9 +15,13 @@ type Service struct {
 }
 
 type Config struct {
-	Address      string
-	ClientID     string
-	ClientSecret string
+	Address      string `fig:"address"`
+	ClientID     string `fig:"client_id"`
+	ClientSecret string `fig:"client_secret" secret:"true"`
+	// TokenChannels require a playback token to watch, for testing private streams
+	TokenChannels []int `fig:"token_channels"`
+	// RevokedChannels have their streams ended on the next heartbeat, for testing bans
+	RevokedChannels []int `fig:"revoked_channels"`
 }
 
 func New(config Config) *Service {
@@ -47,6 +51,29 @@ func (s *Service) GetHmacKey(channelID types.ChannelID) ([]byte, error) {
 	return []byte(hmacKey), nil
 }
 
+func (s *Service) GetPlaybackPolicy(channelID types.ChannelID) (types.PlaybackPolicy, error) {
+	for _, id := range s.config.TokenChannels {
+		if types.ChannelID(id) == channelID {
+			return types.PlaybackToken, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *Service) CheckStream(channelID types.ChannelID, streamID types.StreamID) (string, error) {
+	for _, id := range s.config.RevokedChannels {
+		if types.ChannelID(id) == channelID {
+			return "channel is revoked", nil
+		}
+	}
+	return "", nil
+}
+
+func (s *Service) WarnStream(channelID types.ChannelID, streamID types.StreamID, message string) error {
+	s.log.Warnf("Warning streamer of channel_id=%d stream_id=%d: %s", channelID, streamID, message)
+	return nil
+}
+
 func (s *Service) StartStream(channelID types.ChannelID) (types.StreamID, error) {
 	return types.StreamID(channelID + 1), nil
 }
@@ -3,6 +3,7 @@ package glimesh
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"mime/multipart"
 	"net/http"
@@ -29,6 +30,19 @@ type Service struct {
 	ClientSecret string `mapstructure:"client_secret"`
 }
 
+type Config struct {
+	Endpoint     string `fig:"endpoint"`
+	ClientID     string `fig:"client_id"`
+	ClientSecret string `fig:"client_secret" secret:"true"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Endpoint == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return errors.New("endpoint, client_id and client_secret are required")
+	}
+	return nil
+}
+
 func New(endpoint, clientID, clientSecret string) *Service {
 	return &Service{
 		Endpoint:     endpoint,
@@ -106,7 +120,51 @@ func (s *Service) EndStream(streamID types.StreamID) error {
 	})
 }
 
-type StreamMetadataInput types.StreamMetadata
+// CheckStream ends the stream once it's no longer the channel's stream on Glimesh,
+// eg: it was ended by staff or the channel was banned
+func (s *Service) CheckStream(channelID types.ChannelID, streamID types.StreamID) (string, error) {
+	var channelQuery struct {
+		Channel struct {
+			Stream *struct {
+				Id graphql.String
+			}
+		} `graphql:"channel(id: $id)"`
+	}
+	err := s.client.Query(context.Background(), &channelQuery, map[string]interface{}{
+		"id": graphql.ID(fmt.Sprint(channelID)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	stream := channelQuery.Channel.Stream
+	if stream == nil {
+		return "stream was ended by Glimesh", nil
+	}
+	if string(stream.Id) != fmt.Sprint(streamID) {
+		return fmt.Sprintf("stream was replaced by stream_id=%s", stream.Id), nil
+	}
+	return "", nil
+}
+
+// StreamMetadataInput only has the fields Glimesh's schema accepts, the rest of
+// types.StreamMetadata is ours until the schema has them
+type StreamMetadataInput struct {
+	AudioCodec        string
+	IngestServer      string
+	IngestViewers     int
+	LostPackets       int
+	NackPackets       int
+	RecvPackets       int
+	SourceBitrate     int
+	SourcePing        *int `json:",omitempty"` // left out until it's been measured
+	StreamTimeSeconds int
+	VendorName        string
+	VendorVersion     string
+	VideoCodec        string
+	VideoHeight       int
+	VideoWidth        int
+}
 
 func (s *Service) UpdateStreamMetadata(streamID types.StreamID, metadata types.StreamMetadata) error {
 	var logStreamMetadata struct {
@@ -0,0 +1,47 @@
+package glimesh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateStreamMetadataOnlySendsSchemaFields(t *testing.T) {
+	assert := assert.New(t)
+
+	var metadata map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Variables map[string]json.RawMessage `json:"variables"`
+		}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		assert.NoError(json.Unmarshal(body.Variables["metadata"], &metadata))
+
+		w.Write([]byte(`{"data": {"logStreamMetadata": {"id": "5678"}}}`))
+	}))
+	defer srv.Close()
+
+	s := &Service{client: graphql.NewClient(srv.URL, nil)}
+	assert.NoError(s.UpdateStreamMetadata(5678, types.StreamMetadata{
+		VideoCodec:     "video/H264",
+		VideoBFrames:   true,
+		VideoFramerate: 60,
+		Encoder:        "obs-output module (libobs version 29.1.3)",
+	}))
+
+	assert.Equal("video/H264", metadata["VideoCodec"])
+	for _, field := range []string{"VideoBFrames", "VideoFramerate", "DeclaredVideoBitrate", "DeclaredAudioBitrate", "Encoder"} {
+		assert.NotContains(metadata, field, "Glimesh's schema doesn't have it yet")
+	}
+	assert.NotContains(metadata, "SourcePing", "an unmeasured ping is left out")
+
+	ping := 42
+	assert.NoError(s.UpdateStreamMetadata(5678, types.StreamMetadata{SourcePing: &ping}))
+	assert.Equal(float64(42), metadata["SourcePing"])
+}
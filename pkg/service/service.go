@@ -2,6 +2,7 @@ package service
 
 import (
 	"github.com/Glimesh/waveguide/config"
+	"github.com/Glimesh/waveguide/pkg/registry"
 	"github.com/Glimesh/waveguide/pkg/service/dummy"
 	"github.com/Glimesh/waveguide/pkg/service/glimesh"
 	"github.com/Glimesh/waveguide/pkg/types"
@@ -28,22 +29,58 @@ type Service interface {
 	SendJpegPreviewImage(streamID types.StreamID, img []byte) error
 }
 
-func New(cfg config.Config, logger *logrus.Logger) Service {
-	svcCfg := cfg.Service
-	var svc Service
+// PlaybackPolicyService is implemented by services that decide who can watch each channel
+type PlaybackPolicyService interface {
+	// GetPlaybackPolicy returns an empty policy when the service has no opinion
+	GetPlaybackPolicy(channelID types.ChannelID) (types.PlaybackPolicy, error)
+}
+
+// StreamCheckService is implemented by services that can end a live stream, eg:
+// when the channel is banned or its stream key is revoked
+type StreamCheckService interface {
+	// CheckStream is called on every heartbeat, it returns a reason when the stream must end
+	CheckStream(channelID types.ChannelID, streamID types.StreamID) (reason string, err error)
+}
+
+// StreamWarningService is implemented by services that can show the streamer a
+// warning about their stream, eg: their encoder settings won't play well
+type StreamWarningService interface {
+	WarnStream(channelID types.ChannelID, streamID types.StreamID, message string) error
+}
+
+// TerminationNotifier is implemented by services that push the streams that must
+// end instead of waiting for the next heartbeat
+type TerminationNotifier interface {
+	// Terminations is read until it's closed
+	Terminations() <-chan types.Termination
+}
+
+// Types holds every service that can be picked with `type` in the [service] config
+var Types = registry.New[Service]("service")
+
+func init() {
+	registry.Register(Types, "dummy", func(cfg dummy.Config) (Service, error) {
+		return dummy.New(cfg), nil
+	})
+	registry.Register(Types, "glimesh", func(cfg glimesh.Config) (Service, error) {
+		return glimesh.New(cfg.Endpoint, cfg.ClientID, cfg.ClientSecret), nil
+	})
+}
 
-	switch svcCfg.Type {
-	case "dummy":
-		svc = dummy.New(dummy.Config{})
-	case "glimesh":
-		svc = glimesh.New(svcCfg.Endpoint, svcCfg.ClientID, svcCfg.ClientSecret)
-	default:
-		panic("unsupported service type")
+func New(cfg config.Config, logger *logrus.Logger) (Service, error) {
+	svc, err := Types.New(cfg.Service)
+	if err != nil {
+		return nil, err
 	}
 
 	svc.SetLogger(logger.WithFields(logrus.Fields{
 		"service": svc.Name(),
 	}))
 
-	return svc
+	return svc, nil
+}
+
+// Validate checks the [service] config without connecting to anything
+func Validate(cfg config.Config) error {
+	return Types.Validate(cfg.Service)
 }
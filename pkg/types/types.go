@@ -22,11 +22,49 @@ type StreamMetadata struct {
 	NackPackets       int
 	RecvPackets       int
 	SourceBitrate     int
-	SourcePing        int
+	SourcePing        *int // milliseconds, nil until it's been measured
 	StreamTimeSeconds int
 	VendorName        string
 	VendorVersion     string
 	VideoCodec        string
 	VideoHeight       int
 	VideoWidth        int
+	// VideoBFrames is set once the publisher has sent B-frames
+	VideoBFrames bool
+	// VideoFramerate, the declared bitrates in bits per second and Encoder are
+	// what the publisher says it's sending, when it says
+	VideoFramerate       float64
+	DeclaredVideoBitrate int
+	DeclaredAudioBitrate int
+	Encoder              string
+}
+
+// PlaybackPolicy is who can watch a channel
+type PlaybackPolicy string
+
+const (
+	PlaybackPublic PlaybackPolicy = "public"
+	// PlaybackToken requires viewers to have a signed playback token
+	PlaybackToken PlaybackPolicy = "token"
+)
+
+// Termination is a service telling us a live stream must end, eg: the channel was banned
+type Termination struct {
+	ChannelID ChannelID
+	// StreamID is zero when whatever stream the channel has should end
+	StreamID StreamID
+	Reason   string
+}
+
+// NodeCapacity is how much a node will take and how much it has taken, zero limits are unlimited
+type NodeCapacity struct {
+	Hostname            string
+	MaxPublishers       int
+	MaxViewers          int
+	MaxViewersPerStream int
+	// MaxStreamBitrate is the ingest bitrate limit of each stream in bits per second
+	MaxStreamBitrate int
+
+	Publishers int
+	Viewers    int
 }
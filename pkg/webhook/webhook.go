@@ -0,0 +1,308 @@
+// Package webhook delivers signed stream lifecycle events to an HTTP endpoint.
+//
+// Every event is POSTed as JSON with the following headers:
+//
+//	X-Waveguide-Event: stream.started
+//	X-Waveguide-Timestamp: 1665000000
+//	X-Waveguide-Signature: sha256=<hex hmac>
+//
+// The signature is the HMAC-SHA256 of "<timestamp>.<body>" using the configured
+// secret, receivers should reject old timestamps to avoid replays. Events are
+// delivered by a few workers and retried in the background, so they can arrive
+// out of order, receivers should go by the time in the event.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	EventStreamAuthenticated EventType = "stream.authenticated"
+	EventStreamStarted       EventType = "stream.started"
+	EventStreamStopped       EventType = "stream.stopped"
+	EventStreamTakenOver     EventType = "stream.taken_over"
+	EventHeartbeatFailed     EventType = "stream.heartbeat_failed"
+	EventThumbnailGenerated  EventType = "stream.thumbnail_generated"
+	EventViewerJoined        EventType = "viewer.joined"
+	EventViewerLeft          EventType = "viewer.left"
+)
+
+const (
+	HeaderEvent     = "X-Waveguide-Event"
+	HeaderTimestamp = "X-Waveguide-Timestamp"
+	HeaderSignature = "X-Waveguide-Signature"
+)
+
+type Event struct {
+	Type      EventType       `json:"type"`
+	Time      time.Time       `json:"time"`
+	ChannelID types.ChannelID `json:"channel_id"`
+	StreamID  types.StreamID  `json:"stream_id,omitempty"`
+	Data      interface{}     `json:"data,omitempty"`
+}
+
+type Config struct {
+	URL    string
+	Secret string
+
+	// QueueSize is the number of events waiting to be delivered, new events are dropped when it's full
+	QueueSize int
+	// MaxRetries is the number of attempts after the first one failed
+	MaxRetries int
+	// Backoff is the delay before the first retry, it doubles after every attempt
+	Backoff time.Duration
+	Timeout time.Duration
+}
+
+// workers is how many events are posted at once
+const workers = 4
+
+var eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "waveguide_webhook_events_total",
+	Help: "Webhook events by type and result.",
+}, []string{"type", "result"})
+
+type Dispatcher struct {
+	cfg    Config
+	log    logrus.FieldLogger
+	client *http.Client
+
+	queue chan delivery
+	// ctx is cancelled to give up on the events that haven't been delivered
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+	// active counts the events queued, being posted or waiting for a retry
+	active sync.WaitGroup
+	stop   chan struct{}
+}
+
+// delivery is an event on its way, retries go back on the queue once their backoff is up
+type delivery struct {
+	event   Event
+	body    []byte
+	attempt int
+}
+
+func New(cfg Config, log logrus.FieldLogger) *Dispatcher {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Dispatcher{
+		cfg:    cfg,
+		log:    log,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan delivery, cfg.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start delivers events until Close is called, or the context is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.cancel()
+		case <-d.ctx.Done():
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case next := <-d.queue:
+					d.deliver(next)
+				case <-d.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Send queues the event without blocking, it's safe to call on a nil Dispatcher
+func (d *Dispatcher) Send(eventType EventType, channelID types.ChannelID, streamID types.StreamID, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		Time:      time.Now().UTC(),
+		ChannelID: channelID,
+		StreamID:  streamID,
+		Data:      data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.log.Error(err)
+		eventsTotal.WithLabelValues(string(eventType), "failed").Inc()
+		return
+	}
+
+	d.active.Add(1)
+	if !d.enqueue(delivery{event: event, body: body}) {
+		d.log.Warnf("Webhook queue is full, dropping %s event", eventType)
+	}
+}
+
+// enqueue puts the delivery on the queue without blocking, a delivery that doesn't
+// fit is dropped and no longer active
+func (d *Dispatcher) enqueue(next delivery) bool {
+	select {
+	case d.queue <- next:
+		return true
+	default:
+		eventsTotal.WithLabelValues(string(next.event.Type), "dropped").Inc()
+		d.active.Done()
+		return false
+	}
+}
+
+// Close stops accepting events and waits for the queued events to be delivered,
+// once the context is done the rest are given up on and counted as failed
+func (d *Dispatcher) Close(ctx context.Context) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		d.active.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		d.log.Warnf("Gave up delivering webhooks: %v", ctx.Err())
+		d.cancel()
+		<-idle
+	}
+	d.cancel()
+	close(d.stop)
+}
+
+// deliver posts the event once, failed attempts are retried after their backoff
+// without holding up the worker
+func (d *Dispatcher) deliver(next delivery) {
+	eventType := next.event.Type
+	if d.ctx.Err() != nil {
+		d.fail(eventType)
+		return
+	}
+
+	err := d.post(d.ctx, eventType, next.body)
+	if err == nil {
+		eventsTotal.WithLabelValues(string(eventType), "delivered").Inc()
+		d.active.Done()
+		return
+	}
+
+	if next.attempt >= d.cfg.MaxRetries {
+		d.log.Errorf("Webhook %s failed after %d attempts: %v", eventType, d.cfg.MaxRetries+1, err)
+		d.fail(eventType)
+		return
+	}
+	d.log.Debugf("Webhook %s attempt %d failed: %v", eventType, next.attempt+1, err)
+
+	backoff := d.cfg.Backoff << next.attempt
+	next.attempt++
+	go func() {
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			d.enqueue(next)
+		case <-d.ctx.Done():
+			d.fail(eventType)
+		}
+	}()
+}
+
+func (d *Dispatcher) fail(eventType EventType) {
+	eventsTotal.WithLabelValues(string(eventType), "failed").Inc()
+	d.active.Done()
+}
+
+func (d *Dispatcher) post(ctx context.Context, eventType EventType, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(eventType))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(d.cfg.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded signature receivers should compare against
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
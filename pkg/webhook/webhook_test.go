@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherSignsAndRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var attempts int32
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		expected := "sha256=" + Sign("secret", r.Header.Get(HeaderTimestamp), body)
+		assert.Equal(expected, r.Header.Get(HeaderSignature))
+		assert.Equal(string(EventStreamStarted), r.Header.Get(HeaderEvent))
+
+		var event Event
+		assert.NoError(json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	d := New(Config{URL: srv.URL, Secret: "secret", MaxRetries: 3, Backoff: time.Millisecond}, logger)
+	d.Start(context.Background())
+	d.Send(EventStreamStarted, 1234, 5678, nil)
+	d.Close(context.Background())
+
+	select {
+	case event := <-received:
+		assert.Equal(EventStreamStarted, event.Type)
+		assert.EqualValues(1234, event.ChannelID)
+		assert.EqualValues(5678, event.StreamID)
+	default:
+		t.Fatal("event was not delivered")
+	}
+	assert.Equal(int32(3), atomic.LoadInt32(&attempts))
+
+	// Sending after Close is a no-op
+	d.Send(EventStreamStopped, 1234, 5678, nil)
+}
+
+func TestDispatcherRetriesDontBlockQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	stopped := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderEvent) == string(EventStreamStarted) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		close(stopped)
+	}))
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	d := New(Config{URL: srv.URL, MaxRetries: 1, Backoff: time.Hour}, logger)
+	d.Start(context.Background())
+	d.Send(EventStreamStarted, 1234, 5678, nil)
+	d.Send(EventStreamStopped, 1234, 5678, nil)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		assert.Fail("event was held up behind a retry")
+	}
+}
+
+func TestDispatcherCloseGivesUp(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	d := New(Config{URL: srv.URL, MaxRetries: 3, Timeout: time.Minute}, logger)
+	d.Start(context.Background())
+	for i := 0; i < 10; i++ {
+		d.Send(EventStreamStopped, 1234, 5678, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	d.Close(ctx)
+	assert.Less(time.Since(start), 5*time.Second)
+}